@@ -5,120 +5,427 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/MisterNorwood/SugarCube-Server/internal/utils"
 	"github.com/urfave/cli/v3"
 )
 
+// Execute parses the command line and exits on invalid configuration.
+// It returns an empty SessionCtx when the program shouldn't start, e.g. for --help.
 func Execute() *utils.SessionCtx {
+	session, err := Load(os.Args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	return session
+}
+
+// Load builds the configuration from args, the environment and the config file.
+// It never exits, so it's also used to reload the configuration at runtime.
+func Load(args []string) (*utils.SessionCtx, error) {
 	var SessionCtx utils.SessionCtx
+	defaults := utils.DefaultConfig()
 	app := &cli.Command{
 		Name:    "sugarcube-server",
 		Usage:   "Server for the SugarCube coupon extension",
 		Version: "v1.0.0-alpha.1",
 		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "config",
+				Usage:   "Path to a YAML or JSON config file, flags and env vars override it",
+				Aliases: []string{"c"},
+			},
 			&cli.UintFlag{
 				Name:    "db-port",
-				Value:   27017,
+				Value:   uint64(defaults.DB.Port),
 				Usage:   "Mongod port",
 				Aliases: []string{"d"},
-				Action: func(ctx context.Context, cli *cli.Command, port uint64) error {
-					uid := os.Geteuid()
-					if port > 65535 {
-						return errors.New("Invalid port: Must be a number between 1 and 65535")
-					} else if port <= 1024 && uid != 0 {
-						return errors.New("Invalid port: Ports 1-1024 require root")
-
-					}
-
-					return nil
-				},
 			},
 			&cli.UintFlag{
 				Name:    "port",
-				Value:   80,
+				Value:   uint64(defaults.Server.Port),
 				Usage:   "Port for the program",
 				Aliases: []string{"p"},
-				Action: func(ctx context.Context, cli *cli.Command, port uint64) error {
-					uid := os.Geteuid()
-					if port > 65535 {
-						return errors.New("Invalid port: Must be a number between 1 and 65535")
-					} else if port <= 1024 && uid != 0 {
-						return errors.New("Invalid port: Ports 1-1024 require root")
-
-					}
-
-					return nil
-				},
 			},
 			&cli.StringFlag{
 				Name:    "db-uri",
-				Value:   `localhost`,
-				Usage:   "Port for the program",
+				Value:   defaults.DB.Host,
+				Usage:   "Mongod host, comma separated seed list, or a full mongodb:// or mongodb+srv:// connection string",
 				Aliases: []string{"U"},
 			},
 			&cli.StringFlag{
 				Name:    "db-user",
-				Usage:   "Uatabase username",
+				Usage:   "Database username",
 				Aliases: []string{"u"},
 			},
 			&cli.StringFlag{
 				Name:    "db-password",
-				Usage:   "Database password",
+				Usage:   "Database password, visible in ps, prefer --db-password-file",
 				Aliases: []string{"P"},
 			},
+			&cli.StringFlag{
+				Name:  "db-password-file",
+				Usage: "Read the database password from a file, \"-\" reads it from stdin",
+			},
+			&cli.StringFlag{
+				Name:  "admin-keys-file",
+				Usage: "Read admin API keys from a file, one per line, \"-\" reads them from stdin",
+			},
+			&cli.StringFlag{
+				Name:  "token-secrets-file",
+				Usage: "Read install token signing secrets from a file, one per line, the first signs new tokens",
+			},
+			&cli.BoolFlag{
+				Name:  "require-install-token",
+				Usage: "Require an install token from /api/register on writes and callbacks, off until old extension builds are gone",
+				Value: defaults.Auth.RequireInstallToken,
+			},
+			&cli.UintFlag{
+				Name:  "registrations-per-ip",
+				Usage: "New installs one IP may register per hour, 0 is unlimited",
+				Value: defaults.Auth.RegistrationsPerIP,
+			},
+			&cli.BoolFlag{
+				Name:  "reputation",
+				Usage: "Weight votes by client reputation and hold back submissions from new clients",
+				Value: defaults.Reputation.Enabled,
+			},
+			&cli.BoolFlag{
+				Name:  "db-srv",
+				Usage: "Resolve the database host through DNS SRV records (mongodb+srv)",
+			},
+			&cli.StringFlag{
+				Name:  "db-auth-source",
+				Usage: "Database to authenticate against",
+			},
+			&cli.StringFlag{
+				Name:  "db-replica-set",
+				Usage: "Replica set name",
+			},
+			&cli.StringFlag{
+				Name:  "db-read-preference",
+				Usage: "primary, primaryPreferred, secondary, secondaryPreferred or nearest",
+			},
+			&cli.BoolFlag{
+				Name:  "db-tls",
+				Usage: "Connect to the database over TLS",
+			},
+			&cli.StringFlag{
+				Name:  "db-tls-ca-file",
+				Usage: "PEM file with the CA certificates used to verify the database",
+			},
+			&cli.StringFlag{
+				Name:  "db-tls-cert-key-file",
+				Usage: "PEM file with the client certificate and private key",
+			},
+			&cli.BoolFlag{
+				Name:  "db-tls-insecure",
+				Usage: "Don't verify the database certificate, for testing only",
+			},
 			&cli.BoolFlag{
 				Name:    "debug",
 				Usage:   "enable printing information",
-				Value:   false,
+				Value:   defaults.Debug,
 				Aliases: []string{"D"},
 			},
+			&cli.StringFlag{
+				Name:  "otel-endpoint",
+				Usage: "OTLP/HTTP trace collector endpoint, tracing is disabled when empty",
+			},
+			&cli.FloatFlag{
+				Name:  "otel-sample-ratio",
+				Value: defaults.Tracing.SampleRatio,
+				Usage: "Fraction of root requests to trace (0.0 - 1.0)",
+			},
+			&cli.BoolFlag{
+				Name:  "otel-insecure",
+				Usage: "Send traces over plain HTTP when the endpoint has no scheme",
+				Value: defaults.Tracing.Insecure,
+			},
+			&cli.StringFlag{
+				Name:  "log-privacy",
+				Value: string(defaults.Log.Privacy),
+				Usage: "How sites and coupon codes appear in logs: none, hash or redact",
+			},
+			&cli.StringFlag{
+				Name:  "log-level",
+				Value: defaults.Log.Level,
+				Usage: "Minimum log level: trace, debug, info, warn, error, fatal",
+			},
+			&cli.StringFlag{
+				Name:  "log-format",
+				Value: defaults.Log.Format,
+				Usage: "Format of stdout logs: json or console",
+			},
+			&cli.BoolFlag{
+				Name:  "log-stdout-only",
+				Usage: "Don't write a log file",
+				Value: defaults.Log.StdoutOnly,
+			},
+			&cli.StringFlag{
+				Name:  "log-file",
+				Value: defaults.Log.FilePath,
+				Usage: "Path of the JSON log file",
+			},
+			&cli.UintFlag{
+				Name:  "log-max-size",
+				Value: defaults.Log.MaxSizeMB,
+				Usage: "Rotate the log file after this many megabytes",
+			},
+			&cli.UintFlag{
+				Name:  "log-max-age",
+				Value: defaults.Log.MaxAgeDays,
+				Usage: "Days to keep rotated log files, 0 keeps them forever",
+			},
+			&cli.UintFlag{
+				Name:  "log-max-backups",
+				Value: defaults.Log.MaxBackups,
+				Usage: "Number of rotated log files to keep, 0 keeps all",
+			},
+			&cli.BoolFlag{
+				Name:  "log-compress",
+				Usage: "Gzip rotated log files",
+				Value: defaults.Log.Compress,
+			},
+			&cli.DurationFlag{
+				Name:  "session-ttl",
+				Value: defaults.Sessions.TTL,
+				Usage: "How long a coupon list session stays valid for its callback",
+			},
+			&cli.UintFlag{
+				Name:  "max-sessions",
+				Value: defaults.Sessions.MaxSessions,
+				Usage: "Open sessions across all clients, 0 is unlimited",
+			},
+			&cli.UintFlag{
+				Name:  "sessions-per-ip",
+				Value: defaults.Sessions.MaxPerIP,
+				Usage: "Open sessions per client IP, 0 is unlimited",
+			},
+			&cli.BoolFlag{
+				Name:  "coupons-case-sensitive",
+				Usage: "Treat codes that differ only in case as different coupons",
+				Value: defaults.Coupons.CaseSensitive,
+			},
+			&cli.StringFlag{
+				Name:  "geoip-database",
+				Usage: "MaxMind DB file to look up the country of clients that don't send a region",
+			},
+			&cli.BoolFlag{
+				Name:  "blocklist",
+				Usage: "Periodically import public IP blocklists",
+				Value: defaults.Blocklist.Enabled,
+			},
+			&cli.StringSliceFlag{
+				Name:  "blocklist-source",
+				Value: defaults.Blocklist.Sources,
+				Usage: "URL of an IP blocklist, can be repeated",
+			},
+			&cli.DurationFlag{
+				Name:  "blocklist-interval",
+				Value: defaults.Schedulers.BlocklistInterval,
+				Usage: "How often to refresh the IP blocklist",
+			},
+			&cli.DurationFlag{
+				Name:  "coupon-prune-interval",
+				Value: defaults.Schedulers.CouponPruneInterval,
+				Usage: "How often to delete negative-score coupons",
+			},
+			&cli.DurationFlag{
+				Name:  "session-prune-interval",
+				Value: defaults.Schedulers.SessionPruneInterval,
+				Usage: "How often to drop expired sessions",
+			},
+			&cli.BoolFlag{
+				Name:  "rate-limit",
+				Usage: "Rate limit requests per client IP",
+				Value: defaults.RateLimit.Enabled,
+			},
+			&cli.FloatFlag{
+				Name:  "rate-limit-rps",
+				Value: defaults.RateLimit.RequestsPerSecond,
+				Usage: "Sustained requests per second allowed per client IP",
+			},
+			&cli.UintFlag{
+				Name:  "rate-limit-burst",
+				Value: defaults.RateLimit.Burst,
+				Usage: "Requests a client IP may burst above the sustained rate",
+			},
+			&cli.StringSliceFlag{
+				Name:  "cors-origin",
+				Usage: "Origin allowed to call the API from a browser, can be repeated",
+			},
 		},
 
 		Action: func(ctx context.Context, cli *cli.Command) error {
+			SessionCtx = utils.DefaultConfig()
+			l := &loader{cli: cli}
+
+			configFile := ""
+			layer(l, "config", utils.EnvConfigFile, &configFile, cli.String)
+			if configFile != "" {
+				if err := utils.LoadConfigFile(configFile, &SessionCtx); err != nil {
+					return err
+				}
+				SessionCtx.ConfigFile = configFile
+			}
 
 			//No, there is no better way to do this
 
-			dbPort, err := utils.CheckForEnv(utils.EnvDBPort, cli.Uint("db-port"))
-			checkEnvErr(err)
-			SessionCtx.DbPort = uint16(dbPort)
+			dbPort := uint64(SessionCtx.DB.Port)
+			layer(l, "db-port", utils.EnvDBPort, &dbPort, cli.Uint)
+			webPort := uint64(SessionCtx.Server.Port)
+			layer(l, "port", utils.EnvPort, &webPort, cli.Uint)
+			if dbPort > 65535 {
+				return &utils.ConfigError{Key: "db.port", Msg: "must be a number between 1 and 65535"}
+			}
+			if webPort > 65535 {
+				return &utils.ConfigError{Key: "server.port", Msg: "must be a number between 1 and 65535"}
+			}
+			SessionCtx.DB.Port = uint16(dbPort)
+			SessionCtx.Server.Port = uint16(webPort)
+
+			dbTarget := ""
+			layer(l, "db-uri", utils.EnvDBURI, &dbTarget, cli.String)
+			if uri, host := utils.SplitDBURI(dbTarget); uri != "" {
+				SessionCtx.DB.URI = uri
+			} else if host != "" {
+				SessionCtx.DB.Host = host
+			}
+			layer(l, "db-user", utils.EnvDBUser, &SessionCtx.DB.User, cli.String)
+			layerSecret(l, "db.password", "db-password", utils.EnvDBPassword, utils.EnvDBPasswordFile, &SessionCtx.DB.Password, &SessionCtx.DB.PasswordFile)
+			layer(l, "db-srv", utils.EnvDBSRV, &SessionCtx.DB.SRV, cli.Bool)
+			layer(l, "db-auth-source", utils.EnvDBAuthSource, &SessionCtx.DB.AuthSource, cli.String)
+			layer(l, "db-replica-set", utils.EnvDBReplicaSet, &SessionCtx.DB.ReplicaSet, cli.String)
+			layer(l, "db-read-preference", utils.EnvDBReadPreference, &SessionCtx.DB.ReadPreference, cli.String)
+			layer(l, "db-tls", utils.EnvDBTLS, &SessionCtx.DB.TLS.Enabled, cli.Bool)
+			layer(l, "db-tls-ca-file", utils.EnvDBTLSCAFile, &SessionCtx.DB.TLS.CAFile, cli.String)
+			layer(l, "db-tls-cert-key-file", utils.EnvDBTLSCertKeyFile, &SessionCtx.DB.TLS.CertKeyFile, cli.String)
+			layer(l, "db-tls-insecure", utils.EnvDBTLSInsecure, &SessionCtx.DB.TLS.Insecure, cli.Bool)
+			layer(l, "debug", utils.EnvDebug, &SessionCtx.Debug, cli.Bool)
+
+			layer(l, "otel-endpoint", utils.EnvOtelEndpoint, &SessionCtx.Tracing.Endpoint, cli.String)
+			layer(l, "otel-sample-ratio", utils.EnvOtelSampleRatio, &SessionCtx.Tracing.SampleRatio, cli.Float)
+			layer(l, "otel-insecure", utils.EnvOtelInsecure, &SessionCtx.Tracing.Insecure, cli.Bool)
 
-			webPort, err := utils.CheckForEnv(utils.EnvPort, cli.Uint("port"))
-			checkEnvErr(err)
-			SessionCtx.ServerPort = uint16(webPort)
+			privacy := string(SessionCtx.Log.Privacy)
+			layer(l, "log-privacy", utils.EnvLogPrivacy, &privacy, cli.String)
+			SessionCtx.Log.Privacy = utils.PrivacyMode(privacy)
+			if mode, ok := utils.ParsePrivacyMode(privacy); ok {
+				SessionCtx.Log.Privacy = mode
+			}
+			layer(l, "log-level", utils.EnvLogLevel, &SessionCtx.Log.Level, cli.String)
+			layer(l, "log-format", utils.EnvLogFormat, &SessionCtx.Log.Format, cli.String)
+			layer(l, "log-stdout-only", utils.EnvLogStdoutOnly, &SessionCtx.Log.StdoutOnly, cli.Bool)
+			layer(l, "log-file", utils.EnvLogFile, &SessionCtx.Log.FilePath, cli.String)
+			layer(l, "log-max-size", utils.EnvLogMaxSize, &SessionCtx.Log.MaxSizeMB, cli.Uint)
+			layer(l, "log-max-age", utils.EnvLogMaxAge, &SessionCtx.Log.MaxAgeDays, cli.Uint)
+			layer(l, "log-max-backups", utils.EnvLogMaxBackups, &SessionCtx.Log.MaxBackups, cli.Uint)
+			layer(l, "log-compress", utils.EnvLogCompress, &SessionCtx.Log.Compress, cli.Bool)
 
-			uri, err := utils.CheckForEnv(utils.EnvDBURI, cli.String("db-uri"))
-			checkEnvErr(err)
-			SessionCtx.DbUri = uri
+			layer(l, "session-ttl", utils.EnvSessionTTL, &SessionCtx.Sessions.TTL, cli.Duration)
+			layer(l, "max-sessions", utils.EnvMaxSessions, &SessionCtx.Sessions.MaxSessions, cli.Uint)
+			layer(l, "sessions-per-ip", utils.EnvSessionsPerIP, &SessionCtx.Sessions.MaxPerIP, cli.Uint)
+			layer(l, "coupons-case-sensitive", utils.EnvCouponsCaseSensitive, &SessionCtx.Coupons.CaseSensitive, cli.Bool)
+			layer(l, "geoip-database", utils.EnvGeoIPDatabase, &SessionCtx.GeoIP.Database, cli.String)
+			layer(l, "blocklist", utils.EnvBlocklistEnabled, &SessionCtx.Blocklist.Enabled, cli.Bool)
+			layer(l, "blocklist-source", utils.EnvBlocklistSources, &SessionCtx.Blocklist.Sources, cli.StringSlice)
+			layer(l, "blocklist-interval", utils.EnvBlocklistInterval, &SessionCtx.Schedulers.BlocklistInterval, cli.Duration)
+			layer(l, "coupon-prune-interval", utils.EnvCouponPruneInterval, &SessionCtx.Schedulers.CouponPruneInterval, cli.Duration)
+			layer(l, "session-prune-interval", utils.EnvSessionPruneInterval, &SessionCtx.Schedulers.SessionPruneInterval, cli.Duration)
 
-			user, err := utils.CheckForEnv(utils.EnvDBUser, cli.String("db-user"))
-			checkEnvErr(err)
-			SessionCtx.DbUser = user
+			layer(l, "rate-limit", utils.EnvRateLimitEnabled, &SessionCtx.RateLimit.Enabled, cli.Bool)
+			layer(l, "rate-limit-rps", utils.EnvRateLimitRPS, &SessionCtx.RateLimit.RequestsPerSecond, cli.Float)
+			layer(l, "rate-limit-burst", utils.EnvRateLimitBurst, &SessionCtx.RateLimit.Burst, cli.Uint)
+			layer(l, "cors-origin", utils.EnvCORSOrigins, &SessionCtx.CORS.AllowOrigins, cli.StringSlice)
 
-			pass, err := utils.CheckForEnv(utils.EnvDBPassword, cli.String("db-password"))
-			checkEnvErr(err)
-			SessionCtx.DbPassword = pass
+			// Admin keys have no plain flag, it would show them in ps
+			adminKeys := strings.Join(SessionCtx.Admin.APIKeys, ",")
+			layerSecret(l, "admin.api_keys", "admin-keys", utils.EnvAdminKeys, utils.EnvAdminKeysFile, &adminKeys, &SessionCtx.Admin.APIKeysFile)
+			SessionCtx.Admin.APIKeys = utils.SplitSecretList(adminKeys)
+			utils.RegisterSecret(SessionCtx.Admin.APIKeys...)
 
-			debug, err := utils.CheckForEnv(utils.EnvDebug, cli.Bool("debug"))
-			checkEnvErr(err)
-			SessionCtx.Debug = debug
+			tokenSecrets := strings.Join(SessionCtx.Auth.TokenSecrets, ",")
+			layerSecret(l, "auth.token_secrets", "token-secrets", utils.EnvTokenSecrets, utils.EnvTokenSecretsFile, &tokenSecrets, &SessionCtx.Auth.TokenSecretsFile)
+			SessionCtx.Auth.TokenSecrets = utils.SplitSecretList(tokenSecrets)
+			utils.RegisterSecret(SessionCtx.Auth.TokenSecrets...)
+			layer(l, "require-install-token", utils.EnvRequireInstallToken, &SessionCtx.Auth.RequireInstallToken, cli.Bool)
+			layer(l, "registrations-per-ip", utils.EnvRegistrationsPerIP, &SessionCtx.Auth.RegistrationsPerIP, cli.Uint)
+			layer(l, "reputation", utils.EnvReputationEnabled, &SessionCtx.Reputation.Enabled, cli.Bool)
 
-			return nil
+			utils.RegisterURISecret(SessionCtx.DB.URI)
+
+			if len(l.errs) > 0 {
+				return errors.Join(l.errs...)
+			}
+			return SessionCtx.Validate()
 		},
 	}
-	if err := app.Run(context.Background(), os.Args); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+	if err := app.Run(context.Background(), args); err != nil {
+		return nil, err
 	}
 
-	return &SessionCtx
+	return &SessionCtx, nil
 }
 
-func checkEnvErr(err error) {
+// Collects env parsing errors so Load can report all of them instead of exiting
+type loader struct {
+	cli  *cli.Command
+	errs []error
+}
 
+func (l *loader) check(err error) {
 	if err != nil {
-		fmt.Println("Error: ", err)
-		os.Exit(1)
+		l.errs = append(l.errs, err)
 	}
+}
 
+// layerSecret is layer for secrets: every level can give the value or a *_FILE path to read it from,
+// but not both. The result is registered for redaction.
+func layerSecret(l *loader, key, flag, envVar, fileEnvVar string, dst, file *string) {
+	value, path := *dst, *file
+	if value != "" && path != "" {
+		l.check(&utils.ConfigError{Key: key, Msg: "set either the value or the file, not both"})
+	}
+
+	envValue, envPath := os.Getenv(envVar), os.Getenv(fileEnvVar)
+	if envValue != "" && envPath != "" {
+		l.check(fmt.Errorf("%s: %s and %s are both set", key, envVar, fileEnvVar))
+	}
+	if envValue != "" {
+		value, path = envValue, ""
+	}
+	if envPath != "" {
+		path = envPath
+	}
+
+	if l.cli.IsSet(flag) && l.cli.IsSet(flag+"-file") {
+		l.check(fmt.Errorf("%s: --%s and --%s-file are both set", key, flag, flag))
+	}
+	if l.cli.IsSet(flag) {
+		value, path = l.cli.String(flag), ""
+	}
+	if l.cli.IsSet(flag + "-file") {
+		path = l.cli.String(flag + "-file")
+	}
+
+	if path != "" {
+		fromFile, err := utils.ReadSecretFile(key, path)
+		l.check(err)
+		value = fromFile
+	}
+	utils.RegisterSecret(value)
+	*dst, *file = value, path
+}
+
+// layer applies the env var and then the flag, if set, on top of the value already in dst
+func layer[T utils.CliVar](l *loader, flag string, envVar string, dst *T, get func(string) T) {
+	value, err := utils.CheckForEnv(envVar, *dst)
+	l.check(err)
+	if l.cli.IsSet(flag) {
+		value = get(flag)
+	}
+	*dst = value
 }
@@ -0,0 +1,294 @@
+package api
+
+import (
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/MisterNorwood/SugarCube-Server/internal/database"
+	"github.com/MisterNorwood/SugarCube-Server/internal/services"
+	"github.com/MisterNorwood/SugarCube-Server/internal/utils"
+	"github.com/MisterNorwood/SugarCube-Server/pkg/types"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// POST /api/admin/bans
+func (h *Handler) BanIP(c echo.Context) error {
+	var req BanRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid JSON format")
+	}
+	ip := net.ParseIP(req.IP)
+	if ip == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid IP address")
+	}
+
+	ctx := c.Request().Context()
+	if err := h.Bans.Ban(ctx, ip.String(), req.Reason); err != nil {
+		return err
+	}
+	log.Info().
+		Ctx(ctx).
+		Str("banned_ip", ip.String()).
+		Str("reason", req.Reason).
+		Msg("Admin banned IP")
+
+	return c.JSON(http.StatusCreated, map[string]string{
+		"status": "IP banned",
+	})
+}
+
+// DELETE /api/admin/bans/:ip
+func (h *Handler) UnbanIP(c echo.Context) error {
+	ip := net.ParseIP(c.Param("ip"))
+	if ip == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid IP address")
+	}
+
+	ctx := c.Request().Context()
+	found, err := h.Bans.Unban(ctx, ip.String())
+	if err != nil {
+		return err
+	}
+	if !found {
+		return echo.NewHTTPError(http.StatusNotFound, "IP is not banned")
+	}
+	log.Info().
+		Ctx(ctx).
+		Str("banned_ip", ip.String()).
+		Msg("Admin unbanned IP")
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// DELETE /api/admin/installs/:id?reason=<reason>
+func (h *Handler) RevokeInstall(c echo.Context) error {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid install ID")
+	}
+
+	ctx := c.Request().Context()
+	reason := c.QueryParam("reason")
+	found, err := h.Installs.Revoke(ctx, id.String(), reason)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return echo.NewHTTPError(http.StatusNotFound, "Install not found")
+	}
+	log.Info().
+		Ctx(ctx).
+		Str("install_id", id.String()).
+		Str("reason", reason).
+		Msg("Admin revoked install")
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// GET /api/admin/sessions
+func (h *Handler) SessionStats(c echo.Context) error {
+	return c.JSON(http.StatusOK, h.Sessions.Stats())
+}
+
+// GET /api/admin/quarantine
+func (h *Handler) ListQuarantine(c echo.Context) error {
+	cases, err := h.Votes.OpenCases(c.Request().Context())
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, cases)
+}
+
+// POST /api/admin/quarantine/:id/approve
+func (h *Handler) ApproveQuarantine(c echo.Context) error {
+	ctx := c.Request().Context()
+	resolved, err := h.Votes.Resolve(ctx, c.Param("id"), true)
+	if errors.Is(err, services.ErrCaseNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "No open quarantine case with that ID")
+	}
+	if err != nil {
+		return err
+	}
+	site, code := resolved.Site, resolved.Coupon
+
+	// Each vote goes in as if it had never been held, region scores, reports and the voter's reputation included
+	var rescored []database.VoteResult
+	for _, held := range resolved.Votes {
+		votes := database.ProcessCallback(ctx, h.Coupons, site, held.Vote(code))
+		h.Reputation.RecordVotes(ctx, held.Voter, votes)
+		rescored = append(rescored, votes...)
+	}
+	// Cases from before the votes were kept only know the total
+	if len(resolved.Votes) == 0 && resolved.ScoreChange != 0 {
+		updated, err := database.AdjustScore(ctx, h.Coupons, site, code, resolved.ScoreChange)
+		if err != nil && !errors.Is(err, database.ErrNotFound) {
+			return err
+		}
+		if updated != nil {
+			rescored = append(rescored, database.VoteResult{Coupon: code, ScoreAfter: updated.Score, Status: updated.Status})
+		}
+	}
+
+	if len(rescored) > 0 {
+		h.Cache.Invalidate(site)
+	}
+	for _, vote := range rescored {
+		if vote.Status != types.CouponPending {
+			h.Feed.PublishLocal(types.CouponEvent{Type: types.EventRescored, Site: site, Coupon: vote.Coupon, Score: vote.ScoreAfter})
+		}
+	}
+	log.Info().
+		Ctx(ctx).
+		Str("case_id", c.Param("id")).
+		Str("site", utils.RedactSite(site)).
+		Str("coupon", utils.RedactCoupon(code)).
+		Int("votes", len(resolved.Votes)).
+		Int("applied", len(rescored)).
+		Float64("score_change", resolved.ScoreChange).
+		Msg("Admin approved quarantined votes")
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// POST /api/admin/quarantine/:id/reject
+func (h *Handler) RejectQuarantine(c echo.Context) error {
+	ctx := c.Request().Context()
+	resolved, err := h.Votes.Resolve(ctx, c.Param("id"), false)
+	if errors.Is(err, services.ErrCaseNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "No open quarantine case with that ID")
+	}
+	if err != nil {
+		return err
+	}
+	site, code := resolved.Site, resolved.Coupon
+	log.Info().
+		Ctx(ctx).
+		Str("case_id", c.Param("id")).
+		Str("site", utils.RedactSite(site)).
+		Str("coupon", utils.RedactCoupon(code)).
+		Msg("Admin rejected quarantined votes")
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// GET /api/admin/coupons/pending?site=<sitename>, every site without one
+func (h *Handler) ListPending(c echo.Context) error {
+	ctx := c.Request().Context()
+	sites := []string{c.QueryParam("site")}
+	if sites[0] == "" {
+		var err error
+		if sites, err = h.Coupons.ListCollectionNames(ctx, bson.D{}); err != nil {
+			return database.Unavailable(err, "listing sites failed")
+		}
+	}
+
+	pending := []types.PendingCoupon{}
+	for _, site := range sites {
+		coupons, err := database.ListPending(ctx, h.Coupons, site)
+		if err != nil {
+			return err
+		}
+		for _, coupon := range coupons {
+			pending = append(pending, types.PendingCoupon{Site: site, Coupon: coupon, VariantOf: coupon.VariantOf})
+		}
+	}
+	return c.JSON(http.StatusOK, pending)
+}
+
+// POST /api/admin/coupons/pending/approve?site=<sitename>&coupon=<code>
+func (h *Handler) ApprovePending(c echo.Context) error {
+	ctx := c.Request().Context()
+	site, code := c.QueryParam("site"), c.QueryParam("coupon")
+	promoted, err := database.PromoteCoupon(ctx, h.Coupons, site, code, h.coupons.Load().CaseSensitiveFor(site))
+	if err != nil {
+		return err
+	}
+	h.Cache.Invalidate(site)
+	h.Feed.PublishLocal(types.CouponEvent{Type: types.EventAdded, Site: site, Coupon: promoted.Coupon, Score: promoted.Score, Entry: promoted})
+	log.Info().
+		Ctx(ctx).
+		Str("site", utils.RedactSite(site)).
+		Str("coupon", utils.RedactCoupon(code)).
+		Str("live_coupon", utils.RedactCoupon(promoted.Coupon)).
+		Msg("Admin approved pending coupon")
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// POST /api/admin/coupons/pending/reject?site=<sitename>&coupon=<code>
+func (h *Handler) RejectPending(c echo.Context) error {
+	ctx := c.Request().Context()
+	site, code := c.QueryParam("site"), c.QueryParam("coupon")
+	if err := database.DeletePending(ctx, h.Coupons, site, code); err != nil {
+		return err
+	}
+	h.Cache.Invalidate(site)
+	log.Info().
+		Ctx(ctx).
+		Str("site", utils.RedactSite(site)).
+		Str("coupon", utils.RedactCoupon(code)).
+		Msg("Admin rejected pending coupon")
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// POST /api/admin/coupons/merge?site=<sitename>, every site without one
+func (h *Handler) MergeCoupons(c echo.Context) error {
+	ctx := c.Request().Context()
+	sites := []string{c.QueryParam("site")}
+	if sites[0] == "" {
+		var err error
+		if sites, err = h.Coupons.ListCollectionNames(ctx, bson.D{}); err != nil {
+			return database.Unavailable(err, "listing sites failed")
+		}
+	}
+
+	report := types.MergeReport{Merges: []types.CouponMerge{}}
+	for _, site := range sites {
+		merges, err := database.MergeDuplicates(ctx, h.Coupons, site, h.coupons.Load().CaseSensitiveFor(site))
+		for _, merge := range merges {
+			if err := h.Votes.MoveVotes(ctx, site, append(merge.Variants, merge.Pending...), merge.Coupon); err != nil {
+				log.Warn().
+					Ctx(ctx).
+					Str("site", utils.RedactSite(site)).
+					Str("coupon", utils.RedactCoupon(merge.Coupon)).
+					Err(err).
+					Msg("Failed to move votes of merged coupons")
+			}
+			for _, variant := range merge.Live {
+				h.Feed.PublishLocal(types.CouponEvent{Type: types.EventPruned, Site: site, Coupon: variant})
+			}
+		}
+		if len(merges) > 0 {
+			h.Cache.Invalidate(site)
+		}
+		for _, merge := range merges {
+			report.Merges = append(report.Merges, merge.CouponMerge)
+		}
+		if errors.Is(err, database.ErrNotFound) && len(sites) == 1 {
+			return err
+		}
+		if err != nil {
+			log.Error().
+				Ctx(ctx).
+				Str("site", utils.RedactSite(site)).
+				Int("merged", len(merges)).
+				Err(err).
+				Msg("Coupon merge stopped partway")
+			_, body := errorToResponse(err)
+			report.Failed = append(report.Failed, types.MergeFailure{Site: site, Error: body.Error})
+		}
+	}
+	log.Info().
+		Ctx(ctx).
+		Int("sites", len(sites)).
+		Int("merged", len(report.Merges)).
+		Int("failed", len(report.Failed)).
+		Msg("Admin merged coupon variants")
+
+	return c.JSON(http.StatusOK, report)
+}
@@ -1,115 +1,313 @@
 package api
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"net"
 	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/MisterNorwood/SugarCube-Server/internal/database"
+	"github.com/MisterNorwood/SugarCube-Server/internal/geoip"
 	"github.com/MisterNorwood/SugarCube-Server/internal/services"
+	"github.com/MisterNorwood/SugarCube-Server/internal/telemetry"
 	"github.com/MisterNorwood/SugarCube-Server/internal/utils"
+	"github.com/MisterNorwood/SugarCube-Server/pkg/types"
 	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 	"github.com/rs/zerolog/log"
 	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-var ApiClient *mongo.Database
-var SessionManager *services.SessionManager
+// Handler serves the API. Everything it needs is passed in, so several can run side by side.
+type Handler struct {
+	Coupons    *mongo.Database
+	Sessions   *services.SessionManager
+	Bans       *services.BanService
+	Installs   *services.InstallService
+	Reputation *services.ReputationService
+	Votes      *services.VoteGuard
+	Feed       *services.CouponFeed
+	Cache      *services.SiteCache
+	GeoIP      *geoip.Reader // nil without a GeoIP database
+	// Origins that may open a WebSocket stream, none if nil
+	AllowOrigin func(origin string) bool
 
-// GET /api/coupons?site=<sitename>
-func GetCouponsForPage(c echo.Context) error {
+	heartbeat atomic.Int64 // Of coupon streams, a time.Duration
+	coupons   atomic.Pointer[utils.CouponConfig]
+}
+
+func NewHandler(coupons *mongo.Database, sessions *services.SessionManager, bans *services.BanService, installs *services.InstallService, reputation *services.ReputationService, votes *services.VoteGuard, feed *services.CouponFeed, cache *services.SiteCache, geoIP *geoip.Reader) *Handler {
+	h := &Handler{
+		Coupons:    coupons,
+		Sessions:   sessions,
+		Bans:       bans,
+		Installs:   installs,
+		Reputation: reputation,
+		Votes:      votes,
+		Feed:       feed,
+		Cache:      cache,
+		GeoIP:      geoIP,
+	}
+	h.SetCouponConfig(utils.CouponConfig{})
+	return h
+}
+
+func (h *Handler) SetCouponConfig(cfg utils.CouponConfig) {
+	h.coupons.Store(&cfg)
+}
+
+// clientKey is the reputation key of the caller
+func (h *Handler) clientKey(c echo.Context) string {
+	return services.ClientKey(h.installID(c), c.RealIP())
+}
+
+// installID is the caller's install, empty without a token. Writes and callbacks went
+// through InstallAuth, on other routes a token is only checked for its signature.
+func (h *Handler) installID(c echo.Context) string {
+	if meta := utils.RequestMetaFrom(c.Request().Context()); meta != nil && meta.InstallID != "" {
+		return meta.InstallID
+	}
+	if token := c.Request().Header.Get(types.InstallTokenHeader); token != "" {
+		id, _ := h.Installs.Verify(strings.TrimSpace(token))
+		return id
+	}
+	return ""
+}
+
+// GET /api/v1/coupons?site=<sitename>
+func (h *Handler) GetCouponsForPage(c echo.Context) error {
+	list, err := h.filteredList(c)
+	if err != nil {
+		return err
+	}
+	// The session ID is in the body, so nothing here can be cached
+	response, err := h.Sessions.CreateResponseGetSite(net.ParseIP(c.RealIP()), list.Site, list.Region)
+	if err != nil {
+		return sessionError(c, err)
+	}
+	trace.SpanFromContext(c.Request().Context()).SetAttributes(
+		attribute.String(telemetry.AttrSessionIDHash, telemetry.HashSessionID(response.RequestUUID)),
+	)
+	return c.JSON(http.StatusOK, response)
+}
+
+// GET /api/v2/coupons?site=<sitename>
+func (h *Handler) GetCouponsForPageV2(c echo.Context) error {
+	list, err := h.filteredList(c)
+	if err != nil {
+		return err
+	}
+
+	headers := c.Response().Header()
+	headers.Set("ETag", list.ETag)
+	headers.Set("Vary", types.APIVersionHeader+", "+types.InstallTokenHeader+", Accept-Language")
+	headers.Set("Cache-Control", cacheControl(list, h.Cache.MaxAge()))
+	if etagMatches(c.Request().Header.Get("If-None-Match"), list.ETag) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return c.JSON(http.StatusOK, types.CouponsResponse{Site: list.Site})
+}
+
+// siteList is a site's coupon list as served to one client
+type siteList struct {
+	Site         types.Site
+	ETag         string
+	Trusted      bool
+	Region       string
+	RegionSource string
+}
+
+// couponList returns the site's list from the read cache, filtered to the client's region.
+// Trusted installs also get pending coupons, their votes decide whether those go live.
+func (h *Handler) couponList(c echo.Context) (*siteList, error) {
 	site := c.QueryParam("site")
 	if site == "" {
-		return c.JSON(http.StatusBadRequest, map[string]string{
-			"error": "Missing site parameter",
-		})
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Missing site parameter")
+	}
+	region, source, err := h.clientRegion(c)
+	if err != nil {
+		return nil, err
 	}
 
-	coupons, err := database.GetSiteStruct(site, ApiClient)
+	ctx := c.Request().Context()
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.String(telemetry.AttrSite, site))
+
+	trusted := h.Reputation.TrustedReader(ctx, h.installID(c))
+	cached, err := h.Cache.Get(ctx, site, trusted, func(ctx context.Context) (*types.Site, error) {
+		return database.GetSiteStruct(ctx, site, h.Coupons, trusted)
+	})
 	if err != nil {
-		log.Fatal().
-			Str("ip", c.RealIP()).
-			Str("user_agent", c.Request().UserAgent()).
-			Str("path", c.Request().URL.Path).
-			Str("query_parm", site).
+		log.Warn().
+			Ctx(ctx).
+			Str("query_parm", utils.RedactSite(site)).
 			Err(err).
 			Msg("Error retriving data from database")
+		return nil, err
+	}
 
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": "Database error",
-		})
+	list := &siteList{Site: cached.Site, ETag: cached.ETag, Trusted: trusted, Region: region, RegionSource: source}
+	if region != "" {
+		list.Site = forRegion(cached.Site, region)
+		list.ETag = variantETag(cached.ETag, region)
+	}
+	span.SetAttributes(attribute.Int(telemetry.AttrCouponCount, len(list.Site.CouponEntries)))
+	return list, nil
+}
 
+// filteredList is couponList narrowed down by the filter params
+func (h *Handler) filteredList(c echo.Context) (*siteList, error) {
+	filter, err := couponFilter(c)
+	if err != nil {
+		return nil, err
 	}
+	list, err := h.couponList(c)
+	if err != nil {
+		return nil, err
+	}
+	if key := filterKey(filter); key != "" {
+		list.Site = applyFilter(list.Site, filter)
+		if list.Region != "" {
+			demoteVotedDown(list.Site.CouponEntries, list.Region)
+		}
+		sum := sha256.Sum256([]byte(key))
+		list.ETag = variantETag(list.ETag, hex.EncodeToString(sum[:4]))
+	}
+	return list, nil
+}
 
-	response := SessionManager.CreateResponseGetSite(net.ParseIP(c.RealIP()), *coupons)
-	return c.JSON(http.StatusOK, response)
+// cacheControl is the Cache-Control of a v2 list. Sessions come from POST /api/session,
+// so the list is the same for every client of the same trust and region. Lists with
+// pending coupons or a region from the client's IP are the client's own.
+func cacheControl(list *siteList, maxAge time.Duration) string {
+	visibility := "public"
+	if list.Trusted || list.RegionSource == regionGeoIP {
+		visibility = "private"
+	}
+	return fmt.Sprintf("%s, max-age=%d", visibility, int(maxAge.Seconds()))
 }
 
-// POST /api/coupons?site=<sitename>
-func AddCouponToSite(c echo.Context) error {
+// variantETag derives the ETag of a list served in a variant of the cached one
+func variantETag(etag, variant string) string {
+	return strings.TrimSuffix(etag, `"`) + "-" + variant + `"`
+}
+
+// etagMatches compares If-None-Match with weak comparison, as RFC 9110 asks for
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// POST /api/coupons?site=<sitename>, all versions
+func (h *Handler) AddCouponToSite(c echo.Context) error {
 	site := c.QueryParam("site")
 	if site == "" {
-		return c.JSON(http.StatusBadRequest, map[string]string{
-			"error": "Missing site parameter",
-		})
+		return echo.NewHTTPError(http.StatusBadRequest, "Missing site parameter")
 	}
 	if c.Request().Header.Get("Content-Type") != "application/json" {
-		return c.JSON(http.StatusUnsupportedMediaType, map[string]string{
-			"error": "Content-Type must be application/json"})
+		return echo.NewHTTPError(http.StatusUnsupportedMediaType, "Content-Type must be application/json")
 	}
 
 	var coupon database.CouponEntry
 	if err := c.Bind(&coupon); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{
-			"error": "Invalid JSON format",
-		})
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid JSON format")
 	}
 
-	err := database.AddCouponToExistingSite(site, coupon, ApiClient)
+	ctx := c.Request().Context()
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String(telemetry.AttrSite, site),
+		attribute.Int(telemetry.AttrCouponCount, 1),
+	)
+
+	// Score and status are the server's, new coupons from untrusted clients wait for votes
+	coupon.Coupon = strings.TrimSpace(coupon.Coupon)
+	key := h.clientKey(c)
+	coupon.Score = 0
+	coupon.SubmittedBy = key
+	coupon.Status = types.CouponLive
+	if !h.Reputation.Trusted(ctx, key) {
+		coupon.Status = types.CouponPending
+	}
+
+	stored, merged, err := database.AddCouponToExistingSite(ctx, site, coupon, h.Coupons, h.coupons.Load().CaseSensitiveFor(site))
 	if err != nil {
 		log.Error().
-			Str("site", site).
-			Str("ip", c.RealIP()).
+			Ctx(ctx).
+			Str("site", utils.RedactSite(site)).
+			Str("coupon", utils.RedactCoupon(coupon.Coupon)).
 			Err(err).
 			Msg("Failed to insert coupon")
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": err.Error(),
+		return err
+	} else if merged {
+		h.Cache.Invalidate(site)
+		log.Info().
+			Ctx(ctx).
+			Str("site", utils.RedactSite(site)).
+			Str("coupon", utils.RedactCoupon(coupon.Coupon)).
+			Str("merged_into", utils.RedactCoupon(stored.Coupon)).
+			Msg("Merged coupon into an existing variant")
+		return c.JSON(http.StatusOK, map[string]string{
+			"status": "Coupon merged",
+			"coupon": stored.Coupon,
 		})
 	} else {
+		h.Cache.Invalidate(site)
 		log.Info().
-			Str("site", site).
-			Str("ip", c.RealIP()).
+			Ctx(ctx).
+			Str("site", utils.RedactSite(site)).
+			Str("coupon", utils.RedactCoupon(stored.Coupon)).
+			Str("coupon_status", stored.Status).
+			Str("variant_of", utils.RedactCoupon(stored.VariantOf)).
 			Msg("Inserted coupon")
 	}
 
+	// Also when it's a variant whose details would change a live coupon, votes decide on those
+	if stored.Status == types.CouponPending {
+		return c.JSON(http.StatusCreated, map[string]string{
+			"status": "Coupon pending",
+		})
+	}
+	h.Feed.PublishLocal(types.CouponEvent{Type: types.EventAdded, Site: site, Coupon: stored.Coupon, Score: stored.Score, Entry: stored})
 	return c.JSON(http.StatusCreated, map[string]string{
 		"status": "Coupon added",
 	})
 }
 
-// POST /api/site?url=<sitename>
-func RequestAddSite(c echo.Context) error {
+// POST /api/site?url=<sitename>, all versions
+func (h *Handler) RequestAddSite(c echo.Context) error {
 	site := c.QueryParam("url")
 	if site == "" {
-		return c.JSON(http.StatusBadRequest, map[string]string{
-			"error": "Missing site parameter",
-		})
+		return echo.NewHTTPError(http.StatusBadRequest, "Missing site parameter")
 	}
 
-	err := database.AddSite(site, ApiClient)
+	ctx := c.Request().Context()
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String(telemetry.AttrSite, site))
+
+	err := database.AddSite(ctx, site, h.Coupons)
 	if err != nil {
 		log.Error().
-			Str("site", site).
-			Str("ip", c.RealIP()).
+			Ctx(ctx).
+			Str("site", utils.RedactSite(site)).
 			Err(err).
 			Msg("Failed to add site")
-		return c.JSON(http.StatusInternalServerError, map[string]string{
-			"error": err.Error(),
-		})
+		return err
 	} else {
 		log.Info().
-			Str("site", site).
-			Str("ip", c.RealIP()).
+			Ctx(ctx).
+			Str("site", utils.RedactSite(site)).
 			Msg("Added site")
 	}
 
@@ -118,32 +316,147 @@ func RequestAddSite(c echo.Context) error {
 	})
 }
 
-func RecieveCallBack(c echo.Context) error {
+// POST /api/v1/callback
+func (h *Handler) RecieveCallBack(c echo.Context) error {
 	if c.Request().Header.Get("Content-Type") != "application/json" {
-		return c.JSON(http.StatusUnsupportedMediaType, map[string]string{
-			"error": "Content-Type must be application/json"})
+		return echo.NewHTTPError(http.StatusUnsupportedMediaType, "Content-Type must be application/json")
 	}
 	var callback CallbackResponse
 	if err := c.Bind(&callback); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{
-			"error": "Invalid JSON format",
-		})
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid JSON format")
 	}
-	if callback.RequestID == uuid.Nil || callback.Site == "" || len(callback.Results) <= 0 {
-		return c.JSON(http.StatusBadRequest, map[string]string{
-			"error": "Invalid data",
-		})
+	return h.processCallback(c, types.CallbackRequest{RequestID: callback.RequestID, Site: callback.Site, Results: callback.Results})
+}
 
+// POST /api/v2/callback, same as v1 with snake_case keys
+func (h *Handler) RecieveCallBackV2(c echo.Context) error {
+	if c.Request().Header.Get("Content-Type") != "application/json" {
+		return echo.NewHTTPError(http.StatusUnsupportedMediaType, "Content-Type must be application/json")
+	}
+	var callback types.CallbackRequest
+	if err := c.Bind(&callback); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid JSON format")
 	}
+	return h.processCallback(c, callback)
+}
 
-	if valid, err := SessionManager.ValidateSession(callback.RequestID); valid != true {
-		return c.JSON(http.StatusForbidden, map[string]string{
-			"error": err.Error(),
-		})
+func (h *Handler) processCallback(c echo.Context, callback types.CallbackRequest) error {
+	results, err := callbackResults(&callback)
+	if err != nil {
+		return err
+	}
+	if callback.RequestID == uuid.Nil || callback.Site == "" || len(results) <= 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid data")
+	}
+
+	ctx := c.Request().Context()
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String(telemetry.AttrSite, callback.Site),
+		attribute.Int(telemetry.AttrCouponCount, len(results)),
+		attribute.String(telemetry.AttrSessionIDHash, telemetry.HashSessionID(callback.RequestID)),
+	)
+
+	// Checked before it's used up, a malformed callback doesn't cost the client its session
+	session, err := h.Sessions.ValidateSession(callback.RequestID)
+	if session == nil {
+		return callbackSessionError(err)
+	}
+	if !session.Covers(callback.Site, results) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Results for a site or coupons the session wasn't opened for")
+	}
+	// Only one of concurrent callbacks with the same session gets past this
+	if session, err = h.Sessions.Consume(callback.RequestID); session == nil {
+		return callbackSessionError(err)
+	}
+	voter := h.clientKey(c)
+	trusted := h.Reputation.Trusted(ctx, voter)
+	weight := h.Reputation.Weight(ctx, voter)
+	accepted, quarantined := h.Votes.Screen(ctx, voter, c.RealIP(), callback.Site, results)
+	for _, code := range quarantined {
+		held := services.HeldVote{Voter: voter, IP: c.RealIP(), Region: session.Region, Worked: results[code], Weight: weight, IncludePending: trusted}
+		if report, ok := callback.Reports[code]; ok {
+			held.Report = &report
+		}
+		if err := h.Votes.Quarantine(ctx, callback.Site, code, held); err != nil {
+			log.Warn().
+				Ctx(ctx).
+				Str("site", utils.RedactSite(callback.Site)).
+				Str("coupon", utils.RedactCoupon(code)).
+				Err(err).
+				Msg("Failed to quarantine vote")
+		}
+	}
+	votes := database.ProcessCallback(ctx, h.Coupons, callback.Site, database.Vote{
+		Results:        accepted,
+		Region:         session.Region,
+		Reports:        callback.Reports,
+		Weight:         weight,
+		Voter:          voter,
+		IncludePending: trusted,
+	})
+	h.Reputation.RecordVotes(ctx, voter, votes)
+	if len(votes) > 0 {
+		h.Cache.Invalidate(callback.Site)
+	}
+	for _, vote := range votes {
+		if vote.Status != types.CouponPending {
+			h.Feed.PublishLocal(types.CouponEvent{Type: types.EventRescored, Site: callback.Site, Coupon: vote.Coupon, Score: vote.ScoreAfter})
+		}
+	}
+	if trusted {
+		if promoted, err := database.PromotePending(ctx, h.Coupons, callback.Site, h.Reputation.PromoteScore(), h.coupons.Load().CaseSensitiveFor(callback.Site)); err != nil {
+			log.Warn().
+				Ctx(ctx).
+				Str("site", utils.RedactSite(callback.Site)).
+				Err(err).
+				Msg("Failed to promote pending coupons")
+		} else if len(promoted) > 0 {
+			log.Info().
+				Ctx(ctx).
+				Str("site", utils.RedactSite(callback.Site)).
+				Int("promoted", len(promoted)).
+				Msg("Promoted pending coupons")
+			h.Cache.Invalidate(callback.Site)
+			for i := range promoted {
+				h.Feed.PublishLocal(types.CouponEvent{Type: types.EventAdded, Site: callback.Site, Coupon: promoted[i].Coupon, Score: promoted[i].Score, Entry: &promoted[i]})
+			}
+		}
 	}
-	defer SessionManager.RemoveSession(callback.RequestID)
-	database.ProcessCallback(ApiClient, callback.Site, callback.Results)
 	return c.JSON(http.StatusAccepted, map[string]string{
 		"status": "Success",
 	})
 }
+
+func callbackSessionError(err error) error {
+	if errors.Is(err, services.ErrSessionExpired) {
+		return echo.NewHTTPError(http.StatusForbidden, "Session expired")
+	}
+	return echo.NewHTTPError(http.StatusForbidden, "Session not found")
+}
+
+// callbackResults merges the results and reports of a callback into whether each coupon
+// worked, and checks and normalizes the reports
+func callbackResults(callback *types.CallbackRequest) (map[string]bool, error) {
+	results := make(map[string]bool, len(callback.Results)+len(callback.Reports))
+	for code, worked := range callback.Results {
+		results[code] = worked
+	}
+	for code, report := range callback.Reports {
+		if _, ok := results[code]; ok {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "A coupon can be in results or reports, not both")
+		}
+		if report.Discount < 0 || report.CartTotal < 0 || (report.CartTotal > 0 && report.Discount > report.CartTotal) {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "Report amounts must be at least 0, the discount at most the cart total")
+		}
+		if report.Currency != "" {
+			currency, ok := utils.NormalizeCurrency(report.Currency)
+			if !ok {
+				return nil, echo.NewHTTPError(http.StatusBadRequest, "Report currency must be an ISO 4217 code")
+			}
+			report.Currency = currency
+			callback.Reports[code] = report
+		}
+		results[code] = report.Applied
+	}
+	return results, nil
+}
@@ -0,0 +1,259 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MisterNorwood/SugarCube-Server/internal/database"
+	"github.com/MisterNorwood/SugarCube-Server/internal/services"
+	"github.com/MisterNorwood/SugarCube-Server/internal/utils"
+	"github.com/MisterNorwood/SugarCube-Server/pkg/types"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+func TestEtagMatches(t *testing.T) {
+	const etag = `"abc123"`
+	tests := []struct {
+		ifNoneMatch string
+		want        bool
+	}{
+		{"", false},
+		{`"abc123"`, true},
+		{`W/"abc123"`, true},
+		{`"other", "abc123"`, true},
+		{`"other",W/"abc123"`, true},
+		{`"other"`, false},
+		{`"abc123-DE"`, false},
+		{`abc123`, false},
+		{"*", true},
+	}
+	for _, tt := range tests {
+		if got := etagMatches(tt.ifNoneMatch, etag); got != tt.want {
+			t.Errorf("etagMatches(%q) = %v, want %v", tt.ifNoneMatch, got, tt.want)
+		}
+	}
+	if !etagMatches(`"abc123"`, `W/"abc123"`) {
+		t.Error("a weak ETag should match its strong form")
+	}
+}
+
+func TestVariantETag(t *testing.T) {
+	if got := variantETag(`"abc123"`, "DE"); got != `"abc123-DE"` {
+		t.Fatalf("got %s", got)
+	}
+	if got := variantETag(`W/"abc123"`, "DE"); got != `W/"abc123-DE"` {
+		t.Fatalf("got %s", got)
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	tests := []struct {
+		name string
+		list siteList
+		want string
+	}{
+		{"anonymous", siteList{}, "public, max-age=60"},
+		{"region from query", siteList{Region: "DE", RegionSource: regionQuery}, "public, max-age=60"},
+		{"region from language", siteList{Region: "AT", RegionSource: regionLanguage}, "public, max-age=60"},
+		{"region from IP", siteList{Region: "DE", RegionSource: regionGeoIP}, "private, max-age=60"},
+		{"trusted sees pending", siteList{Trusted: true}, "private, max-age=60"},
+	}
+	for _, tt := range tests {
+		if got := cacheControl(&tt.list, time.Minute); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// Tests that need a MongoDB run against the server at this URI, in databases of their own
+const testMongoEnv = "SUGARCUBE_TEST_MONGO_URI"
+
+// flow serves the extension and admin handlers over fresh, empty databases
+type flow struct {
+	t *testing.T
+	h *Handler
+	e *echo.Echo
+}
+
+func newFlow(t *testing.T, reputation utils.ReputationConfig) *flow {
+	t.Helper()
+	uri := os.Getenv(testMongoEnv)
+	if uri == "" {
+		t.Skip(testMongoEnv + " not set")
+	}
+	client, err := mongo.Connect(options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := "sugarcube_test_" + strings.ReplaceAll(uuid.NewString(), "-", "")[:12]
+	coupons, admin := client.Database(prefix), client.Database(prefix+"_admin")
+	t.Cleanup(func() {
+		ctx := context.Background()
+		_ = coupons.Drop(ctx)
+		_ = admin.Drop(ctx)
+		_ = client.Disconnect(ctx)
+	})
+
+	cfg := utils.DefaultConfig()
+	h := NewHandler(coupons,
+		services.NewSessionManager(cfg.Sessions),
+		services.NewBanService(admin),
+		services.NewInstallService(admin, []string{"flow-test-secret-of-at-least-32-chars"}),
+		services.NewReputationService(admin, reputation),
+		services.NewVoteGuard(admin, cfg.Votes),
+		services.NewCouponFeed(coupons, 0),
+		services.NewSiteCache(cfg.Cache),
+		nil,
+	)
+	h.SetCouponConfig(cfg.Coupons)
+
+	e := echo.New()
+	e.HTTPErrorHandler = HTTPErrorHandler
+	e.POST("/register", h.RegisterInstall)
+	e.POST("/site", h.RequestAddSite)
+	e.GET("/coupons", h.GetCouponsForPageV2)
+	e.POST("/coupons", h.AddCouponToSite)
+	e.POST("/session", h.CreateSession)
+	e.POST("/callback", h.RecieveCallBackV2)
+	e.GET("/admin/pending", h.ListPending)
+	e.POST("/admin/pending/approve", h.ApprovePending)
+	return &flow{t: t, h: h, e: e}
+}
+
+// call sends a request as the client at ip, with an install token if one is given
+func (f *flow) call(method, target, ip, token string, body any, status int, out any) {
+	f.t.Helper()
+	var req *http.Request
+	if body == nil {
+		req = httptest.NewRequest(method, target, nil)
+	} else {
+		data, _ := json.Marshal(body)
+		req = httptest.NewRequest(method, target, strings.NewReader(string(data)))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	}
+	req.Header.Set(echo.HeaderXRealIP, ip)
+	if token != "" {
+		req.Header.Set(types.InstallTokenHeader, token)
+	}
+	rec := httptest.NewRecorder()
+	f.e.ServeHTTP(rec, req)
+	if rec.Code != status {
+		f.t.Fatalf("%s %s: status %d, want %d: %s", method, target, rec.Code, status, rec.Body)
+	}
+	if out != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			f.t.Fatalf("%s %s: %v", method, target, err)
+		}
+	}
+}
+
+func (f *flow) register(ip string) string {
+	var resp types.RegisterResponse
+	f.call(http.MethodPost, "/register", ip, "", nil, http.StatusCreated, &resp)
+	return resp.Token
+}
+
+func (f *flow) submit(ip, token, code string) string {
+	var resp map[string]string
+	f.call(http.MethodPost, "/coupons?site=example.com", ip, token, types.CouponEntry{Coupon: code}, http.StatusCreated, &resp)
+	return resp["status"]
+}
+
+// vote opens a session for the codes and reports them all as working
+func (f *flow) vote(ip, token string, codes ...string) {
+	var session types.SessionResponse
+	f.call(http.MethodPost, "/session?site=example.com", ip, token, types.SessionRequest{Coupons: codes}, http.StatusCreated, &session)
+	results := map[string]bool{}
+	for _, code := range codes {
+		results[code] = true
+	}
+	f.call(http.MethodPost, "/callback", ip, token, types.CallbackRequest{RequestID: session.SessionID, Site: "example.com", Results: results}, http.StatusAccepted, nil)
+}
+
+// public is the list a client without a token gets
+func (f *flow) public() map[string]bool {
+	var resp types.CouponsResponse
+	f.call(http.MethodGet, "/coupons?site=example.com", "192.0.2.99", "", nil, http.StatusOK, &resp)
+	codes := map[string]bool{}
+	for _, entry := range resp.Site.CouponEntries {
+		codes[entry.Coupon] = true
+	}
+	return codes
+}
+
+// A new deployment trusts everyone until someone earns trust, who then promotes pending coupons
+func TestFlowFromEmptyDatabase(t *testing.T) {
+	reputation := utils.DefaultConfig().Reputation
+	// One trusted vote is enough, there's a single trusted client
+	reputation.PromoteScore = 1.5
+	f := newFlow(t, reputation)
+	ctx := context.Background()
+
+	f.call(http.MethodPost, "/site?url=example.com", "192.0.2.1", "", nil, http.StatusCreated, nil)
+	submitter := f.register("192.0.2.1")
+	var codes []string
+	for i := range reputation.MinOutcomes {
+		code := "SAVE" + string(rune('A'+i))
+		if status := f.submit("192.0.2.1", submitter, code); status != "Coupon added" {
+			t.Fatalf("%s during the bootstrap: %s", code, status)
+		}
+		codes = append(codes, code)
+	}
+	if !f.h.Reputation.Bootstrapping(ctx) {
+		t.Fatal("not bootstrapping without any reputation")
+	}
+
+	// Each working code is an outcome for the submitter, enough to trust it
+	f.vote("192.0.2.2", "", codes...)
+	if f.h.Reputation.Bootstrapping(ctx) {
+		t.Fatal("still bootstrapping with a trusted client")
+	}
+	if status := f.submit("192.0.2.3", "", "NEWCODE"); status != "Coupon pending" {
+		t.Fatalf("new client's submission after the bootstrap: %s", status)
+	}
+	if f.public()["NEWCODE"] {
+		t.Fatal("pending coupon in the public list")
+	}
+
+	// Only trusted installs see pending coupons, so only they can vote on them
+	f.call(http.MethodPost, "/session?site=example.com", "192.0.2.4", "", types.SessionRequest{Coupons: []string{"NEWCODE"}}, http.StatusBadRequest, nil)
+	f.vote("192.0.2.1", submitter, "NEWCODE")
+	if !f.public()["NEWCODE"] {
+		t.Fatal("trusted vote didn't promote the pending coupon")
+	}
+}
+
+// With the bootstrap off an admin approves what nobody can promote yet
+func TestFlowAdminApproves(t *testing.T) {
+	reputation := utils.DefaultConfig().Reputation
+	reputation.Bootstrap = false
+	f := newFlow(t, reputation)
+
+	f.call(http.MethodPost, "/site?url=example.com", "192.0.2.1", "", nil, http.StatusCreated, nil)
+	if status := f.submit("192.0.2.1", "", "SAVE10"); status != "Coupon pending" {
+		t.Fatalf("submission without the bootstrap: %s", status)
+	}
+	var pending []types.PendingCoupon
+	f.call(http.MethodGet, "/admin/pending", "127.0.0.1", "", nil, http.StatusOK, &pending)
+	if len(pending) != 1 || pending[0].Site != "example.com" || pending[0].Coupon.Coupon != "SAVE10" {
+		t.Fatalf("pending %+v", pending)
+	}
+
+	f.call(http.MethodPost, "/admin/pending/approve?site=example.com&coupon=SAVE10", "127.0.0.1", "", nil, http.StatusNoContent, nil)
+	if !f.public()["SAVE10"] {
+		t.Fatal("approved coupon isn't live")
+	}
+	f.call(http.MethodPost, "/admin/pending/approve?site=example.com&coupon=SAVE10", "127.0.0.1", "", nil, http.StatusNotFound, nil)
+	if left, err := database.ListPending(context.Background(), f.h.Coupons, "example.com"); err != nil || len(left) != 0 {
+		t.Fatalf("still pending: %v %v", left, err)
+	}
+}
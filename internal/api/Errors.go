@@ -0,0 +1,102 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/MisterNorwood/SugarCube-Server/internal/database"
+	"github.com/MisterNorwood/SugarCube-Server/internal/utils"
+	"github.com/MisterNorwood/SugarCube-Server/pkg/types"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// HTTPErrorHandler is installed as Echo's error handler. Handlers and middleware
+// return errors and this turns them into a status code and an ErrorResponse.
+// Only messages meant for clients are sent, causes are logged.
+func HTTPErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	status, body := errorToResponse(err)
+	body.RequestID = utils.RequestIDFrom(c.Request().Context())
+
+	event := log.Debug()
+	if status >= http.StatusInternalServerError {
+		event = log.Error()
+	}
+	event.
+		Ctx(c.Request().Context()).
+		Int("status", status).
+		Str("code", body.Code).
+		Err(err).
+		Msg("Request failed")
+
+	var writeErr error
+	if c.Request().Method == http.MethodHead {
+		writeErr = c.NoContent(status)
+	} else {
+		writeErr = c.JSON(status, body)
+	}
+	if writeErr != nil {
+		log.Error().Ctx(c.Request().Context()).Err(writeErr).Msg("Failed to write error response")
+	}
+}
+
+func errorToResponse(err error) (int, ErrorResponse) {
+	var httpErr *echo.HTTPError
+	if errors.As(err, &httpErr) {
+		msg := http.StatusText(httpErr.Code)
+		if m, ok := httpErr.Message.(string); ok && m != "" {
+			msg = m
+		} else if httpErr.Message != nil {
+			msg = fmt.Sprint(httpErr.Message)
+		}
+		return httpErr.Code, ErrorResponse{Error: msg, Code: statusCode(httpErr.Code)}
+	}
+
+	msg, ok := database.PublicMessage(err)
+	switch {
+	case ok && errors.Is(err, database.ErrNotFound):
+		return http.StatusNotFound, ErrorResponse{Error: msg, Code: types.CodeNotFound}
+	case ok && errors.Is(err, database.ErrConflict):
+		return http.StatusConflict, ErrorResponse{Error: msg, Code: types.CodeConflict}
+	case ok && errors.Is(err, database.ErrInvalid):
+		return http.StatusBadRequest, ErrorResponse{Error: msg, Code: types.CodeInvalid}
+	case ok && errors.Is(err, database.ErrUnavailable):
+		return http.StatusServiceUnavailable, ErrorResponse{Error: "Service temporarily unavailable", Code: types.CodeUnavailable}
+	}
+
+	return http.StatusInternalServerError, ErrorResponse{Error: "Internal server error", Code: types.CodeInternal}
+}
+
+func statusCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return types.CodeBadRequest
+	case http.StatusUnauthorized:
+		return types.CodeUnauthorized
+	case http.StatusForbidden:
+		return types.CodeForbidden
+	case http.StatusNotFound:
+		return types.CodeNotFound
+	case http.StatusMethodNotAllowed:
+		return types.CodeMethodNotAllowed
+	case http.StatusConflict:
+		return types.CodeConflict
+	case http.StatusRequestEntityTooLarge:
+		return types.CodePayloadTooLarge
+	case http.StatusUnsupportedMediaType:
+		return types.CodeUnsupportedMediaType
+	case http.StatusTooManyRequests:
+		return types.CodeRateLimited
+	case http.StatusServiceUnavailable:
+		return types.CodeUnavailable
+	}
+	if status >= http.StatusInternalServerError {
+		return types.CodeInternal
+	}
+	return types.CodeError
+}
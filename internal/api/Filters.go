@@ -0,0 +1,114 @@
+package api
+
+import (
+	"cmp"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/MisterNorwood/SugarCube-Server/internal/database"
+	"github.com/MisterNorwood/SugarCube-Server/internal/utils"
+	"github.com/MisterNorwood/SugarCube-Server/pkg/types"
+	"github.com/labstack/echo/v4"
+)
+
+// couponFilter reads the filter params of GET /api/coupons, see types.CouponFilter
+func couponFilter(c echo.Context) (types.CouponFilter, error) {
+	var filter types.CouponFilter
+	switch discountType := strings.ToLower(c.QueryParam("discount_type")); discountType {
+	case "", types.DiscountPercent, types.DiscountFixed:
+		filter.DiscountType = discountType
+	default:
+		return filter, echo.NewHTTPError(http.StatusBadRequest, "discount_type must be percent or fixed")
+	}
+	if param := c.QueryParam("free_shipping"); param != "" {
+		freeShipping, err := strconv.ParseBool(param)
+		if err != nil {
+			return filter, echo.NewHTTPError(http.StatusBadRequest, "free_shipping must be true or false")
+		}
+		filter.FreeShipping = freeShipping
+	}
+	if param := c.QueryParam("cart_total"); param != "" {
+		total, err := strconv.ParseFloat(param, 64)
+		if err != nil || total < 0 || math.IsNaN(total) || math.IsInf(total, 0) {
+			return filter, echo.NewHTTPError(http.StatusBadRequest, "cart_total must be a number of at least 0")
+		}
+		filter.CartTotal = total
+	}
+	filter.Category = strings.ToLower(strings.TrimSpace(c.QueryParam("category")))
+	if param := c.QueryParam("first_order"); param != "" {
+		firstOrder, err := strconv.ParseBool(param)
+		if err != nil {
+			return filter, echo.NewHTTPError(http.StatusBadRequest, "first_order must be true or false")
+		}
+		filter.ExcludeFirstOrder = !firstOrder
+	}
+	if param := c.QueryParam("currency"); param != "" {
+		currency, ok := utils.NormalizeCurrency(param)
+		if !ok {
+			return filter, echo.NewHTTPError(http.StatusBadRequest, "currency must be an ISO 4217 code")
+		}
+		filter.Currency = currency
+	}
+	switch sort := c.QueryParam("sort"); sort {
+	case "", "value":
+	case "score":
+		filter.SortByScore = true
+	default:
+		return filter, echo.NewHTTPError(http.StatusBadRequest, "sort must be value or score")
+	}
+	return filter, nil
+}
+
+// filterKey tells lists with different filters apart in their ETag, empty for no filter
+func filterKey(filter types.CouponFilter) string {
+	if filter == (types.CouponFilter{}) {
+		return ""
+	}
+	return strings.Join([]string{
+		filter.DiscountType,
+		strconv.FormatBool(filter.FreeShipping),
+		strconv.FormatFloat(filter.CartTotal, 'f', -1, 64),
+		filter.Category,
+		strconv.FormatBool(filter.ExcludeFirstOrder),
+		strconv.FormatBool(filter.SortByScore),
+		filter.Currency,
+	}, "|")
+}
+
+// applyFilter drops the coupons the filter rules out. The rest are ranked again if the
+// filter has a cart total to value percent coupons on or a currency, and by score if asked.
+func applyFilter(site types.Site, filter types.CouponFilter) types.Site {
+	if filter == (types.CouponFilter{}) {
+		return site
+	}
+	entries := make([]types.CouponEntry, 0, len(site.CouponEntries))
+	for _, entry := range site.CouponEntries {
+		switch {
+		case filter.DiscountType != "" && entry.DiscountType != filter.DiscountType,
+			filter.FreeShipping && !entry.FreeShipping,
+			filter.CartTotal > 0 && entry.MinOrderValue > filter.CartTotal,
+			filter.Category != "" && len(entry.Categories) > 0 && !slices.Contains(entry.Categories, filter.Category),
+			filter.ExcludeFirstOrder && entry.FirstOrderOnly:
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if filter.CartTotal > 0 || filter.Currency != "" {
+		// Without a currency param the site's is kept, what's left may be mostly in another
+		currency := filter.Currency
+		if currency == "" && len(site.CouponEntries) > 0 {
+			currency = site.CouponEntries[0].SavingsCurrency
+		}
+		database.RankCoupons(entries, filter.CartTotal, currency)
+	}
+	if filter.SortByScore {
+		slices.SortStableFunc(entries, func(a, b types.CouponEntry) int {
+			return cmp.Compare(b.Score, a.Score)
+		})
+	}
+	site.CouponEntries = entries
+	return site
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/MisterNorwood/SugarCube-Server/pkg/types"
+	"github.com/labstack/echo/v4"
+)
+
+func TestApplyFilter(t *testing.T) {
+	site := types.Site{Name: "example.com", CouponEntries: []types.CouponEntry{
+		{Coupon: "PCT10", Score: 1, DiscountType: types.DiscountPercent, DiscountAmount: 10},
+		{Coupon: "FIX5", Score: 4, DiscountType: types.DiscountFixed, DiscountAmount: 5, Currency: "EUR", MinOrderValue: 50},
+		{Coupon: "SHIP", Score: 2, FreeShipping: true, Categories: []string{"shoes"}},
+		{Coupon: "WELCOME", Score: 3, DiscountType: types.DiscountFixed, DiscountAmount: 15, Currency: "EUR", FirstOrderOnly: true},
+	}}
+	tests := []struct {
+		name   string
+		filter types.CouponFilter
+		want   []string
+	}{
+		{"none", types.CouponFilter{}, []string{"PCT10", "FIX5", "SHIP", "WELCOME"}},
+		{"discount type", types.CouponFilter{DiscountType: types.DiscountFixed}, []string{"FIX5", "WELCOME"}},
+		{"free shipping", types.CouponFilter{FreeShipping: true}, []string{"SHIP"}},
+		{"category keeps unlimited coupons", types.CouponFilter{Category: "shoes"}, []string{"PCT10", "FIX5", "SHIP", "WELCOME"}},
+		{"other category", types.CouponFilter{Category: "hats"}, []string{"PCT10", "FIX5", "WELCOME"}},
+		{"no first order", types.CouponFilter{ExcludeFirstOrder: true}, []string{"PCT10", "FIX5", "SHIP"}},
+		{"score order", types.CouponFilter{SortByScore: true}, []string{"FIX5", "WELCOME", "SHIP", "PCT10"}},
+		// On a 40 cart FIX5 needs 50, 10% is 4 and WELCOME's 15 beats it
+		{"small cart", types.CouponFilter{CartTotal: 40}, []string{"WELCOME", "PCT10", "SHIP"}},
+		// On a 200 cart 10% is 20
+		{"big cart", types.CouponFilter{CartTotal: 200}, []string{"PCT10", "WELCOME", "FIX5", "SHIP"}},
+		// The fixed amounts are in euros, nothing is known to save dollars
+		{"other currency", types.CouponFilter{Currency: "USD"}, []string{"FIX5", "WELCOME", "SHIP", "PCT10"}},
+		{"other currency big cart", types.CouponFilter{Currency: "USD", CartTotal: 200}, []string{"PCT10", "FIX5", "WELCOME", "SHIP"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := codes(applyFilter(site, tt.filter)); !slices.Equal(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCouponFilter(t *testing.T) {
+	tests := []struct {
+		query string
+		want  types.CouponFilter
+		ok    bool
+	}{
+		{"", types.CouponFilter{}, true},
+		{"discount_type=PERCENT&free_shipping=1&category=%20Shoes", types.CouponFilter{DiscountType: types.DiscountPercent, FreeShipping: true, Category: "shoes"}, true},
+		{"cart_total=49.5&first_order=false&sort=score", types.CouponFilter{CartTotal: 49.5, ExcludeFirstOrder: true, SortByScore: true}, true},
+		{"first_order=true&sort=value", types.CouponFilter{}, true},
+		{"currency=eur", types.CouponFilter{Currency: "EUR"}, true},
+		{"currency=euro", types.CouponFilter{}, false},
+		{"discount_type=bogo", types.CouponFilter{}, false},
+		{"cart_total=-1", types.CouponFilter{}, false},
+		{"cart_total=NaN", types.CouponFilter{}, false},
+		{"cart_total=Inf", types.CouponFilter{}, false},
+		{"free_shipping=maybe", types.CouponFilter{}, false},
+		{"sort=random", types.CouponFilter{}, false},
+	}
+	for _, tt := range tests {
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/api/coupons?"+tt.query, nil), httptest.NewRecorder())
+		got, err := couponFilter(c)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: error %v, want ok %v", tt.query, err, tt.ok)
+			continue
+		}
+		if tt.ok && got != tt.want {
+			t.Errorf("%q: got %+v, want %+v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestFilterKey(t *testing.T) {
+	if key := filterKey(types.CouponFilter{}); key != "" {
+		t.Fatalf("no filter has key %q", key)
+	}
+	a := filterKey(types.CouponFilter{CartTotal: 40})
+	b := filterKey(types.CouponFilter{CartTotal: 40, SortByScore: true})
+	if a == "" || a == b {
+		t.Fatalf("filters share key %q", a)
+	}
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/MisterNorwood/SugarCube-Server/internal/services"
+	"github.com/MisterNorwood/SugarCube-Server/internal/utils"
+	"github.com/MisterNorwood/SugarCube-Server/pkg/types"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// POST /api/register, all versions
+func (h *Handler) RegisterInstall(c echo.Context) error {
+	ctx := c.Request().Context()
+	id, token, err := h.Installs.Register(ctx, c.RealIP(), c.Request().UserAgent())
+	if errors.Is(err, services.ErrRegistrationLimit) {
+		log.Warn().
+			Ctx(ctx).
+			Msg("Refused install registration, too many from this IP")
+		return echo.NewHTTPError(http.StatusTooManyRequests, "Too many registrations from this address, try again later")
+	}
+	if err != nil {
+		log.Error().
+			Ctx(ctx).
+			Err(err).
+			Msg("Failed to register install")
+		return err
+	}
+	if meta := utils.RequestMetaFrom(ctx); meta != nil {
+		meta.InstallID = id
+	}
+	log.Info().
+		Ctx(ctx).
+		Str("install_id", id).
+		Msg("Registered install")
+
+	return c.JSON(http.StatusCreated, types.RegisterResponse{
+		InstallID: id,
+		Token:     token,
+	})
+}
@@ -0,0 +1,67 @@
+package api
+
+import (
+	"cmp"
+	"net"
+	"net/http"
+	"slices"
+
+	"github.com/MisterNorwood/SugarCube-Server/internal/utils"
+	"github.com/MisterNorwood/SugarCube-Server/pkg/types"
+	"github.com/labstack/echo/v4"
+)
+
+// Where the region of a request came from
+const (
+	regionNone     = ""
+	regionQuery    = "query"
+	regionGeoIP    = "geoip"
+	regionLanguage = "accept-language"
+)
+
+// clientRegion is the country the client shops from: the region param, else the
+// country of its IP in the GeoIP database, else the region of its preferred language.
+// An empty region means the list isn't filtered.
+func (h *Handler) clientRegion(c echo.Context) (string, string, error) {
+	if param := c.QueryParam("region"); param != "" {
+		region, ok := utils.NormalizeRegion(param)
+		if !ok {
+			return "", regionNone, echo.NewHTTPError(http.StatusBadRequest, "region must be an ISO 3166-1 alpha-2 code")
+		}
+		return region, regionQuery, nil
+	}
+	if h.GeoIP != nil {
+		if country, ok := h.GeoIP.Country(net.ParseIP(c.RealIP())); ok {
+			if region, ok := utils.NormalizeRegion(country); ok {
+				return region, regionGeoIP, nil
+			}
+		}
+	}
+	if region, ok := utils.RegionFromAcceptLanguage(c.Request().Header.Get("Accept-Language")); ok {
+		return region, regionLanguage, nil
+	}
+	return "", regionNone, nil
+}
+
+// forRegion drops the coupons limited to other regions and ranks the ones clients from the
+// region voted down last. Those are still served, so votes from the region can lift them again.
+func forRegion(site types.Site, region string) types.Site {
+	entries := make([]types.CouponEntry, 0, len(site.CouponEntries))
+	for _, entry := range site.CouponEntries {
+		if len(entry.Regions) > 0 && !slices.Contains(entry.Regions, region) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	demoteVotedDown(entries, region)
+	site.CouponEntries = entries
+	return site
+}
+
+// demoteVotedDown moves coupons with a negative score in the region behind the rest, the
+// worst last. The order is otherwise kept, it's sorted again after every re-rank.
+func demoteVotedDown(entries []types.CouponEntry, region string) {
+	slices.SortStableFunc(entries, func(a, b types.CouponEntry) int {
+		return cmp.Compare(min(b.RegionScores[region], 0), min(a.RegionScores[region], 0))
+	})
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/MisterNorwood/SugarCube-Server/pkg/types"
+)
+
+func TestForRegion(t *testing.T) {
+	site := types.Site{Name: "example.com", CouponEntries: []types.CouponEntry{
+		{Coupon: "FAILSDE", RegionScores: map[string]float64{"DE": -1, "FR": 4}},
+		{Coupon: "EVERYWHERE"},
+		{Coupon: "FRONLY", Regions: []string{"FR"}},
+		{Coupon: "WORSTDE", RegionScores: map[string]float64{"DE": -5}},
+		{Coupon: "DEAT", Regions: []string{"DE", "AT"}, RegionScores: map[string]float64{"DE": 2}},
+	}}
+	tests := []struct {
+		region string
+		want   []string
+	}{
+		{"DE", []string{"EVERYWHERE", "DEAT", "FAILSDE", "WORSTDE"}},
+		{"FR", []string{"FAILSDE", "EVERYWHERE", "FRONLY", "WORSTDE"}},
+		{"AT", []string{"FAILSDE", "EVERYWHERE", "WORSTDE", "DEAT"}},
+		{"US", []string{"FAILSDE", "EVERYWHERE", "WORSTDE"}},
+	}
+	for _, tt := range tests {
+		got := codes(forRegion(site, tt.region))
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.region, got, tt.want)
+		}
+	}
+	if site.CouponEntries[0].Coupon != "FAILSDE" {
+		t.Fatal("forRegion reordered the cached list")
+	}
+}
+
+func TestDemoteAfterFilter(t *testing.T) {
+	site := types.Site{CouponEntries: []types.CouponEntry{
+		{Coupon: "LOW", Score: 1},
+		{Coupon: "FAILSDE", Score: 9, RegionScores: map[string]float64{"DE": -1}},
+		{Coupon: "MID", Score: 5},
+	}}
+	site = applyFilter(site, types.CouponFilter{SortByScore: true})
+	demoteVotedDown(site.CouponEntries, "DE")
+	if got, want := codes(site), []string{"MID", "LOW", "FAILSDE"}; !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func codes(site types.Site) []string {
+	result := make([]string, 0, len(site.CouponEntries))
+	for _, entry := range site.CouponEntries {
+		result = append(result, entry.Coupon)
+	}
+	return result
+}
@@ -1,9 +1,10 @@
 package api
 
-import "github.com/google/uuid"
+import "github.com/MisterNorwood/SugarCube-Server/pkg/types"
 
-type CallbackResponse struct {
-	RequestID uuid.UUID       `json:"RequestID"`
-	Site      string          `json:"Site"`
-	Results   map[string]bool `json:"Results"`
-}
+// Shared with pkg/client
+type (
+	CallbackResponse = types.CallbackResponse
+	BanRequest       = types.BanRequest
+	ErrorResponse    = types.ErrorResponse
+)
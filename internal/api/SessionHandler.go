@@ -0,0 +1,86 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/MisterNorwood/SugarCube-Server/internal/services"
+	"github.com/MisterNorwood/SugarCube-Server/internal/telemetry"
+	"github.com/MisterNorwood/SugarCube-Server/pkg/types"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// More than any site has, a larger request is a client bug or abuse
+const maxSessionCoupons = 200
+
+// POST /api/session?site=<sitename>, all versions. Opened right before the client tests
+// coupons, for the codes it is going to test. Votes of the session also score the coupons
+// in the client's region, see clientRegion.
+func (h *Handler) CreateSession(c echo.Context) error {
+	if c.Request().Header.Get("Content-Type") != "application/json" {
+		return echo.NewHTTPError(http.StatusUnsupportedMediaType, "Content-Type must be application/json")
+	}
+	var request types.SessionRequest
+	if err := c.Bind(&request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid JSON format")
+	}
+	if len(request.Coupons) == 0 || len(request.Coupons) > maxSessionCoupons {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Between 1 and %d coupons required", maxSessionCoupons))
+	}
+
+	list, err := h.couponList(c)
+	if err != nil {
+		return err
+	}
+	// Codes removed since the client fetched the list are left out rather than failing the session
+	offered := make(map[string]bool, len(list.Site.CouponEntries))
+	for _, entry := range list.Site.CouponEntries {
+		offered[entry.Coupon] = true
+	}
+	coupons := make([]string, 0, len(request.Coupons))
+	for _, code := range request.Coupons {
+		if offered[code] {
+			coupons = append(coupons, code)
+			offered[code] = false // Drops duplicates
+		}
+	}
+	if len(coupons) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "None of the coupons are on the site")
+	}
+
+	session, err := h.Sessions.CreateSession(net.ParseIP(c.RealIP()), list.Site.Name, list.Region, coupons)
+	if err != nil {
+		return sessionError(c, err)
+	}
+	trace.SpanFromContext(c.Request().Context()).SetAttributes(
+		attribute.String(telemetry.AttrSessionIDHash, telemetry.HashSessionID(session.RequestUUID)),
+	)
+	return c.JSON(http.StatusCreated, types.SessionResponse{
+		SessionID: session.RequestUUID,
+		Coupons:   coupons,
+		ExpiresAt: session.ExpiryTimestamp.UTC(),
+		Region:    list.Region,
+	})
+}
+
+// sessionError turns the session limits into responses, the client should retry later either way
+func sessionError(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, services.ErrSessionQuota):
+		log.Warn().
+			Ctx(c.Request().Context()).
+			Msg("Refused session over the per IP quota")
+		return echo.NewHTTPError(http.StatusTooManyRequests, "Too many open sessions, send the callbacks of the open ones first")
+	case errors.Is(err, services.ErrSessionsFull):
+		log.Warn().
+			Ctx(c.Request().Context()).
+			Msg("Refused session at the session limit")
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "Too many open sessions, try again later")
+	}
+	return err
+}
@@ -0,0 +1,135 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/MisterNorwood/SugarCube-Server/internal/services"
+	"github.com/MisterNorwood/SugarCube-Server/internal/telemetry"
+	"github.com/MisterNorwood/SugarCube-Server/pkg/types"
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/websocket"
+)
+
+var errWebSocketOrigin = errors.New("origin not allowed")
+
+func (h *Handler) SetStreamHeartbeat(interval time.Duration) {
+	h.heartbeat.Store(int64(interval))
+}
+
+// GET /api/coupons/stream?site=<sitename>, all versions. Server-sent events by default,
+// a WebSocket when the request asks for an upgrade.
+func (h *Handler) StreamCoupons(c echo.Context) error {
+	site := c.QueryParam("site")
+	if site == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Missing site parameter")
+	}
+	trace.SpanFromContext(c.Request().Context()).SetAttributes(attribute.String(telemetry.AttrSite, site))
+
+	events, cancel, err := h.Feed.Subscribe(site, c.RealIP())
+	if errors.Is(err, services.ErrFeedFull) || errors.Is(err, services.ErrFeedClosed) {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "Too many open streams, try again later")
+	}
+	if errors.Is(err, services.ErrFeedIPFull) {
+		return echo.NewHTTPError(http.StatusTooManyRequests, "Too many open streams from this address")
+	}
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	if strings.EqualFold(c.Request().Header.Get("Upgrade"), "websocket") {
+		return h.streamWebSocket(c, events)
+	}
+	return h.streamSSE(c, events)
+}
+
+func (h *Handler) streamSSE(c echo.Context, events <-chan types.CouponEvent) error {
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("X-Accel-Buffering", "no") // nginx would hold events back otherwise
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+
+	heartbeat := time.NewTicker(time.Duration(h.heartbeat.Load()))
+	defer heartbeat.Stop()
+	ctx := c.Request().Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-heartbeat.C:
+			if _, err := io.WriteString(res, ": ping\n\n"); err != nil {
+				return nil
+			}
+		case event, ok := <-events:
+			if !ok {
+				return nil // Shutting down or fell behind, EventSource reconnects on its own
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(res, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+				return nil
+			}
+		}
+		res.Flush()
+	}
+}
+
+func (h *Handler) streamWebSocket(c echo.Context, events <-chan types.CouponEvent) error {
+	server := websocket.Server{
+		// Browsers send the page's origin, it has to be one CORS allows. Clients outside
+		// a browser send none and are limited like any other caller.
+		Handshake: func(_ *websocket.Config, r *http.Request) error {
+			origin := r.Header.Get("Origin")
+			if origin != "" && (h.AllowOrigin == nil || !h.AllowOrigin(origin)) {
+				return errWebSocketOrigin
+			}
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+			// Clients don't send anything, reading only notices when they go away
+			closed := make(chan struct{})
+			go func() {
+				_, _ = io.Copy(io.Discard, ws)
+				close(closed)
+			}()
+
+			heartbeat := time.NewTicker(time.Duration(h.heartbeat.Load()))
+			defer heartbeat.Stop()
+			for {
+				select {
+				case <-closed:
+					return
+				case <-heartbeat.C:
+					ws.PayloadType = websocket.PingFrame
+					_, err := ws.Write(nil)
+					ws.PayloadType = websocket.TextFrame
+					if err != nil {
+						return
+					}
+				case event, ok := <-events:
+					if !ok {
+						return
+					}
+					if err := websocket.JSON.Send(ws, event); err != nil {
+						return
+					}
+				}
+			}
+		},
+	}
+	server.ServeHTTP(c.Response(), c.Request())
+	return nil
+}
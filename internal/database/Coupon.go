@@ -4,41 +4,49 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
+	"net/url"
+	"slices"
+	"strings"
 	"time"
 
+	"github.com/MisterNorwood/SugarCube-Server/internal/telemetry"
+	"github.com/MisterNorwood/SugarCube-Server/internal/utils"
+	"github.com/MisterNorwood/SugarCube-Server/pkg/types"
+	"github.com/rs/zerolog/log"
 	"go.mongodb.org/mongo-driver/v2/bson"
 	"go.mongodb.org/mongo-driver/v2/mongo"
 	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
-type CouponEntry struct {
-	Coupon    string         `bson:"coupon" json:"coupon"`           //Actual coupon
-	Score     int            `bson:"score" json:"score"`             //Internal, a score to track how effective the code is
-	ExpiresAt time.Time      `bson:"expires_at" json:"expires_at"`   //IMPORTANT: ISO8601-formatted
-	Extra     map[string]any `bson:",inline" json:"extra,omitempty"` //Random stuff for other sites
-}
-
-type Site struct {
-	Name          string        `json:"name"` //URL
-	CouponEntries []CouponEntry `json:"coupon_entries"`
-}
+// Shared with pkg/client
+type (
+	CouponEntry = types.CouponEntry
+	Site        = types.Site
+)
 
-func GetSiteStruct(siteName string, db *mongo.Database) (*Site, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// GetSiteStruct returns a site with its coupons, best first, pending ones only if includePending is set
+func GetSiteStruct(parent context.Context, siteName string, db *mongo.Database, includePending bool) (site *Site, err error) {
+	ctx, span := startSpan(parent, "database.GetSiteStruct", siteName)
+	defer func() { endSpan(span, err) }()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 
-	collections, err := db.ListCollectionNames(ctx, bson.M{"name": siteName})
-	if err != nil {
-		return nil, fmt.Errorf("error listing collections: %w", err)
-	}
-	if len(collections) == 0 {
-		return nil, fmt.Errorf("site '%s' does not exist", siteName)
+	// No collection can have such a name, and Find would fail on it
+	if validateSiteName(siteName) != nil {
+		return nil, NotFound("site '%s' does not exist", siteName)
 	}
-
 	coll := db.Collection(siteName)
-	cur, err := coll.Find(ctx, bson.M{})
+	filter := bson.M{}
+	if !includePending {
+		filter["status"] = bson.M{"$ne": types.CouponPending}
+	}
+	cur, err := coll.Find(ctx, filter)
 	if err != nil {
-		return nil, fmt.Errorf("error fetching coupons from '%s': %w", siteName, err)
+		return nil, wrapMongoErr(err, "error fetching coupons from '%s'", siteName)
 	}
 	defer cur.Close(ctx)
 
@@ -51,9 +59,21 @@ func GetSiteStruct(siteName string, db *mongo.Database) (*Site, error) {
 		coupons = append(coupons, entry)
 	}
 	if err := cur.Err(); err != nil {
-		return nil, fmt.Errorf("cursor error: %w", err)
+		return nil, wrapMongoErr(err, "cursor error")
+	}
+	// Finding nothing doesn't tell an empty site from a missing one
+	if len(coupons) == 0 {
+		collections, err := db.ListCollectionNames(ctx, bson.M{"name": siteName})
+		if err != nil {
+			return nil, wrapMongoErr(err, "error listing collections")
+		}
+		if len(collections) == 0 {
+			return nil, NotFound("site '%s' does not exist", siteName)
+		}
 	}
 
+	RankCoupons(coupons, 0, "")
+	span.SetAttributes(attribute.Int(telemetry.AttrCouponCount, len(coupons)))
 	return &Site{
 		Name:          siteName,
 		CouponEntries: coupons,
@@ -61,83 +81,540 @@ func GetSiteStruct(siteName string, db *mongo.Database) (*Site, error) {
 
 }
 
-func AddCouponToExistingSite(siteName string, coupon CouponEntry, db *mongo.Database) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// AddCouponToExistingSite inserts the coupon and returns it as stored. A variant of a code
+// the site has, the same but for case or whitespace, is merged into that coupon instead,
+// which is returned with merged set. Only a pending coupon takes on the variant's details,
+// a variant that would change a live one is stored as a pending coupon that PromotePending
+// folds into the live one once votes promote it.
+func AddCouponToExistingSite(parent context.Context, siteName string, coupon CouponEntry, db *mongo.Database, caseSensitive bool) (stored *CouponEntry, merged bool, err error) {
+	ctx, span := startSpan(parent, "database.AddCouponToExistingSite", siteName)
+	defer func() { endSpan(span, err) }()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 
+	coupon.Coupon = strings.TrimSpace(coupon.Coupon)
+	if coupon.Coupon == "" {
+		return nil, false, Invalid("coupon code must not be empty")
+	}
+	if err := normalizeLocation(&coupon); err != nil {
+		return nil, false, err
+	}
+	if err := normalizeDiscount(&coupon); err != nil {
+		return nil, false, err
+	}
+	coupon.CodeKey = utils.CouponKey(coupon.Coupon, caseSensitive)
+	coupon.VariantOf = ""
+
 	collections, err := db.ListCollectionNames(ctx, bson.M{"name": siteName})
 	if err != nil {
-		return fmt.Errorf("error listing collections: %w", err)
+		return nil, false, wrapMongoErr(err, "error listing collections")
 	}
 	if len(collections) == 0 {
-		return fmt.Errorf("site '%s' does not exist", siteName)
+		return nil, false, NotFound("site '%s' does not exist", siteName)
 	}
 
-	filter := bson.M{"coupon": coupon.Coupon}
-	var existing bson.M
-	err = db.Collection(siteName).FindOne(ctx, filter).Decode(&existing)
+	coll := db.Collection(siteName)
+	// The exact code first, a variant waiting for votes has no key
+	var existing CouponEntry
+	err = coll.FindOne(ctx, bson.M{"coupon": coupon.Coupon}).Decode(&existing)
 	if err == nil {
-		return fmt.Errorf("coupon '%s' already exists", coupon.Coupon)
-	} else if !errors.Is(err, mongo.ErrNoDocuments) {
-		return fmt.Errorf("failed to check existing coupon: %w", err)
+		return nil, false, Conflict("coupon already exists")
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, false, wrapMongoErr(err, "failed to check existing coupon")
+	}
+	err = coll.FindOne(ctx, bson.M{"code_key": coupon.CodeKey}).Decode(&existing)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		if _, err := coll.InsertOne(ctx, coupon); err != nil {
+			return nil, false, wrapMongoErr(err, "insert failed")
+		}
+		return &coupon, false, nil
 	}
-
-	_, err = db.Collection(siteName).InsertOne(ctx, coupon)
 	if err != nil {
-		return fmt.Errorf("insert failed: %w", err)
+		return nil, false, wrapMongoErr(err, "failed to check existing coupon")
 	}
 
-	return nil
+	// The submission is new to nobody, only what it says about the coupon counts
+	coupon.Score, coupon.RegionScores = 0, nil
+	if existing.Status != types.CouponPending {
+		if !changesDetails(existing, coupon) {
+			return &existing, true, nil
+		}
+		variant := reviewVariant(coupon, existing.Coupon)
+		if _, err := coll.InsertOne(ctx, variant); err != nil {
+			return nil, false, wrapMongoErr(err, "insert failed")
+		}
+		return &variant, false, nil
+	}
+
+	coupon.SubmittedBy = ""
+	result := mergeDetails(mergeVotes(existing, coupon), coupon)
+	if _, err := coll.ReplaceOne(ctx, bson.M{"coupon": existing.Coupon}, result); err != nil {
+		return nil, false, wrapMongoErr(err, "failed to merge coupon")
+	}
+	return &result, true, nil
 }
 
-func AddSite(siteName string, db *mongo.Database) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+func AddSite(parent context.Context, siteName string, db *mongo.Database) (err error) {
+	ctx, span := startSpan(parent, "database.AddSite", siteName)
+	defer func() { endSpan(span, err) }()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 
+	if err := validateSiteName(siteName); err != nil {
+		return err
+	}
+
 	collections, err := db.ListCollectionNames(ctx, bson.M{"name": siteName})
 	if err != nil {
-		return fmt.Errorf("error listing collections: %w", err)
+		return wrapMongoErr(err, "error listing collections")
 	}
 	if len(collections) != 0 {
-		return fmt.Errorf("site '%s' does already exists!", siteName)
+		return Conflict("site '%s' already exists", siteName)
 	}
 	e := db.CreateCollection(ctx, siteName)
 	if e != nil {
-		return fmt.Errorf("site collection for '%s' failed: %w ", siteName, err)
+		return wrapMongoErr(e, "site collection for '%s' failed", siteName)
 
 	}
-	indexErr := EnsureCouponIndex(db.Collection(siteName))
+	indexErr := EnsureCouponIndex(ctx, db.Collection(siteName))
 	if indexErr != nil {
-		return fmt.Errorf("collection index adjustment for site '%s' failed: %w", siteName, indexErr)
+		return wrapMongoErr(indexErr, "collection index adjustment for site '%s' failed", siteName)
 	}
+	enablePreImages(ctx, db, siteName)
 
 	return nil
 
 }
 
-func ProcessCallback(db *mongo.Database, siteName string, callbackResults map[string]bool) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+// normalizeLocation checks and upper-cases the region, currency and locale fields
+func normalizeLocation(coupon *CouponEntry) error {
+	regions := make([]string, 0, len(coupon.Regions))
+	for _, region := range coupon.Regions {
+		normalized, ok := utils.NormalizeRegion(region)
+		if !ok {
+			return Invalid("region '%s' is not an ISO 3166-1 alpha-2 code", region)
+		}
+		if !slices.Contains(regions, normalized) {
+			regions = append(regions, normalized)
+		}
+	}
+	coupon.Regions = regions
+	if coupon.Currency != "" {
+		currency, ok := utils.NormalizeCurrency(coupon.Currency)
+		if !ok {
+			return Invalid("currency '%s' is not an ISO 4217 code", coupon.Currency)
+		}
+		coupon.Currency = currency
+	}
+	if coupon.Locale != "" {
+		locale, ok := utils.NormalizeLocale(coupon.Locale)
+		if !ok {
+			return Invalid("locale '%s' is not a BCP 47 tag", coupon.Locale)
+		}
+		coupon.Locale = locale
+	}
+	return nil
+}
+
+// normalizeDiscount checks the discount fields and lower-cases the type and categories
+func normalizeDiscount(coupon *CouponEntry) error {
+	coupon.DiscountType = strings.ToLower(strings.TrimSpace(coupon.DiscountType))
+	switch coupon.DiscountType {
+	case "":
+		if coupon.DiscountAmount != 0 {
+			return Invalid("discount_amount needs a discount_type")
+		}
+	case types.DiscountPercent:
+		if coupon.DiscountAmount > 100 {
+			return Invalid("discount_amount of a percent discount must be at most 100")
+		}
+	case types.DiscountFixed:
+	default:
+		return Invalid("discount_type must be %s or %s", types.DiscountPercent, types.DiscountFixed)
+	}
+	for field, value := range map[string]float64{"discount_amount": coupon.DiscountAmount, "min_order_value": coupon.MinOrderValue} {
+		if value < 0 || math.IsNaN(value) || math.IsInf(value, 0) {
+			return Invalid("%s must be a number of at least 0", field)
+		}
+	}
+
+	categories := make([]string, 0, len(coupon.Categories))
+	for _, category := range coupon.Categories {
+		category = strings.ToLower(strings.TrimSpace(category))
+		if category == "" || len(category) > 100 {
+			return Invalid("categories must be between 1 and 100 characters")
+		}
+		if !slices.Contains(categories, category) {
+			categories = append(categories, category)
+		}
+	}
+	coupon.Categories = categories
+
+	if coupon.SourceURL != "" {
+		source, err := url.Parse(coupon.SourceURL)
+		if err != nil || (source.Scheme != "http" && source.Scheme != "https") || source.Host == "" || len(coupon.SourceURL) > 2048 {
+			return Invalid("source_url must be an http or https URL")
+		}
+	}
+	// Only callbacks report outcomes
+	coupon.ReportsApplied, coupon.ReportsFailed, coupon.SavingsSamples = 0, 0, nil
+	return nil
+}
+
+// Site names become collection names, so they have to follow Mongo's naming rules
+func validateSiteName(siteName string) error {
+	if siteName == "" || len(siteName) > 255 {
+		return Invalid("site name must be between 1 and 255 characters")
+	}
+	if strings.ContainsAny(siteName, "$\x00") || strings.HasPrefix(siteName, "system.") {
+		return Invalid("site name contains forbidden characters")
+	}
+	return nil
+}
+
+// VoteResult is the state of a coupon right before a callback vote was applied to it
+type VoteResult struct {
+	Coupon      string
+	Worked      bool
+	ScoreBefore float64
+	ScoreAfter  float64
+	Status      string
+	SubmittedBy string
+}
+
+// Vote is one callback's results and what they count for
+type Vote struct {
+	Results        map[string]bool
+	Region         string                        // Also scored per region when set
+	Reports        map[string]types.CouponReport // Savings of the coupons, from v2 callbacks
+	Weight         float64
+	Voter          string // Votes on the voter's own coupons are ignored
+	IncludePending bool   // Only trusted clients can vote pending coupons live
+}
+
+// ProcessCallback moves each reported coupon's score by the vote's weight, up if it worked
+// and down if it didn't, and returns what the coupons looked like before. Unknown coupons
+// and coupons the vote doesn't count for are skipped.
+func ProcessCallback(parent context.Context, db *mongo.Database, siteName string, vote Vote) []VoteResult {
+	ctx, span := startSpan(parent, "database.ProcessCallback", siteName)
+	defer span.End()
+	span.SetAttributes(attribute.Int(telemetry.AttrCouponCount, len(vote.Results)))
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	coll := db.Collection(siteName)
 
-	for code, worked := range callbackResults {
+	var results []VoteResult
+	for code, worked := range vote.Results {
+		change := vote.Weight
 		if !worked {
-			filter := bson.M{"coupon": code}
-			update := bson.M{"$inc": bson.M{"score": -1}}
-			_, _ = coll.UpdateOne(ctx, filter, update)
+			change = -vote.Weight
+		}
+		filter := bson.M{"coupon": code}
+		if vote.Voter != "" {
+			filter["submitted_by"] = bson.M{"$ne": vote.Voter}
+		}
+		if !vote.IncludePending {
+			filter["status"] = bson.M{"$ne": types.CouponPending}
+		}
+		inc := bson.M{"score": change}
+		if vote.Region != "" {
+			inc["region_scores."+vote.Region] = change
+		}
+		if worked {
+			inc["reports_applied"] = 1
+		} else {
+			inc["reports_failed"] = 1
+		}
+		update := bson.M{"$inc": inc}
+		if report, ok := vote.Reports[code]; ok && worked && (report.Discount > 0 || report.CartTotal > 0) {
+			sample := types.SavingsSample{Discount: report.Discount, CartTotal: report.CartTotal, Currency: report.Currency, At: time.Now().UTC()}
+			update["$push"] = bson.M{"savings_samples": bson.M{"$each": bson.A{sample}, "$slice": -savingsSamples}}
+		}
+		var before CouponEntry
+		err := coll.FindOneAndUpdate(ctx, filter, update).Decode(&before)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			continue
+		}
+		if err != nil {
+			log.Warn().
+				Ctx(ctx).
+				Str("site", utils.RedactSite(siteName)).
+				Str("coupon", utils.RedactCoupon(code)).
+				Err(err).
+				Msg("Failed to apply callback score")
+			continue
+		}
+		results = append(results, VoteResult{
+			Coupon:      code,
+			Worked:      worked,
+			ScoreBefore: before.Score,
+			ScoreAfter:  before.Score + change,
+			Status:      before.Status,
+			SubmittedBy: before.SubmittedBy,
+		})
+	}
+	return results
+}
+
+// AdjustScore adds change to a coupon's score, for votes applied after review, and returns the updated coupon
+func AdjustScore(parent context.Context, db *mongo.Database, siteName, code string, change float64) (coupon *CouponEntry, err error) {
+	ctx, span := startSpan(parent, "database.AdjustScore", siteName)
+	defer func() { endSpan(span, err) }()
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var updated CouponEntry
+	err = db.Collection(siteName).FindOneAndUpdate(ctx,
+		bson.M{"coupon": code},
+		bson.M{"$inc": bson.M{"score": change}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&updated)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, NotFound("coupon does not exist")
+	}
+	if err != nil {
+		return nil, wrapMongoErr(err, "failed to adjust score")
+	}
+	return &updated, nil
+}
+
+// PromotePending makes pending coupons that reached minScore live and returns them. A
+// variant held back from a live coupon is folded into it instead, the live coupon is
+// returned in its place.
+func PromotePending(parent context.Context, db *mongo.Database, siteName string, minScore float64, caseSensitive bool) (promoted []CouponEntry, err error) {
+	ctx, span := startSpan(parent, "database.PromotePending", siteName)
+	defer func() { endSpan(span, err) }()
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	coll := db.Collection(siteName)
+	filter := bson.M{"status": types.CouponPending, "score": bson.M{"$gte": minScore}}
+	cur, err := coll.Find(ctx, filter)
+	if err != nil {
+		return nil, wrapMongoErr(err, "failed to find promotable coupons")
+	}
+	var found []CouponEntry
+	if err := cur.All(ctx, &found); err != nil {
+		return nil, wrapMongoErr(err, "cursor error")
+	}
+
+	var codes []string
+	for _, coupon := range found {
+		if coupon.VariantOf != "" {
+			folded, err := foldVariant(ctx, coll, coupon, caseSensitive)
+			if err != nil {
+				return promoted, err
+			}
+			promoted = append(promoted, *folded)
+			continue
 		}
+		coupon.Status = types.CouponLive
+		codes = append(codes, coupon.Coupon)
+		promoted = append(promoted, coupon)
+	}
+	if len(codes) == 0 {
+		return promoted, nil
+	}
+	filter["coupon"] = bson.M{"$in": codes}
+	if _, err := coll.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"status": types.CouponLive}}); err != nil {
+		return nil, wrapMongoErr(err, "failed to promote pending coupons")
+	}
+	return promoted, nil
+}
+
+// ListPending returns the pending coupons of a site, the ones waiting for votes or an admin
+func ListPending(parent context.Context, db *mongo.Database, siteName string) (pending []CouponEntry, err error) {
+	ctx, span := startSpan(parent, "database.ListPending", siteName)
+	defer func() { endSpan(span, err) }()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	if validateSiteName(siteName) != nil {
+		return nil, NotFound("site '%s' does not exist", siteName)
+	}
+	cur, err := db.Collection(siteName).Find(ctx, bson.M{"status": types.CouponPending}, options.Find().SetSort(bson.D{{Key: "score", Value: -1}}))
+	if err != nil {
+		return nil, wrapMongoErr(err, "failed to find pending coupons")
+	}
+	pending = []CouponEntry{}
+	if err := cur.All(ctx, &pending); err != nil {
+		return nil, wrapMongoErr(err, "cursor error")
 	}
+	return pending, nil
 }
 
-func EnsureCouponIndex(collection *mongo.Collection) error {
-	indexModel := mongo.IndexModel{
-		Keys: bson.D{{Key: "coupon", Value: 1}},
-		Options: options.Index().
-			SetUnique(true).
-			SetName("coupon_idx"),
+// PromoteCoupon makes one pending coupon live whatever its score, for an admin approving it.
+// A variant held back from a live coupon is folded into it, which is returned instead.
+func PromoteCoupon(parent context.Context, db *mongo.Database, siteName, code string, caseSensitive bool) (coupon *CouponEntry, err error) {
+	ctx, span := startSpan(parent, "database.PromoteCoupon", siteName)
+	defer func() { endSpan(span, err) }()
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if validateSiteName(siteName) != nil {
+		return nil, NotFound("site '%s' does not exist", siteName)
 	}
+	coll := db.Collection(siteName)
+	filter := bson.M{"coupon": code, "status": types.CouponPending}
+	var pending CouponEntry
+	err = coll.FindOne(ctx, filter).Decode(&pending)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, NotFound("no pending coupon '%s'", code)
+	}
+	if err != nil {
+		return nil, wrapMongoErr(err, "failed to find pending coupon")
+	}
+	if pending.VariantOf != "" {
+		return foldVariant(ctx, coll, pending, caseSensitive)
+	}
+	result, err := coll.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"status": types.CouponLive}})
+	if err != nil {
+		return nil, wrapMongoErr(err, "failed to promote pending coupon")
+	}
+	if result.MatchedCount == 0 {
+		return nil, NotFound("no pending coupon '%s'", code)
+	}
+	pending.Status = types.CouponLive
+	return &pending, nil
+}
+
+// DeletePending deletes a pending coupon, for an admin rejecting it. Live coupons are left alone.
+func DeletePending(parent context.Context, db *mongo.Database, siteName, code string) (err error) {
+	ctx, span := startSpan(parent, "database.DeletePending", siteName)
+	defer func() { endSpan(span, err) }()
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
 
-	_, err := collection.Indexes().CreateOne(context.TODO(), indexModel)
+	if validateSiteName(siteName) != nil {
+		return NotFound("site '%s' does not exist", siteName)
+	}
+	result, err := db.Collection(siteName).DeleteOne(ctx, bson.M{"coupon": code, "status": types.CouponPending})
+	if err != nil {
+		return wrapMongoErr(err, "failed to delete pending coupon")
+	}
+	if result.DeletedCount == 0 {
+		return NotFound("no pending coupon '%s'", code)
+	}
+	return nil
+}
+
+// foldVariant merges a promoted variant into the coupon it was held back from and returns
+// that coupon. If the coupon is gone the variant goes live in its place with its key.
+func foldVariant(ctx context.Context, coll *mongo.Collection, variant CouponEntry, caseSensitive bool) (*CouponEntry, error) {
+	var target CouponEntry
+	err := coll.FindOne(ctx, bson.M{"coupon": variant.VariantOf}).Decode(&target)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		variant.Status, variant.VariantOf = types.CouponLive, ""
+		variant.CodeKey = utils.CouponKey(variant.Coupon, caseSensitive)
+		if _, err := coll.ReplaceOne(ctx, bson.M{"coupon": variant.Coupon}, variant); err != nil {
+			return nil, wrapMongoErr(err, "failed to promote coupon variant")
+		}
+		return &variant, nil
+	}
+	if err != nil {
+		return nil, wrapMongoErr(err, "failed to find the coupon of a variant")
+	}
+
+	variant.Status = types.CouponLive
+	result := mergeDetails(mergeVotes(target, variant), variant)
+	if _, err := coll.ReplaceOne(ctx, bson.M{"coupon": target.Coupon}, result); err != nil {
+		return nil, wrapMongoErr(err, "failed to merge coupon variant")
+	}
+	if _, err := coll.DeleteOne(ctx, bson.M{"coupon": variant.Coupon}); err != nil {
+		return nil, wrapMongoErr(err, "failed to delete merged coupon variant")
+	}
+	return &result, nil
+}
+
+// EnablePreImages has every site collection keep pre-images for change streams, so deletes
+// carry the deleted coupon. Best effort, it needs MongoDB 6.0 and a replica set.
+func EnablePreImages(ctx context.Context, db *mongo.Database) {
+	names, err := db.ListCollectionNames(ctx, bson.M{})
+	if err != nil {
+		log.Debug().
+			Ctx(ctx).
+			Err(err).
+			Msg("Failed to list collections for pre-images")
+		return
+	}
+	for _, name := range names {
+		enablePreImages(ctx, db, name)
+	}
+}
+
+func enablePreImages(ctx context.Context, db *mongo.Database, collection string) {
+	err := db.RunCommand(ctx, bson.D{
+		{Key: "collMod", Value: collection},
+		{Key: "changeStreamPreAndPostImages", Value: bson.M{"enabled": true}},
+	}).Err()
+	if err != nil {
+		log.Debug().
+			Ctx(ctx).
+			Str("collection", collection).
+			Err(err).
+			Msg("Pre-images not enabled")
+	}
+}
+
+// EnsureCouponIndexes creates the coupon indexes on every site collection, sites from
+// before code keys have none. Best effort, a site whose coupons clash on a key is logged
+// and keeps working without the key index until the merge endpoint is run on it.
+func EnsureCouponIndexes(ctx context.Context, db *mongo.Database) error {
+	names, err := db.ListCollectionNames(ctx, bson.M{})
+	if err != nil {
+		return wrapMongoErr(err, "error listing collections")
+	}
+	for _, name := range names {
+		err := EnsureCouponIndex(ctx, db.Collection(name))
+		switch {
+		case err == nil:
+		case mongo.IsDuplicateKeyError(err):
+			log.Warn().
+				Ctx(ctx).
+				Str("site", utils.RedactSite(name)).
+				Err(err).
+				Msg("Coupons share a code key, run POST /api/admin/coupons/merge on the site")
+		default:
+			log.Warn().
+				Ctx(ctx).
+				Str("site", utils.RedactSite(name)).
+				Err(err).
+				Msg("Failed to create coupon indexes")
+		}
+	}
+	return nil
+}
+
+func EnsureCouponIndex(ctx context.Context, collection *mongo.Collection) error {
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "coupon", Value: 1}},
+			Options: options.Index().
+				SetUnique(true).
+				SetName("coupon_idx"),
+		},
+		{
+			// Coupons from before keys have none until MergeDuplicates runs on the site
+			Keys: bson.D{{Key: "code_key", Value: 1}},
+			Options: options.Index().
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"code_key": bson.M{"$type": "string"}}).
+				SetName("code_key_idx"),
+		},
+	})
 	return err
 }
+
+func startSpan(ctx context.Context, name string, siteName string) (context.Context, trace.Span) {
+	return telemetry.Tracer().Start(ctx, name, trace.WithAttributes(attribute.String(telemetry.AttrSite, siteName)))
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
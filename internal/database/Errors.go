@@ -0,0 +1,78 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// Error kinds, match them with errors.Is
+var (
+	ErrNotFound    = errors.New("not found")
+	ErrConflict    = errors.New("conflict")
+	ErrInvalid     = errors.New("invalid")
+	ErrUnavailable = errors.New("unavailable")
+)
+
+// Error is returned by the database layer. Message is safe to show to API clients,
+// Err holds the underlying cause and should only ever end up in logs.
+type Error struct {
+	Kind    error
+	Message string
+	Err     error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %v", e.Message, e.Err)
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+func (e *Error) Is(target error) bool { return target == e.Kind }
+
+func NotFound(format string, args ...any) error {
+	return &Error{Kind: ErrNotFound, Message: fmt.Sprintf(format, args...)}
+}
+
+func Conflict(format string, args ...any) error {
+	return &Error{Kind: ErrConflict, Message: fmt.Sprintf(format, args...)}
+}
+
+func Invalid(format string, args ...any) error {
+	return &Error{Kind: ErrInvalid, Message: fmt.Sprintf(format, args...)}
+}
+
+func Unavailable(cause error, format string, args ...any) error {
+	return &Error{Kind: ErrUnavailable, Message: fmt.Sprintf(format, args...), Err: cause}
+}
+
+// wrapMongoErr classifies a driver error. Errors that aren't a known kind
+// are wrapped as-is and surface as internal errors.
+func wrapMongoErr(err error, format string, args ...any) error {
+	msg := fmt.Sprintf(format, args...)
+	switch {
+	case err == nil:
+		return nil
+	case mongo.IsDuplicateKeyError(err):
+		return &Error{Kind: ErrConflict, Message: msg, Err: err}
+	case mongo.IsTimeout(err), mongo.IsNetworkError(err),
+		errors.Is(err, context.DeadlineExceeded), errors.Is(err, mongo.ErrClientDisconnected):
+		return &Error{Kind: ErrUnavailable, Message: msg, Err: err}
+	default:
+		return fmt.Errorf("%s: %w", msg, err)
+	}
+}
+
+// PublicMessage returns the client-safe message of a database error
+func PublicMessage(err error) (string, bool) {
+	var dbErr *Error
+	if errors.As(err, &dbErr) {
+		return dbErr.Message, true
+	}
+	return "", false
+}
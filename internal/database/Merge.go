@@ -0,0 +1,247 @@
+package database
+
+import (
+	"cmp"
+	"context"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/MisterNorwood/SugarCube-Server/internal/utils"
+	"github.com/MisterNorwood/SugarCube-Server/pkg/types"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// CouponMerge is a merge with the variants that were live, only their removal is public.
+// Variants held back as pending count as removed, they're out of the public list.
+type CouponMerge struct {
+	types.CouponMerge
+	Live []string
+}
+
+// MergeDuplicates merges the coupons of a site whose codes share a key and stores the key
+// on every coupon, for sites from before keys or after the case rule changed. The coupon
+// kept is the live one with the best score, variants' scores and reports are added to it.
+// A variant whose details would change a live kept coupon is held back as pending instead.
+// Keys are rewritten one coupon at a time, so on error the merges done so far are returned
+// with it and every coupon not reached yet still has its old key.
+func MergeDuplicates(parent context.Context, db *mongo.Database, siteName string, caseSensitive bool) (merges []CouponMerge, err error) {
+	ctx, span := startSpan(parent, "database.MergeDuplicates", siteName)
+	defer func() { endSpan(span, err) }()
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	collections, err := db.ListCollectionNames(ctx, bson.M{"name": siteName})
+	if err != nil {
+		return nil, wrapMongoErr(err, "error listing collections")
+	}
+	if len(collections) == 0 {
+		return nil, NotFound("site '%s' does not exist", siteName)
+	}
+	coll := db.Collection(siteName)
+	cur, err := coll.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, wrapMongoErr(err, "error fetching coupons from '%s'", siteName)
+	}
+	var coupons []CouponEntry
+	if err := cur.All(ctx, &coupons); err != nil {
+		return nil, wrapMongoErr(err, "cursor error")
+	}
+
+	groups := map[string][]CouponEntry{}
+	for _, coupon := range coupons {
+		// Waiting for votes to fold into their live coupon, see PromotePending
+		if coupon.VariantOf != "" {
+			continue
+		}
+		key := utils.CouponKey(coupon.Coupon, caseSensitive)
+		groups[key] = append(groups[key], coupon)
+	}
+	for _, key := range slices.Sorted(maps.Keys(groups)) {
+		group := groups[key]
+		slices.SortFunc(group, func(a, b CouponEntry) int {
+			return cmp.Or(
+				cmp.Compare(pendingRank(a), pendingRank(b)),
+				cmp.Compare(b.Score, a.Score),
+				cmp.Compare(a.Coupon, b.Coupon),
+			)
+		})
+		kept := group[0]
+		if len(group) == 1 {
+			if kept.CodeKey == key {
+				continue
+			}
+			if err := releaseKey(ctx, coll, key, kept.Coupon); err != nil {
+				return merges, err
+			}
+			if _, err := coll.UpdateOne(ctx, bson.M{"coupon": kept.Coupon}, bson.M{"$set": bson.M{"code_key": key}}); err != nil {
+				return merges, wrapMongoErr(err, "failed to store coupon key")
+			}
+			continue
+		}
+
+		merged := kept
+		merge := CouponMerge{CouponMerge: types.CouponMerge{Site: siteName, Coupon: kept.Coupon, Variants: []string{}}}
+		var review []CouponEntry
+		for _, variant := range group[1:] {
+			merged = mergeVotes(merged, variant)
+			if variant.Status != types.CouponPending {
+				merge.Live = append(merge.Live, variant.Coupon)
+			}
+			switch {
+			case merged.Status == types.CouponPending:
+				merged = mergeDetails(merged, variant)
+			case changesDetails(merged, variant):
+				review = append(review, reviewVariant(variant, kept.Coupon))
+				merge.Pending = append(merge.Pending, variant.Coupon)
+				continue
+			}
+			merge.Variants = append(merge.Variants, variant.Coupon)
+		}
+		merged.CodeKey = key
+		if _, err := coll.DeleteMany(ctx, bson.M{"coupon": bson.M{"$in": merge.Variants}}); err != nil {
+			return merges, wrapMongoErr(err, "failed to delete merged coupons")
+		}
+		for _, variant := range review {
+			if _, err := coll.ReplaceOne(ctx, bson.M{"coupon": variant.Coupon}, variant); err != nil {
+				return merges, wrapMongoErr(err, "failed to hold back merged coupon")
+			}
+		}
+		if err := releaseKey(ctx, coll, key, kept.Coupon); err != nil {
+			return merges, err
+		}
+		if _, err := coll.ReplaceOne(ctx, bson.M{"coupon": kept.Coupon}, merged); err != nil {
+			return merges, wrapMongoErr(err, "failed to store merged coupon")
+		}
+		merges = append(merges, merge)
+	}
+
+	if err := EnsureCouponIndex(ctx, coll); err != nil {
+		return merges, wrapMongoErr(err, "coupon key index for site '%s' failed", siteName)
+	}
+	return merges, nil
+}
+
+// releaseKey takes the key from a coupon other than the one about to store it. Only a key
+// from an earlier case rule can be held elsewhere, its holder gets its new key in its own group.
+func releaseKey(ctx context.Context, coll *mongo.Collection, key, coupon string) error {
+	_, err := coll.UpdateMany(ctx,
+		bson.M{"code_key": key, "coupon": bson.M{"$ne": coupon}},
+		bson.M{"$unset": bson.M{"code_key": ""}},
+	)
+	return wrapMongoErr(err, "failed to release coupon key")
+}
+
+func pendingRank(coupon CouponEntry) int {
+	if coupon.Status == types.CouponPending {
+		return 1
+	}
+	return 0
+}
+
+// mergeVotes folds what callbacks said about a variant into the kept coupon: scores,
+// reports and savings. A live variant makes a pending kept coupon live.
+func mergeVotes(kept, variant CouponEntry) CouponEntry {
+	kept.Score += variant.Score
+	if len(variant.RegionScores) > 0 {
+		regionScores := maps.Clone(kept.RegionScores)
+		if regionScores == nil {
+			regionScores = map[string]float64{}
+		}
+		for region, score := range variant.RegionScores {
+			regionScores[region] += score
+		}
+		kept.RegionScores = regionScores
+	}
+	kept.ReportsApplied += variant.ReportsApplied
+	kept.ReportsFailed += variant.ReportsFailed
+	samples := append(slices.Clone(kept.SavingsSamples), variant.SavingsSamples...)
+	slices.SortStableFunc(samples, func(a, b types.SavingsSample) int { return a.At.Compare(b.At) })
+	kept.SavingsSamples = samples[max(0, len(samples)-savingsSamples):]
+
+	if variant.Status != types.CouponPending && kept.Status == types.CouponPending {
+		kept.Status = types.CouponLive
+	}
+	return kept
+}
+
+// mergeDetails adds what a variant says about the coupon to the kept one. Lists only
+// widen, none is everywhere or the whole shop. Only a later expiry replaces one, and
+// the variant only fills in fields the kept coupon lacks. Restrictions the kept coupon
+// doesn't have, a minimum order or first orders only, aren't taken on. Only coupons
+// nobody is served yet get this, live ones get it once votes promote the variant.
+func mergeDetails(kept, variant CouponEntry) CouponEntry {
+	// A missing expires_at is usually unknown rather than never, so only a later date extends it
+	if !kept.ExpiresAt.IsZero() && variant.ExpiresAt.After(kept.ExpiresAt) {
+		kept.ExpiresAt = variant.ExpiresAt
+	}
+	kept.Regions = widen(kept.Regions, variant.Regions)
+	kept.Categories = widen(kept.Categories, variant.Categories)
+	if kept.DiscountType == "" {
+		kept.DiscountType, kept.DiscountAmount = variant.DiscountType, variant.DiscountAmount
+	}
+	kept.Currency = cmp.Or(kept.Currency, variant.Currency)
+	kept.Locale = cmp.Or(kept.Locale, variant.Locale)
+	kept.SourceURL = cmp.Or(kept.SourceURL, variant.SourceURL)
+	kept.FreeShipping = kept.FreeShipping || variant.FreeShipping
+
+	if len(variant.Extra) > 0 {
+		extra := maps.Clone(kept.Extra)
+		if extra == nil {
+			extra = map[string]any{}
+		}
+		for field, value := range variant.Extra {
+			if _, ok := extra[field]; !ok && field != "_id" {
+				extra[field] = value
+			}
+		}
+		kept.Extra = extra
+	}
+	return kept
+}
+
+// changesDetails reports whether mergeDetails would change the kept coupon
+func changesDetails(kept, variant CouponEntry) bool {
+	merged := mergeDetails(kept, variant)
+	return !merged.ExpiresAt.Equal(kept.ExpiresAt) ||
+		!slices.Equal(merged.Regions, kept.Regions) ||
+		!slices.Equal(merged.Categories, kept.Categories) ||
+		merged.DiscountType != kept.DiscountType ||
+		merged.DiscountAmount != kept.DiscountAmount ||
+		merged.Currency != kept.Currency ||
+		merged.Locale != kept.Locale ||
+		merged.SourceURL != kept.SourceURL ||
+		merged.FreeShipping != kept.FreeShipping ||
+		len(merged.Extra) != len(kept.Extra)
+}
+
+// reviewVariant is a variant held back as a pending coupon of its own, because its details
+// would change a live coupon. Votes promote it like any pending coupon, and it's folded into
+// the live one then. It has no key, the live coupon holds it.
+func reviewVariant(variant CouponEntry, live string) CouponEntry {
+	variant.Score, variant.RegionScores = 0, nil
+	variant.ReportsApplied, variant.ReportsFailed, variant.SavingsSamples = 0, 0, nil
+	variant.Status = types.CouponPending
+	variant.VariantOf = live
+	variant.CodeKey = ""
+	return variant
+}
+
+// widen joins two lists of places a coupon works in, where none is everywhere
+func widen(a, b []string) []string {
+	if len(a) == 0 || len(b) == 0 {
+		return nil
+	}
+	return union(a, b)
+}
+
+func union(a, b []string) []string {
+	result := slices.Clone(a)
+	for _, value := range b {
+		if !slices.Contains(result, value) {
+			result = append(result, value)
+		}
+	}
+	return result
+}
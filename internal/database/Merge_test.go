@@ -0,0 +1,136 @@
+package database
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/MisterNorwood/SugarCube-Server/pkg/types"
+)
+
+func TestMergeVotes(t *testing.T) {
+	day := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	kept := CouponEntry{
+		Coupon: "ABC", Score: 3, Status: types.CouponLive, Regions: []string{"DE"},
+		RegionScores: map[string]float64{"DE": 2}, ReportsApplied: 4, ReportsFailed: 1,
+		SavingsSamples: []types.SavingsSample{{Discount: 5, At: day}},
+	}
+	variant := CouponEntry{
+		Coupon: "abc", Score: -1, Status: types.CouponPending, Regions: []string{"AQ"}, FirstOrderOnly: true,
+		RegionScores: map[string]float64{"DE": -1, "FR": 1}, ReportsApplied: 1, ReportsFailed: 2,
+		SavingsSamples: []types.SavingsSample{{Discount: 7, At: day.Add(-time.Hour)}},
+	}
+
+	got := mergeVotes(kept, variant)
+	if got.Coupon != "ABC" || got.Score != 2 || got.ReportsApplied != 5 || got.ReportsFailed != 3 {
+		t.Fatalf("votes not added up: %+v", got)
+	}
+	if got.RegionScores["DE"] != 1 || got.RegionScores["FR"] != 1 || kept.RegionScores["DE"] != 2 {
+		t.Fatalf("region scores %v, kept's %v", got.RegionScores, kept.RegionScores)
+	}
+	if len(got.SavingsSamples) != 2 || got.SavingsSamples[0].Discount != 7 {
+		t.Fatalf("samples not merged oldest first: %+v", got.SavingsSamples)
+	}
+	if got.Status != types.CouponLive || !slices.Equal(got.Regions, []string{"DE"}) || got.FirstOrderOnly {
+		t.Fatalf("details taken from the variant: %+v", got)
+	}
+
+	if promoted := mergeVotes(CouponEntry{Status: types.CouponPending}, CouponEntry{}); promoted.Status != types.CouponLive {
+		t.Fatalf("a live variant left the kept coupon %q", promoted.Status)
+	}
+}
+
+func TestMergeVotesKeepsLatestSamples(t *testing.T) {
+	var kept, variant CouponEntry
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := range savingsSamples {
+		kept.SavingsSamples = append(kept.SavingsSamples, types.SavingsSample{Discount: 1, At: start.Add(time.Duration(2*i) * time.Minute)})
+		variant.SavingsSamples = append(variant.SavingsSamples, types.SavingsSample{Discount: 2, At: start.Add(time.Duration(2*i+1) * time.Minute)})
+	}
+	got := mergeVotes(kept, variant).SavingsSamples
+	if len(got) != savingsSamples || !got[0].At.Equal(start.Add(time.Duration(savingsSamples)*time.Minute)) {
+		t.Fatalf("kept %d samples from %v", len(got), got[0].At)
+	}
+}
+
+func TestMergeDetails(t *testing.T) {
+	expires := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		kept    CouponEntry
+		variant CouponEntry
+		check   func(t *testing.T, got CouponEntry)
+		changes bool
+	}{
+		{"nothing new", CouponEntry{Regions: []string{"DE"}, Currency: "EUR"}, CouponEntry{Regions: []string{"DE"}}, func(t *testing.T, got CouponEntry) {}, false},
+		{"everywhere stays everywhere", CouponEntry{}, CouponEntry{Regions: []string{"AQ"}, Categories: []string{"shoes"}}, func(t *testing.T, got CouponEntry) {
+			if got.Regions != nil || got.Categories != nil {
+				t.Fatalf("narrowed to %v and %v", got.Regions, got.Categories)
+			}
+		}, false},
+		{"no list widens to everywhere", CouponEntry{Regions: []string{"DE"}}, CouponEntry{}, func(t *testing.T, got CouponEntry) {
+			if got.Regions != nil {
+				t.Fatalf("regions %v", got.Regions)
+			}
+		}, true},
+		{"lists join", CouponEntry{Regions: []string{"DE"}}, CouponEntry{Regions: []string{"AT", "DE"}}, func(t *testing.T, got CouponEntry) {
+			if !slices.Equal(got.Regions, []string{"DE", "AT"}) {
+				t.Fatalf("regions %v", got.Regions)
+			}
+		}, true},
+		{"restrictions not taken on", CouponEntry{Regions: []string{"DE"}}, CouponEntry{Regions: []string{"DE"}, FirstOrderOnly: true, MinOrderValue: 50}, func(t *testing.T, got CouponEntry) {
+			if got.FirstOrderOnly || got.MinOrderValue != 0 {
+				t.Fatalf("got %+v", got)
+			}
+		}, false},
+		{"later expiry", CouponEntry{ExpiresAt: expires}, CouponEntry{ExpiresAt: expires.AddDate(1, 0, 0)}, func(t *testing.T, got CouponEntry) {
+			if !got.ExpiresAt.Equal(expires.AddDate(1, 0, 0)) {
+				t.Fatalf("expires %v", got.ExpiresAt)
+			}
+		}, true},
+		{"earlier expiry", CouponEntry{ExpiresAt: expires}, CouponEntry{ExpiresAt: expires.AddDate(-1, 0, 0)}, func(t *testing.T, got CouponEntry) {
+			if !got.ExpiresAt.Equal(expires) {
+				t.Fatalf("expires %v", got.ExpiresAt)
+			}
+		}, false},
+		{"unknown expiry stays unknown", CouponEntry{}, CouponEntry{ExpiresAt: expires}, func(t *testing.T, got CouponEntry) {
+			if !got.ExpiresAt.IsZero() {
+				t.Fatalf("expires %v", got.ExpiresAt)
+			}
+		}, false},
+		{"missing fields filled", CouponEntry{DiscountType: types.DiscountFixed, DiscountAmount: 5}, CouponEntry{DiscountType: types.DiscountPercent, DiscountAmount: 50, Currency: "EUR", FreeShipping: true, Extra: map[string]any{"note": "x", "_id": 1}}, func(t *testing.T, got CouponEntry) {
+			if got.DiscountType != types.DiscountFixed || got.DiscountAmount != 5 || got.Currency != "EUR" || !got.FreeShipping {
+				t.Fatalf("got %+v", got)
+			}
+			if _, ok := got.Extra["_id"]; ok || got.Extra["note"] != "x" {
+				t.Fatalf("extra %v", got.Extra)
+			}
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.check(t, mergeDetails(tt.kept, tt.variant))
+			if got := changesDetails(tt.kept, tt.variant); got != tt.changes {
+				t.Fatalf("changesDetails is %v, want %v", got, tt.changes)
+			}
+		})
+	}
+}
+
+func TestReviewVariant(t *testing.T) {
+	variant := CouponEntry{
+		Coupon: "abc", Score: 4, Status: types.CouponLive, CodeKey: "ABC", SubmittedBy: "install:1",
+		RegionScores: map[string]float64{"DE": 4}, ReportsApplied: 3, Regions: []string{"AQ"},
+		SavingsSamples: []types.SavingsSample{{Discount: 1}},
+	}
+	got := reviewVariant(variant, "ABC")
+	if got.Status != types.CouponPending || got.VariantOf != "ABC" || got.CodeKey != "" {
+		t.Fatalf("not held back: %+v", got)
+	}
+	if got.Score != 0 || got.RegionScores != nil || got.ReportsApplied != 0 || got.SavingsSamples != nil {
+		t.Fatalf("votes kept, they went to the live coupon: %+v", got)
+	}
+	if got.Coupon != "abc" || got.SubmittedBy != "install:1" || !slices.Equal(got.Regions, []string{"AQ"}) {
+		t.Fatalf("submission lost: %+v", got)
+	}
+}
@@ -0,0 +1,112 @@
+package database
+
+import (
+	"cmp"
+	"maps"
+	"slices"
+
+	"github.com/MisterNorwood/SugarCube-Server/pkg/types"
+)
+
+// Coupons keep the latest this many reported savings, the median is taken over them
+const savingsSamples = 50
+
+// RankCoupons fills in the savings of the coupons in currency and sorts them by expected
+// value, ties by score, so clients try the best code first. Amounts in other currencies
+// are left out rather than compared. Without a currency the one most amounts are in is used.
+func RankCoupons(coupons []CouponEntry, cartTotal float64, currency string) {
+	if currency == "" {
+		currency = savingsCurrency(coupons)
+	}
+	for i := range coupons {
+		coupons[i].MedianSavings, _ = medianSavings(coupons[i], 0, currency)
+		coupons[i].ExpectedValue = ExpectedValue(coupons[i], cartTotal, currency)
+		coupons[i].SavingsCurrency = currency
+	}
+	slices.SortStableFunc(coupons, func(a, b CouponEntry) int {
+		return cmp.Or(cmp.Compare(b.ExpectedValue, a.ExpectedValue), cmp.Compare(b.Score, a.Score))
+	})
+}
+
+// ExpectedValue is what trying the coupon saves on average in currency: the median reported
+// savings, else what its discount promises, times the share of callbacks it applied in. With
+// a cart total percent coupons are valued on that cart, without one they're worth their
+// median only.
+func ExpectedValue(entry CouponEntry, cartTotal float64, currency string) float64 {
+	savings, ok := medianSavings(entry, cartTotal, currency)
+	if !ok {
+		savings = promisedSavings(entry, cartTotal, currency)
+	}
+	// Laplace smoothed, a coupon nobody reported on counts as a coin flip
+	applied := float64(entry.ReportsApplied+1) / float64(entry.ReportsApplied+entry.ReportsFailed+2)
+	return applied * savings
+}
+
+// sampleCurrency is the currency of a reported amount, the coupon's if the report named none
+func sampleCurrency(entry CouponEntry, sample types.SavingsSample) string {
+	return cmp.Or(sample.Currency, entry.Currency)
+}
+
+// savingsCurrency is the currency most of the coupons' amounts are in, empty if none names one.
+// Ties go to the first code alphabetically, so the same list always ranks the same.
+func savingsCurrency(coupons []CouponEntry) string {
+	counts := map[string]int{}
+	for _, entry := range coupons {
+		if entry.Currency != "" {
+			counts[entry.Currency]++
+		}
+		for _, sample := range entry.SavingsSamples {
+			if currency := sampleCurrency(entry, sample); currency != "" {
+				counts[currency]++
+			}
+		}
+	}
+	best := ""
+	for _, currency := range slices.Sorted(maps.Keys(counts)) {
+		if counts[currency] > counts[best] {
+			best = currency
+		}
+	}
+	return best
+}
+
+// medianSavings is the median of the amounts reported in currency, amounts of unknown
+// currency only count when currency is unknown too
+func medianSavings(entry CouponEntry, cartTotal float64, currency string) (float64, bool) {
+	// Scaled to the cart, 10% off saved more on the carts it was reported from. The
+	// share saved is the same in every currency, so all samples count then.
+	scaled := cartTotal > 0 && entry.DiscountType == types.DiscountPercent
+	values := make([]float64, 0, len(entry.SavingsSamples))
+	for _, sample := range entry.SavingsSamples {
+		switch {
+		case scaled && sample.CartTotal > 0:
+			values = append(values, sample.Discount/sample.CartTotal*cartTotal)
+		case !scaled && sampleCurrency(entry, sample) == currency:
+			values = append(values, sample.Discount)
+		}
+	}
+	if len(values) == 0 {
+		return 0, false
+	}
+	slices.Sort(values)
+	mid := len(values) / 2
+	if len(values)%2 == 1 {
+		return values[mid], true
+	}
+	return (values[mid-1] + values[mid]) / 2, true
+}
+
+// promisedSavings is the coupon's discount in currency. A fixed amount in another
+// currency is worth nothing here, one without a currency is taken as is.
+func promisedSavings(entry CouponEntry, cartTotal float64, currency string) float64 {
+	switch entry.DiscountType {
+	case types.DiscountFixed:
+		if entry.Currency != "" && entry.Currency != currency {
+			return 0
+		}
+		return entry.DiscountAmount
+	case types.DiscountPercent:
+		return entry.DiscountAmount / 100 * cartTotal
+	}
+	return 0
+}
@@ -0,0 +1,131 @@
+package database
+
+import (
+	"math"
+	"slices"
+	"testing"
+
+	"github.com/MisterNorwood/SugarCube-Server/pkg/types"
+)
+
+func samples(currency string, discounts ...float64) []types.SavingsSample {
+	result := make([]types.SavingsSample, 0, len(discounts))
+	for _, discount := range discounts {
+		result = append(result, types.SavingsSample{Discount: discount, CartTotal: discount * 10, Currency: currency})
+	}
+	return result
+}
+
+func TestMedianSavings(t *testing.T) {
+	mixed := append(samples("EUR", 10, 20, 30), samples("JPY", 1000, 2000)...)
+	tests := []struct {
+		name      string
+		entry     CouponEntry
+		cartTotal float64
+		currency  string
+		want      float64
+		ok        bool
+	}{
+		{"no samples", CouponEntry{}, 0, "EUR", 0, false},
+		{"odd count", CouponEntry{SavingsSamples: samples("EUR", 30, 10, 20)}, 0, "EUR", 20, true},
+		{"even count", CouponEntry{SavingsSamples: samples("EUR", 10, 20, 30, 40)}, 0, "EUR", 25, true},
+		{"other currencies left out", CouponEntry{SavingsSamples: mixed}, 0, "EUR", 20, true},
+		{"only the requested currency", CouponEntry{SavingsSamples: mixed}, 0, "JPY", 1500, true},
+		{"no samples in currency", CouponEntry{SavingsSamples: mixed}, 0, "USD", 0, false},
+		{"coupon currency fills in", CouponEntry{Currency: "EUR", SavingsSamples: samples("", 5, 7)}, 0, "EUR", 6, true},
+		{"unknown currency", CouponEntry{SavingsSamples: samples("", 5, 7)}, 0, "", 6, true},
+		{"unknown left out of a known currency", CouponEntry{SavingsSamples: samples("", 5, 7)}, 0, "EUR", 0, false},
+		// Every sample saved 10%, whatever the currency
+		{"percent scaled to cart", CouponEntry{DiscountType: types.DiscountPercent, SavingsSamples: mixed}, 50, "EUR", 5, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := medianSavings(tt.entry, tt.cartTotal, tt.currency)
+			if ok != tt.ok || math.Abs(got-tt.want) > 1e-9 {
+				t.Fatalf("got %v, %v, want %v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestExpectedValue(t *testing.T) {
+	tests := []struct {
+		name      string
+		entry     CouponEntry
+		cartTotal float64
+		currency  string
+		want      float64
+	}{
+		{"nothing known", CouponEntry{}, 0, "EUR", 0},
+		{"promised fixed", CouponEntry{DiscountType: types.DiscountFixed, DiscountAmount: 10, Currency: "EUR"}, 0, "EUR", 5},
+		{"promised fixed in another currency", CouponEntry{DiscountType: types.DiscountFixed, DiscountAmount: 1000, Currency: "JPY"}, 0, "EUR", 0},
+		{"promised fixed without currency", CouponEntry{DiscountType: types.DiscountFixed, DiscountAmount: 10}, 0, "EUR", 5},
+		{"promised percent without cart", CouponEntry{DiscountType: types.DiscountPercent, DiscountAmount: 10}, 0, "EUR", 0},
+		{"promised percent on cart", CouponEntry{DiscountType: types.DiscountPercent, DiscountAmount: 10}, 80, "EUR", 4},
+		{"reported beats promised", CouponEntry{DiscountType: types.DiscountFixed, DiscountAmount: 50, ReportsApplied: 2, SavingsSamples: samples("EUR", 8, 8)}, 0, "EUR", 6},
+		{"failures weigh in", CouponEntry{ReportsApplied: 1, ReportsFailed: 2, SavingsSamples: samples("EUR", 12)}, 0, "EUR", 4.8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ExpectedValue(tt.entry, tt.cartTotal, tt.currency); math.Abs(got-tt.want) > 1e-9 {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRankCoupons(t *testing.T) {
+	site := func() []CouponEntry {
+		return []CouponEntry{
+			{Coupon: "YEN", Score: 1, ReportsApplied: 3, SavingsSamples: samples("JPY", 1000, 1000, 1000)},
+			{Coupon: "EURO", Score: 1, ReportsApplied: 2, SavingsSamples: samples("EUR", 20, 20)},
+			{Coupon: "EURO5", Score: 2, ReportsApplied: 1, SavingsSamples: samples("EUR", 5)},
+			{Coupon: "FIXED", Score: 3, DiscountType: types.DiscountFixed, DiscountAmount: 10, Currency: "EUR"},
+		}
+	}
+	tests := []struct {
+		name     string
+		currency string
+		want     []string
+		savings  string
+	}{
+		// EUR has five amounts to JPY's three, so the yen coupon isn't compared
+		{"site currency", "", []string{"EURO", "FIXED", "EURO5", "YEN"}, "EUR"},
+		{"requested currency", "EUR", []string{"EURO", "FIXED", "EURO5", "YEN"}, "EUR"},
+		{"other currency", "JPY", []string{"YEN", "FIXED", "EURO5", "EURO"}, "JPY"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			coupons := site()
+			RankCoupons(coupons, 0, tt.currency)
+			var got []string
+			for _, coupon := range coupons {
+				got = append(got, coupon.Coupon)
+				if coupon.SavingsCurrency != tt.savings {
+					t.Fatalf("%s ranked in %q, want %q", coupon.Coupon, coupon.SavingsCurrency, tt.savings)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSavingsCurrency(t *testing.T) {
+	tests := []struct {
+		name    string
+		coupons []CouponEntry
+		want    string
+	}{
+		{"nothing", []CouponEntry{{}}, ""},
+		{"unknown samples", []CouponEntry{{SavingsSamples: samples("", 1, 2)}}, ""},
+		{"majority", []CouponEntry{{SavingsSamples: samples("JPY", 1)}, {Currency: "EUR", SavingsSamples: samples("", 1)}}, "EUR"},
+		{"tie goes alphabetically", []CouponEntry{{SavingsSamples: samples("USD", 1)}, {SavingsSamples: samples("EUR", 1)}}, "EUR"},
+	}
+	for _, tt := range tests {
+		if got := savingsCurrency(tt.coupons); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
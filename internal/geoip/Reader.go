@@ -0,0 +1,293 @@
+// Package geoip looks up the country of an IP in a local MaxMind DB file, such as
+// GeoLite2-Country or DB-IP's country database. Only what the country lookup needs
+// of the format is implemented, see https://maxmind.github.io/MaxMind-DB/
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strings"
+)
+
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+var errCorrupt = errors.New("geoip: corrupt database")
+
+// Reader is safe for concurrent use, the file is read into memory once
+type Reader struct {
+	buf        []byte
+	nodeCount  uint64
+	recordSize uint64
+	ipVersion  uint64
+	dataStart  uint64
+	ipv4Start  uint64 // Node the IPv4 subtree of an IPv6 database starts at
+}
+
+func Open(path string) (*Reader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	marker := bytes.LastIndex(buf, metadataMarker)
+	if marker < 0 {
+		// Metadata is at the end, so a download cut short has none either
+		return nil, fmt.Errorf("%w: %s has no metadata, it's cut short or not a MaxMind DB file", errCorrupt, path)
+	}
+
+	r := &Reader{buf: buf}
+	d := decoder{buf: buf[marker+len(metadataMarker):]}
+	value, _, err := d.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("geoip: reading metadata: %w", err)
+	}
+	metadata, ok := value.(map[string]any)
+	if !ok {
+		return nil, errCorrupt
+	}
+	r.nodeCount, _ = metadata["node_count"].(uint64)
+	r.recordSize, _ = metadata["record_size"].(uint64)
+	r.ipVersion, _ = metadata["ip_version"].(uint64)
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("geoip: unsupported record size %d", r.recordSize)
+	}
+	treeSize := r.recordSize * 2 / 8 * r.nodeCount
+	r.dataStart = treeSize + 16 // The tree and the data are separated by 16 zero bytes
+	if r.dataStart > uint64(marker) {
+		return nil, errCorrupt
+	}
+
+	if r.ipVersion == 6 {
+		node := uint64(0)
+		for i := 0; i < 96 && node < r.nodeCount; i++ {
+			if node, err = r.record(node, 0); err != nil {
+				return nil, err
+			}
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+// Country returns the ISO 3166-1 alpha-2 code of the country the IP is in,
+// or the country it's registered to if the database doesn't know better
+func (r *Reader) Country(ip net.IP) (string, bool) {
+	bits, node := ip.To4(), uint64(0)
+	switch {
+	case bits != nil && r.ipVersion == 6:
+		node = r.ipv4Start
+	case bits == nil && r.ipVersion == 4:
+		return "", false
+	case bits == nil:
+		bits = ip.To16()
+	}
+	if bits == nil {
+		return "", false
+	}
+
+	for i := 0; i < len(bits)*8 && node < r.nodeCount; i++ {
+		bit := uint64(bits[i/8]>>(7-i%8)) & 1
+		var err error
+		if node, err = r.record(node, bit); err != nil {
+			return "", false
+		}
+	}
+	if node <= r.nodeCount {
+		return "", false // Equal is the "not found" record
+	}
+
+	d := decoder{buf: r.buf[r.dataStart:]}
+	value, _, err := d.decode(node-r.nodeCount-16, 0)
+	if err != nil {
+		return "", false
+	}
+	record, _ := value.(map[string]any)
+	for _, key := range []string{"country", "registered_country"} {
+		country, _ := record[key].(map[string]any)
+		if code, ok := country["iso_code"].(string); ok && code != "" {
+			return strings.ToUpper(code), true
+		}
+	}
+	return "", false
+}
+
+// record returns the left (bit 0) or right (bit 1) record of a node
+func (r *Reader) record(node, bit uint64) (uint64, error) {
+	size := r.recordSize * 2 / 8
+	offset := node * size
+	if offset+size > uint64(len(r.buf)) {
+		return 0, errCorrupt
+	}
+	b := r.buf[offset : offset+size]
+	switch r.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2]), nil
+	case 28:
+		if bit == 0 {
+			return uint64(b[3]&0xf0)<<20 | uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2]), nil
+		}
+		return uint64(b[3]&0x0f)<<24 | uint64(b[4])<<16 | uint64(b[5])<<8 | uint64(b[6]), nil
+	default:
+		return uint64(binary.BigEndian.Uint32(b[bit*4:])), nil
+	}
+}
+
+// Data section field types
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// Nested deeper than this is a pointer loop in a corrupt file
+const maxDepth = 32
+
+type decoder struct {
+	buf []byte
+}
+
+// decode reads the value at offset and returns it with the offset after it.
+// Unsigned integers come back as uint64, maps as map[string]any.
+func (d decoder) decode(offset uint64, depth int) (any, uint64, error) {
+	if depth > maxDepth || offset >= uint64(len(d.buf)) {
+		return nil, 0, errCorrupt
+	}
+	ctrl := d.buf[offset]
+	offset++
+	kind := int(ctrl >> 5)
+	if kind == typePointer {
+		target, next, err := d.pointer(ctrl, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err := d.decode(target, depth+1)
+		return value, next, err
+	}
+	if kind == typeExtended {
+		if offset >= uint64(len(d.buf)) {
+			return nil, 0, errCorrupt
+		}
+		kind = 7 + int(d.buf[offset])
+		offset++
+	}
+
+	size := uint64(ctrl & 0x1f)
+	if size >= 29 {
+		extra := size - 28
+		if offset+extra > uint64(len(d.buf)) {
+			return nil, 0, errCorrupt
+		}
+		n := uint64(0)
+		for _, b := range d.buf[offset : offset+extra] {
+			n = n<<8 | uint64(b)
+		}
+		offset += extra
+		size = [...]uint64{29, 285, 65821}[extra-1] + n
+	}
+
+	// Every entry takes a byte at least, so a bigger size is corrupt and not worth allocating for
+	if (kind == typeMap || kind == typeArray) && size > uint64(len(d.buf))-offset {
+		return nil, 0, errCorrupt
+	}
+
+	switch kind {
+	case typeMap:
+		m := make(map[string]any, size)
+		for range size {
+			key, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			value, after, err := d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			k, _ := key.(string)
+			m[k] = value
+			offset = after
+		}
+		return m, offset, nil
+	case typeArray:
+		a := make([]any, 0, size)
+		for range size {
+			value, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+			offset = next
+		}
+		return a, offset, nil
+	case typeBool:
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint64(len(d.buf)) {
+		return nil, 0, errCorrupt
+	}
+	raw := d.buf[offset : offset+size]
+	offset += size
+	switch kind {
+	case typeString:
+		return string(raw), offset, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errCorrupt
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(raw)), offset, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errCorrupt
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(raw)), offset, nil
+	case typeUint16, typeUint32, typeUint64, typeInt32:
+		n := uint64(0)
+		for _, b := range raw {
+			n = n<<8 | uint64(b)
+		}
+		return n, offset, nil
+	case typeBytes, typeUint128:
+		return raw, offset, nil
+	}
+	return nil, 0, fmt.Errorf("geoip: unsupported field type %d", kind)
+}
+
+// pointer returns the offset a pointer points to and the offset after the pointer
+func (d decoder) pointer(ctrl byte, offset uint64) (uint64, uint64, error) {
+	size := uint64(ctrl>>3&0x3) + 1
+	if offset+size > uint64(len(d.buf)) {
+		return 0, 0, errCorrupt
+	}
+	b := d.buf[offset : offset+size]
+	low := uint64(ctrl & 0x7)
+	var target uint64
+	switch size {
+	case 1:
+		target = low<<8 | uint64(b[0])
+	case 2:
+		target = (low<<16 | uint64(b[0])<<8 | uint64(b[1])) + 2048
+	case 3:
+		target = (low<<24 | uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])) + 526336
+	default:
+		target = uint64(binary.BigEndian.Uint32(b))
+	}
+	return target, offset + size, nil
+}
@@ -0,0 +1,266 @@
+package geoip
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Data section encoding, only what the tests need: short strings and maps, uints and 1 byte pointers
+
+func str(s string) []byte {
+	return append([]byte{typeString<<5 | byte(len(s))}, s...)
+}
+
+func uintOf(kind byte, n uint64) []byte {
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{kind<<5 | byte(len(b))}, b...)
+}
+
+func mapOf(pairs ...[]byte) []byte {
+	b := []byte{typeMap<<5 | byte(len(pairs)/2)}
+	for _, p := range pairs {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func pointer(offset uint64) []byte {
+	return []byte{typePointer<<5 | byte(offset>>8), byte(offset)}
+}
+
+func metadata(nodeCount, recordSize, ipVersion uint64) []byte {
+	return mapOf(
+		str("node_count"), uintOf(typeUint32, nodeCount),
+		str("record_size"), uintOf(typeUint16, recordSize),
+		str("ip_version"), uintOf(typeUint16, ipVersion),
+	)
+}
+
+// tree encodes the left and right record of each node
+func tree(recordSize int, nodes [][2]uint64) []byte {
+	var b []byte
+	for _, n := range nodes {
+		l, r := n[0], n[1]
+		switch recordSize {
+		case 24:
+			b = append(b, byte(l>>16), byte(l>>8), byte(l), byte(r>>16), byte(r>>8), byte(r))
+		case 28:
+			b = append(b, byte(l>>16), byte(l>>8), byte(l), byte(l>>24)<<4|byte(r>>24)&0x0f, byte(r>>16), byte(r>>8), byte(r))
+		case 32:
+			b = append(b, byte(l>>24), byte(l>>16), byte(l>>8), byte(l), byte(r>>24), byte(r>>16), byte(r>>8), byte(r))
+		}
+	}
+	return b
+}
+
+func file(tree, data, meta []byte) []byte {
+	b := append(append([]byte{}, tree...), make([]byte, 16)...)
+	b = append(b, data...)
+	b = append(b, metadataMarker...)
+	return append(b, meta...)
+}
+
+type network struct {
+	cidr  string
+	value []byte // Data section value, at the offset the values before it end at
+}
+
+// build writes a database with the networks in a tree of the record size and IP version.
+// An IPv4 database leaves the IPv6 networks out.
+func build(t *testing.T, recordSize int, ipVersion uint64, networks []network) []byte {
+	t.Helper()
+	// Records are 0 for empty, a node index, or -(data offset + 1)
+	nodes := [][2]int64{{0, 0}}
+	var data []byte
+	for _, n := range networks {
+		ip, ipNet, err := net.ParseCIDR(n.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, _ := ipNet.Mask.Size()
+		bits := ip.To16()
+		switch {
+		case ip.To4() == nil && ipVersion == 4:
+			continue
+		case ip.To4() != nil && ipVersion == 4:
+			bits = ip.To4()
+		case ip.To4() != nil:
+			// IPv4 is the ::/96 subtree of an IPv6 database
+			bits = append(make([]byte, 12), ip.To4()...)
+			ones += 96
+		}
+
+		node := 0
+		for i := range ones {
+			bit := bits[i/8] >> (7 - i%8) & 1
+			if i == ones-1 {
+				nodes[node][bit] = -int64(len(data) + 1)
+				break
+			}
+			if nodes[node][bit] <= 0 {
+				nodes = append(nodes, [2]int64{})
+				nodes[node][bit] = int64(len(nodes) - 1)
+			}
+			node = int(nodes[node][bit])
+		}
+		data = append(data, n.value...)
+	}
+
+	count := uint64(len(nodes))
+	records := make([][2]uint64, len(nodes))
+	for i, n := range nodes {
+		for bit, v := range n {
+			switch {
+			case v == 0:
+				records[i][bit] = count
+			case v > 0:
+				records[i][bit] = uint64(v)
+			default:
+				records[i][bit] = count + 16 + uint64(-v-1)
+			}
+		}
+	}
+	return file(tree(recordSize, records), data, metadata(count, uint64(recordSize), ipVersion))
+}
+
+func open(t *testing.T, b []byte) (*Reader, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return Open(path)
+}
+
+func testNetworks() []network {
+	country := mapOf(str("iso_code"), str("de"))
+	return []network{
+		{"1.2.3.0/24", mapOf(str("country"), country)},
+		// Points at the country map of the first value, after its map byte and key
+		{"9.9.9.0/24", mapOf(str("country"), pointer(uint64(1+len(str("country")))))},
+		{"2001:db8::/32", mapOf(str("registered_country"), mapOf(str("iso_code"), str("FR")))},
+		{"5.6.0.0/16", mapOf(str("city"), str("Nowhere"))},
+	}
+}
+
+func TestCountry(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string // Empty is not found
+	}{
+		{"1.2.3.4", "DE"},
+		{"1.2.3.255", "DE"},
+		{"::ffff:1.2.3.4", "DE"},
+		{"9.9.9.9", "DE"},
+		{"2001:db8::1", "FR"},
+		{"2001:db8:ffff::1", "FR"},
+		{"1.2.4.1", ""},
+		{"5.6.7.8", ""}, // A record without a country
+		{"2001:db9::1", ""},
+		{"::1", ""},
+	}
+	for _, ipVersion := range []uint64{4, 6} {
+		for _, recordSize := range []int{24, 28, 32} {
+			r, err := open(t, build(t, recordSize, ipVersion, testNetworks()))
+			if err != nil {
+				t.Fatalf("IPv%d, %d bit records: %v", ipVersion, recordSize, err)
+			}
+			for _, tt := range tests {
+				want := tt.want
+				if ipVersion == 4 && net.ParseIP(tt.ip).To4() == nil {
+					want = "" // Not in an IPv4 database
+				}
+				got, ok := r.Country(net.ParseIP(tt.ip))
+				if got != want || ok != (want != "") {
+					t.Errorf("IPv%d, %d bit records: Country(%s) = %q, %v, want %q", ipVersion, recordSize, tt.ip, got, ok, want)
+				}
+			}
+		}
+	}
+}
+
+func TestOpenCorrupt(t *testing.T) {
+	count := uint64(2)
+	good := tree(24, [][2]uint64{{1, count}, {count, count + 16}})
+	data := mapOf(str("country"), mapOf(str("iso_code"), str("DE")))
+	tests := []struct {
+		name string
+		file []byte
+	}{
+		{"empty", nil},
+		{"no metadata", file(good, data, nil)[:len(good)+16+len(data)]},
+		{"metadata cut short", file(good, data, metadata(count, 24, 6)[:20])},
+		{"tree past the metadata", file(good, data, metadata(1000, 24, 6))},
+		{"metadata pointer loop", file(good, data, pointer(0))},
+		{"metadata not a map", file(good, data, str("node_count"))},
+		{"map bigger than the file", file(good, data, []byte{typeMap<<5 | 31, 0xff, 0xff, 0xff})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := open(t, tt.file); !errors.Is(err, errCorrupt) {
+				t.Fatalf("got %v, want errCorrupt", err)
+			}
+		})
+	}
+
+	if _, err := open(t, file(good, data, metadata(count, 16, 6))); err == nil || errors.Is(err, errCorrupt) {
+		t.Fatalf("got %v for 16 bit records, want unsupported", err)
+	}
+}
+
+// Every prefix of a database is rejected as corrupt
+func TestOpenTruncated(t *testing.T) {
+	b := build(t, 28, 6, testNetworks())
+	for n := range len(b) {
+		if _, err := open(t, b[:n]); !errors.Is(err, errCorrupt) {
+			t.Fatalf("cut at %d of %d: got %v, want errCorrupt", n, len(b), err)
+		}
+	}
+	if _, err := open(t, b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Records that point at bad data or loop are not found, without a panic
+func TestCountryCorrupt(t *testing.T) {
+	count := uint64(1)
+	tests := []struct {
+		name    string
+		records [2]uint64
+		data    []byte
+	}{
+		{"pointer loop", [2]uint64{count + 16, count + 16}, pointer(0)},
+		{"pointer past the data", [2]uint64{count + 16, count + 16}, pointer(2000)},
+		{"record past the data", [2]uint64{count + 16 + 5000, count + 16 + 5000}, mapOf()},
+		{"record into the separator", [2]uint64{count + 3, count + 3}, mapOf()},
+		{"map cut short", [2]uint64{count + 16, count + 16}, mapOf(str("country"))},
+		{"tree loop", [2]uint64{0, 0}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := open(t, file(tree(24, [][2]uint64{tt.records}), tt.data, metadata(count, 24, 6)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, ip := range []string{"1.2.3.4", "2001:db8::1"} {
+				if got, ok := r.Country(net.ParseIP(ip)); ok {
+					t.Fatalf("Country(%s) = %q", ip, got)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodePointerLoop(t *testing.T) {
+	// Two pointers at each other
+	d := decoder{buf: append(pointer(2), pointer(0)...)}
+	if _, _, err := d.decode(0, 0); !errors.Is(err, errCorrupt) {
+		t.Fatalf("got %v, want errCorrupt", err)
+	}
+}
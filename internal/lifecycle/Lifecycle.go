@@ -0,0 +1,135 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Component is anything with background work that has to be started and drained.
+// Stop must return once the component is idle or ctx is done, whichever comes first.
+type Component interface {
+	Start(ctx context.Context) error
+	Stop(ctx context.Context) error
+}
+
+// Hooks turns a pair of functions into a Component, either may be nil
+type Hooks struct {
+	OnStart func(ctx context.Context) error
+	OnStop  func(ctx context.Context) error
+}
+
+func (h Hooks) Start(ctx context.Context) error {
+	if h.OnStart == nil {
+		return nil
+	}
+	return h.OnStart(ctx)
+}
+
+func (h Hooks) Stop(ctx context.Context) error {
+	if h.OnStop == nil {
+		return nil
+	}
+	return h.OnStop(ctx)
+}
+
+type entry struct {
+	name      string
+	component Component
+}
+
+// Manager starts components in the order they were registered and stops them in reverse.
+// Register dependencies first: the database before the jobs using it, the HTTP server last,
+// so shutdown stops accepting requests, drains them, stops jobs, flushes queues and then closes the DB.
+type Manager struct {
+	mu       sync.Mutex
+	entries  []entry
+	started  []entry
+	stopped  bool
+	failures chan error
+
+	// Closed when Stop is called, aborts a Start still in progress
+	stopping chan struct{}
+	stopOnce sync.Once
+}
+
+func New() *Manager {
+	return &Manager{
+		failures: make(chan error, 1),
+		stopping: make(chan struct{}),
+	}
+}
+
+func (m *Manager) Register(name string, c Component) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = append(m.entries, entry{name: name, component: c})
+}
+
+// Start starts every registered component that isn't running yet and stops at the first error.
+// Components started before the error stay running until Stop.
+func (m *Manager) Start(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stopped {
+		return errors.New("lifecycle: already stopped")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-m.stopping:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for _, e := range m.entries[len(m.started):] {
+		if err := e.component.Start(ctx); err != nil {
+			return fmt.Errorf("starting %s: %w", e.name, err)
+		}
+		m.started = append(m.started, e)
+		log.Debug().Str("component", e.name).Msg("Started")
+	}
+	return nil
+}
+
+// Stop stops the started components in reverse order. Every component gets a chance to stop
+// even if an earlier one fails or ctx runs out, the errors are joined.
+func (m *Manager) Stop(ctx context.Context) error {
+	m.stopOnce.Do(func() { close(m.stopping) })
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stopped = true
+
+	var errs []error
+	for i := len(m.started) - 1; i >= 0; i-- {
+		e := m.started[i]
+		start := time.Now()
+		if err := e.component.Stop(ctx); err != nil {
+			log.Error().Err(err).Str("component", e.name).Msg("Failed to stop cleanly")
+			errs = append(errs, fmt.Errorf("stopping %s: %w", e.name, err))
+			continue
+		}
+		log.Info().Str("component", e.name).Dur("took", time.Since(start)).Msg("Stopped")
+	}
+	m.started = nil
+	return errors.Join(errs...)
+}
+
+// Fail reports an error from a running component that should bring the program down,
+// e.g. the HTTP server dying. Only the first failure is kept.
+func (m *Manager) Fail(err error) {
+	select {
+	case m.failures <- err:
+	default:
+	}
+}
+
+func (m *Manager) Failed() <-chan error {
+	return m.failures
+}
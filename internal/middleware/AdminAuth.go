@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/MisterNorwood/SugarCube-Server/pkg/types"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+const AdminKeyHeader = types.AdminKeyHeader
+
+// AdminAuth guards the admin API. The key is accepted as a bearer token
+// or in X-Admin-Key. With no keys configured the admin API is disabled.
+type AdminAuth struct {
+	keys atomic.Pointer[[]string]
+}
+
+func NewAdminAuth(keys []string) *AdminAuth {
+	auth := &AdminAuth{}
+	auth.SetKeys(keys)
+	return auth
+}
+
+func (auth *AdminAuth) SetKeys(keys []string) {
+	keysCopy := append([]string(nil), keys...)
+	auth.keys.Store(&keysCopy)
+}
+
+func (auth *AdminAuth) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		keys := *auth.keys.Load()
+		if len(keys) == 0 {
+			return echo.NewHTTPError(http.StatusNotFound, "Admin API is disabled")
+		}
+
+		presented := c.Request().Header.Get(AdminKeyHeader)
+		if authHeader := c.Request().Header.Get(echo.HeaderAuthorization); presented == "" && strings.HasPrefix(authHeader, "Bearer ") {
+			presented = strings.TrimPrefix(authHeader, "Bearer ")
+		}
+
+		if presented == "" || !matchesAnyKey(presented, keys) {
+			log.Warn().
+				Ctx(c.Request().Context()).
+				Str("path", c.Request().URL.Path).
+				Msg("Rejected admin request with missing or invalid key")
+			return echo.NewHTTPError(http.StatusUnauthorized, "Invalid admin key")
+		}
+		return next(c)
+	}
+}
+
+// Compares against every key so timing doesn't reveal which one matched
+func matchesAnyKey(presented string, keys []string) bool {
+	match := 0
+	for _, key := range keys {
+		match |= subtle.ConstantTimeCompare([]byte(presented), []byte(key))
+	}
+	return match == 1
+}
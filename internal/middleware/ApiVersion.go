@@ -0,0 +1,137 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/MisterNorwood/SugarCube-Server/internal/utils"
+	"github.com/MisterNorwood/SugarCube-Server/pkg/types"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+var HEADER = types.APIVersionHeader
+var API_VER = types.APIVersion
+
+const apiVersionKey = "api_version"
+
+// APIVersions picks the API version of each request, from the path on /api/<version>
+// routes or from the SC-Api-version header on the unversioned ones, and announces
+// deprecated versions. Outside debug mode the header is required either way, it's how
+// requests from something other than the extension are turned away.
+// The deprecation schedule can be replaced at runtime.
+type APIVersions struct {
+	requireHeader bool
+	policies      atomic.Pointer[map[string]utils.APIVersionPolicy]
+}
+
+func NewAPIVersions(cfg utils.APIConfig, requireHeader bool) *APIVersions {
+	versions := &APIVersions{requireHeader: requireHeader}
+	versions.Update(cfg)
+	return versions
+}
+
+func (v *APIVersions) Update(cfg utils.APIConfig) {
+	policies := make(map[string]utils.APIVersionPolicy, len(cfg.Versions))
+	for version, policy := range cfg.Versions {
+		policies[version] = policy
+	}
+	v.policies.Store(&policies)
+}
+
+// Path serves the /api/<version> group, a header naming another version is a client bug
+func (v *APIVersions) Path(version string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			header := requestedVersion(c)
+			if header == "" && v.requireHeader {
+				return blockVersion(c, header)
+			}
+			if header != "" && header != version {
+				return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%s header says %s but the path is for %s", HEADER, header, version))
+			}
+			return v.serve(c, version, next)
+		}
+	}
+}
+
+// Negotiate serves the unversioned /api group from the header, old builds only send v1
+func (v *APIVersions) Negotiate(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		version := requestedVersion(c)
+		if version == "" && !v.requireHeader {
+			version = API_VER
+		}
+		if !slices.Contains(types.APIVersions, version) {
+			return blockVersion(c, version)
+		}
+		return v.serve(c, version, next)
+	}
+}
+
+func (v *APIVersions) serve(c echo.Context, version string, next echo.HandlerFunc) error {
+	c.Set(apiVersionKey, version)
+	if meta := utils.RequestMetaFrom(c.Request().Context()); meta != nil {
+		meta.APIVersion = version
+	}
+
+	headers := c.Response().Header()
+	headers.Set(types.ServedVersionHeader, version)
+	if policy, ok := (*v.policies.Load())[version]; ok {
+		// RFC 9745 and RFC 8594
+		headers.Set("Deprecation", "@"+strconv.FormatInt(policy.Deprecated.Unix(), 10))
+		if !policy.Sunset.IsZero() {
+			headers.Set("Sunset", policy.Sunset.UTC().Format(http.TimeFormat))
+		}
+		if policy.Link != "" {
+			headers.Add("Link", fmt.Sprintf("<%s>; rel=\"deprecation\"; type=\"text/html\"", policy.Link))
+		}
+	}
+	return next(c)
+}
+
+// requestedVersion is the version the client asked for, the api_version query
+// parameter counts for clients that can't set headers
+func requestedVersion(c echo.Context) string {
+	if version := strings.TrimSpace(c.Request().Header.Get(HEADER)); version != "" {
+		return version
+	}
+	return strings.TrimSpace(c.QueryParam(types.APIVersionQuery))
+}
+
+// APIVersionOf returns the version negotiated for the request, empty outside the API groups
+func APIVersionOf(c echo.Context) string {
+	version, _ := c.Get(apiVersionKey).(string)
+	return version
+}
+
+func blockVersion(c echo.Context, version string) error {
+	log.Warn().
+		Ctx(c.Request().Context()).
+		Str("received_version", version).
+		Strs("supported_versions", types.APIVersions).
+		Str("header_dump", HeaderToString(c.Request().Header)).
+		Str("path", c.Request().URL.Path).
+		Msg("Blocked request due to invalid API version header")
+
+	return echo.ErrForbidden
+}
+
+// Headers worth logging on a blocked request. The rest can carry credentials, install
+// tokens, admin keys and cookies, which the secret redactor doesn't know about.
+var loggedHeaders = []string{"User-Agent", HEADER, "Origin", "Content-Type", "Accept"}
+
+// HeaderToString lists the loggable headers of a request, one per line
+func HeaderToString(header http.Header) string {
+	var b strings.Builder
+	for _, k := range loggedHeaders {
+		for _, val := range header.Values(k) {
+			b.WriteString(fmt.Sprintf("%s: %s\n", http.CanonicalHeaderKey(k), val))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,30 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/MisterNorwood/SugarCube-Server/pkg/types"
+)
+
+func TestHeaderToString(t *testing.T) {
+	header := http.Header{}
+	header.Set("User-Agent", "SugarCube/1.2")
+	header.Set(types.APIVersionHeader, "v9")
+	header.Set(types.InstallTokenHeader, "install-secret")
+	header.Set(types.AdminKeyHeader, "admin-secret")
+	header.Set("Authorization", "Bearer bearer-secret")
+	header.Set("Cookie", "session=cookie-secret")
+	header.Set("Proxy-Authorization", "Basic proxy-secret")
+
+	dump := HeaderToString(header)
+	for _, want := range []string{"User-Agent: SugarCube/1.2", "Sc-Api-Version: v9"} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("dump is missing %q:\n%s", want, dump)
+		}
+	}
+	if strings.Contains(dump, "secret") {
+		t.Fatalf("dump contains a credential:\n%s", dump)
+	}
+}
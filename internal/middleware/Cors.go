@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"net/http"
+	"slices"
+	"sync/atomic"
+
+	"github.com/MisterNorwood/SugarCube-Server/internal/utils"
+	"github.com/MisterNorwood/SugarCube-Server/pkg/types"
+	"github.com/labstack/echo/v4"
+	echomw "github.com/labstack/echo/v4/middleware"
+)
+
+// CORS allows browser calls from the configured origins. Preflights are answered
+// here, before the API version check, since browsers never send custom headers on them.
+// The origin list can be replaced at runtime.
+type CORS struct {
+	origins atomic.Pointer[[]string]
+	handler echo.MiddlewareFunc
+}
+
+func NewCORS(cfg utils.CORSConfig) *CORS {
+	cors := &CORS{}
+	cors.Update(cfg)
+	cors.handler = echomw.CORSWithConfig(echomw.CORSConfig{
+		AllowOriginFunc: cors.allowOrigin,
+		AllowMethods:    []string{http.MethodGet, http.MethodPost, http.MethodDelete, http.MethodOptions},
+		AllowHeaders: []string{
+			echo.HeaderContentType,
+			echo.HeaderAuthorization,
+			HEADER,
+			InstallTokenHeader,
+			"If-None-Match",
+			utils.RequestIDHeader,
+		},
+		ExposeHeaders: []string{utils.RequestIDHeader, types.ServedVersionHeader, "ETag", "Deprecation", "Sunset", "Link"},
+		MaxAge:        int(cfg.MaxAge),
+	})
+	return cors
+}
+
+func (cors *CORS) Update(cfg utils.CORSConfig) {
+	origins := append([]string(nil), cfg.AllowOrigins...)
+	cors.origins.Store(&origins)
+}
+
+func (cors *CORS) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return cors.handler(next)
+}
+
+// Allowed reports whether the origin is on the list
+func (cors *CORS) Allowed(origin string) bool {
+	origins := *cors.origins.Load()
+	return slices.Contains(origins, "*") || slices.Contains(origins, origin)
+}
+
+func (cors *CORS) allowOrigin(origin string) (bool, error) {
+	return cors.Allowed(origin), nil
+}
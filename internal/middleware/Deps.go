@@ -1,7 +0,0 @@
-package middleware
-
-import (
-	"go.mongodb.org/mongo-driver/v2/mongo"
-)
-
-var DBMiddlewareClient *mongo.Client
@@ -19,7 +19,6 @@ func GlobalHeaderMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 		// App metadata
 		headers.Set("X-App-Name", "Sugarcube")
 		headers.Set("X-App-Version", "1.0.0")
-		headers.Set("X-API-Version", "v1")
 
 		return next(c)
 	}
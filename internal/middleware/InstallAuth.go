@@ -0,0 +1,93 @@
+package middleware
+
+import (
+	goctx "context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/MisterNorwood/SugarCube-Server/internal/database"
+	"github.com/MisterNorwood/SugarCube-Server/internal/services"
+	"github.com/MisterNorwood/SugarCube-Server/internal/utils"
+	"github.com/MisterNorwood/SugarCube-Server/pkg/types"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+const InstallTokenHeader = types.InstallTokenHeader
+
+// InstallAuth requires an install token from POST /api/register on writes and callbacks.
+// With the requirement switched off, builds from before registration can still write
+// and a token is only checked when one is sent.
+type InstallAuth struct {
+	installs *services.InstallService
+	required atomic.Bool
+}
+
+func NewInstallAuth(installs *services.InstallService, required bool) *InstallAuth {
+	auth := &InstallAuth{installs: installs}
+	auth.SetRequired(required)
+	return auth
+}
+
+func (auth *InstallAuth) SetRequired(required bool) {
+	auth.required.Store(required)
+}
+
+func (auth *InstallAuth) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		reqCtx := c.Request().Context()
+		token := strings.TrimSpace(c.Request().Header.Get(InstallTokenHeader))
+		if token == "" {
+			if auth.required.Load() {
+				return echo.NewHTTPError(http.StatusUnauthorized, "Install token required, register through /api/register")
+			}
+			return next(c)
+		}
+
+		id, ok := auth.installs.Verify(token)
+		if !ok {
+			log.Warn().
+				Ctx(reqCtx).
+				Str("path", c.Request().URL.Path).
+				Msg("Rejected request with an invalid install token")
+			return echo.NewHTTPError(http.StatusUnauthorized, "Invalid install token")
+		}
+
+		ctx, cancel := goctx.WithTimeout(reqCtx, 30*time.Second)
+		err := auth.installs.Check(ctx, id)
+		cancel()
+		switch {
+		case errors.Is(err, services.ErrInstallRevoked):
+			log.Warn().
+				Ctx(reqCtx).
+				Str("install_id", id).
+				Str("path", c.Request().URL.Path).
+				Msg("Blocked request from a revoked install")
+			return echo.NewHTTPError(http.StatusForbidden, "Install token revoked")
+		case errors.Is(err, services.ErrInstallUnknown):
+			return echo.NewHTTPError(http.StatusUnauthorized, "Unknown install, register again")
+		case err != nil:
+			// Fail closed like the ban check
+			return database.Unavailable(err, "install lookup failed")
+		}
+
+		if meta := utils.RequestMetaFrom(reqCtx); meta != nil {
+			meta.InstallID = id
+		}
+		return next(c)
+	}
+}
+
+// ClientKey identifies the client for rate limiting: the install when it sends
+// a token with a valid signature, otherwise its IP
+func (auth *InstallAuth) ClientKey(c echo.Context) string {
+	if token := c.Request().Header.Get(InstallTokenHeader); token != "" {
+		if id, ok := auth.installs.Verify(strings.TrimSpace(token)); ok {
+			return "install:" + id
+		}
+	}
+	return c.RealIP()
+}
@@ -2,40 +2,69 @@ package middleware
 
 import (
 	goctx "context"
-	"errors"
+	"time"
+
+	"github.com/MisterNorwood/SugarCube-Server/internal/database"
+	"github.com/MisterNorwood/SugarCube-Server/internal/services"
+	"github.com/MisterNorwood/SugarCube-Server/internal/telemetry"
+	"github.com/MisterNorwood/SugarCube-Server/internal/utils"
 	"github.com/labstack/echo/v4"
 	"github.com/rs/zerolog/log"
-	"go.mongodb.org/mongo-driver/v2/bson"
-	"go.mongodb.org/mongo-driver/v2/mongo"
-	"net/http"
-	"time"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func CheckIPBanList(next echo.HandlerFunc) echo.HandlerFunc {
-	db := DBMiddlewareClient.Database("sugarcube_admin")
+// IPBanCheck rejects requests from IPs on the ban list
+type IPBanCheck struct {
+	bans *services.BanService
+}
+
+func NewIPBanCheck(bans *services.BanService) *IPBanCheck {
+	return &IPBanCheck{bans: bans}
+}
+
+func (b *IPBanCheck) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(ctx echo.Context) error {
 		ip := ctx.RealIP()
-		filter := bson.M{"ip": ip}
-		ctxGO, cancel := goctx.WithTimeout(goctx.Background(), 30*time.Second)
-		defer cancel()
+		reqCtx := ctx.Request().Context()
+
+		spanCtx, span := telemetry.Tracer().Start(reqCtx, "middleware.CheckIPBanList")
+		ctxGO, cancel := goctx.WithTimeout(spanCtx, 30*time.Second)
+		banned, found := b.bans.IsBanned(ctxGO, ip)
+		cancel()
+
+		banHit := attribute.Bool(telemetry.AttrBanHit, banned)
+		span.SetAttributes(banHit)
+		trace.SpanFromContext(reqCtx).SetAttributes(banHit)
+		span.End()
 
-		found := db.Collection("ip_bans").FindOne(ctxGO, filter).Err()
-		if found == nil {
+		meta := utils.RequestMetaFrom(reqCtx)
+		if banned {
+			if meta != nil {
+				meta.BanDecision = "blocked"
+			}
 			log.Warn().
-				Str("ip", ctx.RealIP()).
+				Ctx(reqCtx).
 				Str("user_agent", ctx.Request().UserAgent()).
 				Str("path", ctx.Request().URL.Path).
 				Msg("Blocked request due to IP being on a blacklist")
-			return ctx.String(http.StatusForbidden, "Forbidden")
+			return echo.ErrForbidden
 
-		} else if !errors.Is(found, mongo.ErrNoDocuments) {
-			log.Fatal().
-				Str("ip", ctx.RealIP()).
+		} else if found != nil {
+			if meta != nil {
+				meta.BanDecision = "error"
+			}
+			log.Error().
+				Ctx(reqCtx).
 				Str("user_agent", ctx.Request().UserAgent()).
 				Str("path", ctx.Request().URL.Path).
 				Err(found).
 				Msg("Error on checking request against IP list")
-
+			// Fail closed, we can't tell whether this client is banned
+			return database.Unavailable(found, "ban list lookup failed")
+		}
+		if meta != nil {
+			meta.BanDecision = "allowed"
 		}
 
 		return next(ctx)
@@ -3,6 +3,7 @@ package middleware
 import (
 	"time"
 
+	"github.com/MisterNorwood/SugarCube-Server/internal/utils"
 	"github.com/labstack/echo/v4"
 	"github.com/rs/zerolog/log"
 )
@@ -11,12 +12,39 @@ func ZeroLogMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		start := time.Now()
 		err := next(c)
-		log.Info().
-			Str("method", c.Request().Method).
-			Str("url", c.Request().URL.String()).
+		if err != nil {
+			// Let Echo write the error response now so the status and size below are accurate
+			c.Error(err)
+		}
+
+		req := c.Request()
+		event := log.Info().
+			Ctx(req.Context()).
+			Str("method", req.Method).
+			Str("url", utils.RedactURL(req.URL)).
+			Str("route", c.Path()).
+			Str("user_agent", req.UserAgent()).
 			Int("status", c.Response().Status).
-			Dur("duration", time.Since(start)).
-			Msg("Request processed")
-		return err
+			Int64("bytes_in", req.ContentLength).
+			Int64("bytes_out", c.Response().Size).
+			Dur("duration", time.Since(start))
+
+		if meta := utils.RequestMetaFrom(req.Context()); meta != nil {
+			if meta.APIVersion != "" {
+				event.Str("api_version", meta.APIVersion)
+			}
+			if meta.InstallID != "" {
+				event.Str("install_id", meta.InstallID)
+			}
+			if meta.BanDecision != "" {
+				event.Str("ban_decision", meta.BanDecision)
+			}
+			if meta.RateLimitDecision != "" {
+				event.Str("ratelimit_decision", meta.RateLimitDecision)
+			}
+		}
+
+		event.Msg("Request processed")
+		return nil
 	}
 }
@@ -0,0 +1,80 @@
+package middleware
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/MisterNorwood/SugarCube-Server/internal/utils"
+	"github.com/labstack/echo/v4"
+	echomw "github.com/labstack/echo/v4/middleware"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/time/rate"
+)
+
+// RateLimiter is a per client token bucket limiter whose limits can be
+// replaced at runtime. Replacing them starts every client with a full bucket.
+// A client keyed on something other than its IP also spends from the IP's bucket,
+// so registering new installs doesn't buy fresh buckets.
+type RateLimiter struct {
+	state atomic.Pointer[rateLimitState]
+	key   func(echo.Context) string
+}
+
+type rateLimitState struct {
+	enabled bool
+	store   echomw.RateLimiterStore
+}
+
+// key identifies the client, the IP if nil
+func NewRateLimiter(cfg utils.RateLimitConfig, key func(echo.Context) string) *RateLimiter {
+	if key == nil {
+		key = func(c echo.Context) string { return c.RealIP() }
+	}
+	rl := &RateLimiter{key: key}
+	rl.Update(cfg)
+	return rl
+}
+
+func (rl *RateLimiter) Update(cfg utils.RateLimitConfig) {
+	state := &rateLimitState{enabled: cfg.Enabled}
+	if cfg.Enabled {
+		state.store = echomw.NewRateLimiterMemoryStoreWithConfig(echomw.RateLimiterMemoryStoreConfig{
+			Rate:      rate.Limit(cfg.RequestsPerSecond),
+			Burst:     int(cfg.Burst),
+			ExpiresIn: cfg.ExpiresIn,
+		})
+	}
+	rl.state.Store(state)
+}
+
+func (rl *RateLimiter) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		state := rl.state.Load()
+		if !state.enabled {
+			return next(c)
+		}
+
+		ip := c.RealIP()
+		allowed, _ := state.store.Allow(ip)
+		if key := rl.key(c); allowed && key != ip {
+			allowed, _ = state.store.Allow(key)
+		}
+		meta := utils.RequestMetaFrom(c.Request().Context())
+
+		if !allowed {
+			if meta != nil {
+				meta.RateLimitDecision = "limited"
+			}
+			log.Warn().
+				Ctx(c.Request().Context()).
+				Str("path", c.Request().URL.Path).
+				Msg("Rate limited request")
+			return echo.NewHTTPError(http.StatusTooManyRequests, "Too many requests")
+		}
+
+		if meta != nil {
+			meta.RateLimitDecision = "allowed"
+		}
+		return next(c)
+	}
+}
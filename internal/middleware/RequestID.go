@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"github.com/MisterNorwood/SugarCube-Server/internal/utils"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+const maxRequestIDLength = 128
+
+// RequestIDMiddleware propagates the caller's X-Request-ID or generates one,
+// echoes it back on the response and stores it on the request context.
+func RequestIDMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+
+		id := req.Header.Get(utils.RequestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.NewString()
+		}
+		c.Response().Header().Set(utils.RequestIDHeader, id)
+
+		meta := &utils.RequestMeta{
+			ID:        id,
+			ClientIP:  c.RealIP(),
+			UserAgent: req.UserAgent(),
+		}
+		c.SetRequest(req.WithContext(utils.WithRequestMeta(req.Context(), meta)))
+
+		return next(c)
+	}
+}
+
+// Only accept short printable IDs so a client can't inject junk into our logs
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		if r < 0x21 || r > 0x7e {
+			return false
+		}
+	}
+	return true
+}
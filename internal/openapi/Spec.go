@@ -0,0 +1,213 @@
+// Package openapi builds the OpenAPI 3 document from the routes as they are registered,
+// so the served document can't drift from the route table, and validates requests against it.
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/MisterNorwood/SugarCube-Server/pkg/types"
+	"github.com/labstack/echo/v4"
+)
+
+const Version = "3.0.3"
+
+// Operation describes one route. Body and Response are zero values of the Go types
+// that are bound and returned, their schemas are generated from them.
+type Operation struct {
+	Summary     string
+	Description string
+	Tags        []string
+	Query       []Param
+	Body        any
+	Response    any
+	Status      int  // Success status, 200 if unset
+	Admin       bool // Requires an admin API key
+	Install     bool // Requires an install token from /api/register
+	Public      bool // Skips the API version check
+}
+
+type Param struct {
+	Name        string
+	Description string
+	Required    bool
+}
+
+type Document struct {
+	OpenAPI    string                          `json:"openapi"`
+	Info       Info                            `json:"info"`
+	Paths      map[string]map[string]*opObject `json:"paths"`
+	Components components                      `json:"components"`
+}
+
+type Info struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+type components struct {
+	Schemas         map[string]*Schema        `json:"schemas"`
+	SecuritySchemes map[string]securityScheme `json:"securitySchemes"`
+}
+
+type securityScheme struct {
+	Type string `json:"type"`
+	In   string `json:"in"`
+	Name string `json:"name"`
+}
+
+type opObject struct {
+	Summary     string                 `json:"summary,omitempty"`
+	Description string                 `json:"description,omitempty"`
+	Tags        []string               `json:"tags,omitempty"`
+	Parameters  []paramObject          `json:"parameters,omitempty"`
+	RequestBody *bodyObject            `json:"requestBody,omitempty"`
+	Responses   map[string]*bodyObject `json:"responses"`
+	Security    []map[string][]string  `json:"security,omitempty"`
+}
+
+type paramObject struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required"`
+	Schema      *Schema `json:"schema"`
+}
+
+type bodyObject struct {
+	Description string               `json:"description,omitempty"`
+	Required    bool                 `json:"required,omitempty"`
+	Content     map[string]mediaType `json:"content,omitempty"`
+}
+
+type mediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Spec collects operations while routes are registered and serves the resulting document
+type Spec struct {
+	mu         sync.Mutex
+	info       Info
+	paths      map[string]map[string]*opObject
+	components map[string]*Schema
+	rendered   []byte
+}
+
+func NewSpec(info Info) *Spec {
+	return &Spec{
+		info:       info,
+		paths:      map[string]map[string]*opObject{},
+		components: map[string]*Schema{},
+	}
+}
+
+var echoParam = regexp.MustCompile(`:(\w+)`)
+
+// Add documents a route, path uses Echo syntax (/bans/:ip). It returns the
+// middleware that validates requests for it.
+func (s *Spec) Add(method, path string, op Operation) echo.MiddlewareFunc {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rendered = nil
+
+	object := &opObject{
+		Summary:     op.Summary,
+		Description: op.Description,
+		Tags:        op.Tags,
+		Responses:   map[string]*bodyObject{},
+	}
+	for _, name := range echoParam.FindAllStringSubmatch(path, -1) {
+		object.Parameters = append(object.Parameters, paramObject{Name: name[1], In: "path", Required: true, Schema: &Schema{Type: "string"}})
+	}
+	for _, param := range op.Query {
+		object.Parameters = append(object.Parameters, paramObject{Name: param.Name, In: "query", Description: param.Description, Required: param.Required, Schema: &Schema{Type: "string"}})
+	}
+	if !op.Public && !op.Admin {
+		object.Parameters = append(object.Parameters, paramObject{
+			Name: types.APIVersionHeader, In: "header", Required: true,
+			Description: "API version, must be " + types.APIVersion,
+			Schema:      &Schema{Type: "string"},
+		})
+	}
+
+	var body *Schema
+	if op.Body != nil {
+		body = s.schemaFor(reflect.TypeOf(op.Body))
+		object.RequestBody = &bodyObject{Required: true, Content: map[string]mediaType{"application/json": {Schema: body}}}
+	}
+
+	status := op.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := &bodyObject{Description: http.StatusText(status)}
+	if op.Response != nil {
+		success.Content = map[string]mediaType{"application/json": {Schema: s.schemaFor(reflect.TypeOf(op.Response))}}
+	}
+	object.Responses[strconv.Itoa(status)] = success
+	errorBody := map[string]mediaType{"application/json": {Schema: s.schemaFor(reflect.TypeOf(types.ErrorResponse{}))}}
+	object.Responses["default"] = &bodyObject{Description: "Error, see code", Content: errorBody}
+
+	if op.Admin {
+		object.Security = []map[string][]string{{"adminKey": {}}}
+	}
+	if op.Install {
+		object.Security = []map[string][]string{{"installToken": {}}}
+	}
+
+	openapiPath := echoParam.ReplaceAllString(path, "{$1}")
+	if s.paths[openapiPath] == nil {
+		s.paths[openapiPath] = map[string]*opObject{}
+	}
+	s.paths[openapiPath][strings.ToLower(method)] = object
+
+	return s.validator(op, body)
+}
+
+// Has reports whether a route was documented, path uses Echo syntax
+func (s *Spec) Has(method, path string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.paths[echoParam.ReplaceAllString(path, "{$1}")][strings.ToLower(method)]
+	return ok
+}
+
+func (s *Spec) Document() Document {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Document{
+		OpenAPI: Version,
+		Info:    s.info,
+		Paths:   s.paths,
+		Components: components{
+			Schemas: s.components,
+			SecuritySchemes: map[string]securityScheme{
+				"adminKey":     {Type: "apiKey", In: "header", Name: types.AdminKeyHeader},
+				"installToken": {Type: "apiKey", In: "header", Name: types.InstallTokenHeader},
+			},
+		},
+	}
+}
+
+// Handler serves the document as JSON
+func (s *Spec) Handler(c echo.Context) error {
+	s.mu.Lock()
+	rendered := s.rendered
+	s.mu.Unlock()
+	if rendered == nil {
+		var err error
+		if rendered, err = json.MarshalIndent(s.Document(), "", "  "); err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.rendered = rendered
+		s.mu.Unlock()
+	}
+	return c.JSONBlob(http.StatusOK, rendered)
+}
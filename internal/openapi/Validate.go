@@ -0,0 +1,157 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+// Request bodies are small, anything bigger is rejected before decoding
+const MaxBodyBytes = 1 << 20
+
+// validator rejects requests that don't match the documented query parameters and body schema.
+// The body is put back afterwards so handlers can bind it as usual.
+func (s *Spec) validator(op Operation, body *Schema) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			for _, param := range op.Query {
+				if param.Required && strings.TrimSpace(c.QueryParam(param.Name)) == "" {
+					return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Missing %s parameter", param.Name))
+				}
+			}
+			if body == nil {
+				return next(c)
+			}
+
+			req := c.Request()
+			if mediaType, _, _ := strings.Cut(req.Header.Get(echo.HeaderContentType), ";"); strings.TrimSpace(mediaType) != echo.MIMEApplicationJSON {
+				return echo.NewHTTPError(http.StatusUnsupportedMediaType, "Content-Type must be application/json")
+			}
+			data, err := io.ReadAll(http.MaxBytesReader(c.Response(), req.Body, MaxBodyBytes))
+			if err != nil {
+				var tooLarge *http.MaxBytesError
+				if errors.As(err, &tooLarge) {
+					return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "Request body too large")
+				}
+				return echo.NewHTTPError(http.StatusBadRequest, "Failed to read request body")
+			}
+			req.Body = io.NopCloser(bytes.NewReader(data))
+
+			decoder := json.NewDecoder(bytes.NewReader(data))
+			decoder.UseNumber()
+			var value any
+			if err := decoder.Decode(&value); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "Invalid JSON format")
+			}
+			if err := s.validate(body, value, ""); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body: "+err.Error())
+			}
+			return next(c)
+		}
+	}
+}
+
+func (s *Spec) validate(schema *Schema, value any, path string) error {
+	if schema.Ref != "" {
+		resolved := s.components[strings.TrimPrefix(schema.Ref, "#/components/schemas/")]
+		if resolved == nil {
+			return nil
+		}
+		schema = resolved
+	}
+	if value == nil {
+		return nil // Required-ness is checked by the parent object
+	}
+	fail := func(format string, args ...any) error {
+		where := path
+		if where == "" {
+			where = "body"
+		}
+		return fmt.Errorf("%s: %s", where, fmt.Sprintf(format, args...))
+	}
+
+	switch schema.Type {
+	case "object":
+		object, ok := value.(map[string]any)
+		if !ok {
+			return fail("must be an object")
+		}
+		for _, name := range schema.Required {
+			if v, ok := object[name]; !ok || v == nil {
+				return fail("%s is required", name)
+			}
+		}
+		for name, v := range object {
+			property := schema.Properties[name]
+			if property == nil {
+				property = schema.AdditionalProperties
+			}
+			if property == nil {
+				continue
+			}
+			if err := s.validate(property, v, join(path, name)); err != nil {
+				return err
+			}
+		}
+	case "array":
+		items, ok := value.([]any)
+		if !ok {
+			return fail("must be an array")
+		}
+		for i, item := range items {
+			if err := s.validate(schema.Items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return fail("must be a string")
+		}
+		if schema.MinLength != nil && len(str) < *schema.MinLength {
+			return fail("must not be empty")
+		}
+		switch schema.Format {
+		case "uuid":
+			if _, err := uuid.Parse(str); err != nil {
+				return fail("must be a UUID")
+			}
+		case "date-time":
+			if _, err := time.Parse(time.RFC3339, str); err != nil {
+				return fail("must be an RFC 3339 timestamp")
+			}
+		}
+	case "integer":
+		number, ok := value.(json.Number)
+		if !ok {
+			return fail("must be an integer")
+		}
+		if _, err := number.Int64(); err != nil {
+			return fail("must be an integer")
+		}
+	case "number":
+		if _, ok := value.(json.Number); !ok {
+			return fail("must be a number")
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fail("must be true or false")
+		}
+	}
+	return nil
+}
+
+func join(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
@@ -0,0 +1,73 @@
+package openapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/MisterNorwood/SugarCube-Server/pkg/types"
+	"github.com/labstack/echo/v4"
+)
+
+func TestValidator(t *testing.T) {
+	spec := NewSpec(Info{Title: "test", Version: "1"})
+	validate := spec.Add(http.MethodPost, "/callback", Operation{
+		Query: []Param{{Name: "site", Required: true}},
+		Body:  types.CallbackRequest{},
+	})
+	const id = `"2f1c2b1e-8d3a-4d5e-9f6a-1b2c3d4e5f60"`
+
+	tests := []struct {
+		name        string
+		query       string
+		contentType string
+		body        string
+		status      int
+	}{
+		{"valid", "?site=example.com", echo.MIMEApplicationJSON, `{"request_id":` + id + `,"site":"example.com","results":{"SAVE10":true}}`, http.StatusOK},
+		{"charset", "?site=example.com", echo.MIMEApplicationJSONCharsetUTF8, `{"request_id":` + id + `,"site":"example.com"}`, http.StatusOK},
+		{"unknown field", "?site=example.com", echo.MIMEApplicationJSON, `{"request_id":` + id + `,"site":"example.com","extra":1}`, http.StatusOK},
+		{"missing query", "", echo.MIMEApplicationJSON, `{"request_id":` + id + `,"site":"example.com"}`, http.StatusBadRequest},
+		{"blank query", "?site=%20", echo.MIMEApplicationJSON, `{"request_id":` + id + `,"site":"example.com"}`, http.StatusBadRequest},
+		{"wrong content type", "?site=example.com", echo.MIMETextPlain, `{}`, http.StatusUnsupportedMediaType},
+		{"malformed", "?site=example.com", echo.MIMEApplicationJSON, `{"site":`, http.StatusBadRequest},
+		{"not an object", "?site=example.com", echo.MIMEApplicationJSON, `[]`, http.StatusBadRequest},
+		{"missing required", "?site=example.com", echo.MIMEApplicationJSON, `{"site":"example.com"}`, http.StatusBadRequest},
+		{"empty required string", "?site=example.com", echo.MIMEApplicationJSON, `{"request_id":` + id + `,"site":""}`, http.StatusBadRequest},
+		{"bad uuid", "?site=example.com", echo.MIMEApplicationJSON, `{"request_id":"nope","site":"example.com"}`, http.StatusBadRequest},
+		{"bad map value", "?site=example.com", echo.MIMEApplicationJSON, `{"request_id":` + id + `,"site":"example.com","results":{"SAVE10":"yes"}}`, http.StatusBadRequest},
+		{"bad nested number", "?site=example.com", echo.MIMEApplicationJSON, `{"request_id":` + id + `,"site":"example.com","reports":{"SAVE10":{"applied":true,"discount":"5"}}}`, http.StatusBadRequest},
+		{"too large", "?site=example.com", echo.MIMEApplicationJSON, `{"site":"` + strings.Repeat("a", MaxBodyBytes) + `"}`, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/callback"+tt.query, strings.NewReader(tt.body))
+			req.Header.Set(echo.HeaderContentType, tt.contentType)
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(req, rec)
+
+			var bound types.CallbackRequest
+			err := validate(func(c echo.Context) error {
+				// The body has to be readable again after validation
+				if err := c.Bind(&bound); err != nil {
+					return err
+				}
+				return c.NoContent(http.StatusOK)
+			})(c)
+
+			status := rec.Code
+			if he, ok := err.(*echo.HTTPError); ok {
+				status = he.Code
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if status != tt.status {
+				t.Fatalf("got status %d, want %d (%v)", status, tt.status, err)
+			}
+			if status == http.StatusOK && bound.Site != "example.com" {
+				t.Fatalf("handler bound site %q", bound.Site)
+			}
+		})
+	}
+}
@@ -3,38 +3,66 @@ package services
 import (
 	"bufio"
 	"context"
+	"errors"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog/log"
 
-	"github.com/go-co-op/gocron"
 	"go.mongodb.org/mongo-driver/v2/bson"
 	"go.mongodb.org/mongo-driver/v2/mongo"
 	"go.mongodb.org/mongo-driver/v2/mongo/options"
 )
 
-func StartBlocklistUpdater(db *mongo.Database) {
-	s := gocron.NewScheduler(time.UTC)
+// BanService owns the ip_bans collection: lookups for the ban middleware,
+// manual bans from the admin API and blocklist imports.
+type BanService struct {
+	db *mongo.Database
+}
+
+func NewBanService(db *mongo.Database) *BanService {
+	return &BanService{db: db}
+}
+
+func (b *BanService) collection() *mongo.Collection {
+	return b.db.Collection("ip_bans")
+}
 
-	s.Every(12).Hours().Do(func() {
+// BlocklistUpdater periodically imports public IP blocklists into ip_bans.
+// Sources and interval can be swapped while it runs.
+type BlocklistUpdater struct {
+	*PeriodicJob
+	sources atomic.Pointer[[]string]
+}
+
+func NewBlocklistUpdater(bans *BanService, interval time.Duration, sources []string) *BlocklistUpdater {
+	u := &BlocklistUpdater{}
+	u.SetSources(sources)
+	u.PeriodicJob = NewPeriodicJob("blocklist-updater", interval, func(ctx context.Context) {
 		log.Info().Msg("Updating IP blocklist...")
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 		defer cancel()
-		UpdateIPBlocklist(ctx, db)
+		bans.ImportBlocklists(ctx, *u.sources.Load())
 	})
+	return u
+}
 
-	s.StartAsync()
+func (u *BlocklistUpdater) SetSources(sources []string) {
+	sourcesCopy := append([]string(nil), sources...)
+	u.sources.Store(&sourcesCopy)
 }
 
-func UpdateIPBlocklist(ctx context.Context, db *mongo.Database) {
-	sources := []string{
-		//"https://raw.githubusercontent.com/firehol/blocklist-ipsets/master/firehol_level1.netset",
-		"https://lists.blocklist.de/lists/all.txt",
-	}
+// ImportBlocklists downloads every source and inserts the IPs that aren't banned yet
+func (b *BanService) ImportBlocklists(ctx context.Context, sources []string) {
 	for _, url := range sources {
-		resp, err := http.Get(url)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			log.Warn().Err(err).Str("source", url).Msg("Invalid blocklist source")
+			continue
+		}
+		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
 			log.Warn().Str("source", url).Msg("Failed to fetch blocklist")
 			continue
@@ -49,7 +77,7 @@ func UpdateIPBlocklist(ctx context.Context, db *mongo.Database) {
 			}
 		}
 
-		result, err := db.Collection("ip_bans").InsertMany(ctx, ips, options.InsertMany().SetOrdered(false))
+		result, err := b.collection().InsertMany(ctx, ips, options.InsertMany().SetOrdered(false))
 		if err != nil {
 			if bwe, ok := err.(mongo.BulkWriteException); ok {
 				for _, we := range bwe.WriteErrors {
@@ -68,10 +96,38 @@ func UpdateIPBlocklist(ctx context.Context, db *mongo.Database) {
 	}
 }
 
-func InitBanLists(db *mongo.Database, ctx context.Context) {
-	db.Collection("ip_bans").Indexes().CreateOne(ctx, mongo.IndexModel{
+func (b *BanService) EnsureIndexes(ctx context.Context) error {
+	_, err := b.collection().Indexes().CreateOne(ctx, mongo.IndexModel{
 		Keys:    bson.D{{Key: "ip", Value: 1}},
 		Options: options.Index().SetUnique(true),
 	})
-	StartBlocklistUpdater(db)
+	return err
+}
+
+// IsBanned reports whether ip is on the ban list
+func (b *BanService) IsBanned(ctx context.Context, ip string) (bool, error) {
+	err := b.collection().FindOne(ctx, bson.M{"ip": ip}).Err()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Ban adds a manual ban. Banning an already banned IP is not an error.
+func (b *BanService) Ban(ctx context.Context, ip string, reason string) error {
+	_, err := b.collection().UpdateOne(ctx,
+		bson.M{"ip": ip},
+		bson.M{"$setOnInsert": bson.M{"ip": ip, "reason": reason, "manual": true, "created_at": time.Now().UTC()}},
+		options.UpdateOne().SetUpsert(true),
+	)
+	return err
+}
+
+// Unban removes a ban and reports whether the IP was banned
+func (b *BanService) Unban(ctx context.Context, ip string) (bool, error) {
+	result, err := b.collection().DeleteOne(ctx, bson.M{"ip": ip})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount > 0, nil
 }
@@ -0,0 +1,301 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/MisterNorwood/SugarCube-Server/internal/database"
+	"github.com/MisterNorwood/SugarCube-Server/pkg/types"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+var (
+	ErrFeedFull   = errors.New("too many stream subscribers")
+	ErrFeedIPFull = errors.New("too many stream subscribers from one IP")
+	ErrFeedClosed = errors.New("coupon feed is shut down")
+)
+
+// Subscribers that fall this far behind are dropped, the client reconnects
+const subscriberBuffer = 64
+
+// Mongo's error for $changeStream on a standalone server
+const changeStreamUnsupported = 40573
+
+// CouponFeed fans coupon changes out to stream subscribers by site. On a replica set
+// the events come from a change stream on the coupon database, so writes by every
+// instance show up. Without one, e.g. on a standalone mongod, the write paths of this
+// instance publish through PublishLocal instead.
+type CouponFeed struct {
+	db    *mongo.Database
+	max   atomic.Uint64
+	maxIP atomic.Uint64
+
+	mu     sync.Mutex
+	subs   map[string]map[chan types.CouponEvent]struct{}
+	count  int
+	perIP  map[string]int
+	closed bool
+
+	onChange atomic.Pointer[func(site string)]
+
+	// Set while the change stream delivers, local publishes are skipped to avoid doubles
+	streaming atomic.Bool
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+func NewCouponFeed(db *mongo.Database, maxSubscribers uint64) *CouponFeed {
+	f := &CouponFeed{db: db, subs: map[string]map[chan types.CouponEvent]struct{}{}, perIP: map[string]int{}}
+	f.SetMaxSubscribers(maxSubscribers)
+	return f
+}
+
+func (f *CouponFeed) SetMaxSubscribers(max uint64) {
+	f.max.Store(max)
+}
+
+// SetMaxPerIP caps the open streams of one IP, 0 is unlimited
+func (f *CouponFeed) SetMaxPerIP(max uint64) {
+	f.maxIP.Store(max)
+}
+
+// Subscribe returns the events of one site until cancel is called. The channel is
+// closed early when the feed shuts down or the subscriber falls behind.
+func (f *CouponFeed) Subscribe(site, ip string) (<-chan types.CouponEvent, func(), error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil, nil, ErrFeedClosed
+	}
+	if uint64(f.count) >= f.max.Load() {
+		return nil, nil, ErrFeedFull
+	}
+	if maxIP := f.maxIP.Load(); maxIP > 0 && uint64(f.perIP[ip]) >= maxIP {
+		return nil, nil, ErrFeedIPFull
+	}
+
+	ch := make(chan types.CouponEvent, subscriberBuffer)
+	if f.subs[site] == nil {
+		f.subs[site] = map[chan types.CouponEvent]struct{}{}
+	}
+	f.subs[site][ch] = struct{}{}
+	f.count++
+	f.perIP[ip]++
+
+	var once sync.Once
+	cancel := func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.remove(site, ch)
+		// Counted until cancel even if the channel was closed early, the stream is open until then
+		once.Do(func() {
+			if f.perIP[ip]--; f.perIP[ip] <= 0 {
+				delete(f.perIP, ip)
+			}
+		})
+	}
+	return ch, cancel, nil
+}
+
+// remove drops a subscriber, f.mu must be held
+func (f *CouponFeed) remove(site string, ch chan types.CouponEvent) {
+	if _, ok := f.subs[site][ch]; !ok {
+		return
+	}
+	delete(f.subs[site], ch)
+	if len(f.subs[site]) == 0 {
+		delete(f.subs, site)
+	}
+	f.count--
+	close(ch)
+}
+
+// OnChange sets a function called with the site of every published event, e.g. to invalidate a cache
+func (f *CouponFeed) OnChange(fn func(site string)) {
+	f.onChange.Store(&fn)
+}
+
+func (f *CouponFeed) publish(event types.CouponEvent) {
+	if event.At.IsZero() {
+		event.At = time.Now().UTC()
+	}
+	if onChange := f.onChange.Load(); onChange != nil {
+		(*onChange)(event.Site)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for ch := range f.subs[event.Site] {
+		select {
+		case ch <- event:
+		default:
+			f.remove(event.Site, ch)
+		}
+	}
+}
+
+// PublishLocal publishes a change made by this instance, unless the change stream will
+func (f *CouponFeed) PublishLocal(event types.CouponEvent) {
+	if !f.streaming.Load() {
+		f.publish(event)
+	}
+}
+
+// Announce publishes an event no database write stands for, which the change stream won't deliver
+func (f *CouponFeed) Announce(event types.CouponEvent) {
+	f.publish(event)
+}
+
+// Start begins watching the coupon database, falling back to local publishing if it can't
+func (f *CouponFeed) Start(context.Context) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	f.cancel = cancel
+	f.done = make(chan struct{})
+	go f.watch(ctx)
+	return nil
+}
+
+// Stop ends the watch and closes every subscription, so open streams return
+func (f *CouponFeed) Stop(ctx context.Context) error {
+	if f.cancel != nil {
+		f.cancel()
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	for site, subs := range f.subs {
+		for ch := range subs {
+			f.remove(site, ch)
+		}
+	}
+	return nil
+}
+
+func (f *CouponFeed) watch(ctx context.Context) {
+	defer close(f.done)
+	var resumeToken bson.Raw
+	for {
+		err := f.stream(ctx, &resumeToken)
+		f.streaming.Store(false)
+		if ctx.Err() != nil {
+			return
+		}
+		var serverErr mongo.ServerError
+		if errors.As(err, &serverErr) && serverErr.HasErrorCode(changeStreamUnsupported) {
+			log.Info().Msg("Change streams need a replica set, coupon streams only see this instance's changes")
+			return
+		}
+		log.Warn().Err(err).Msg("Coupon change stream failed, publishing local changes until it's back")
+		resumeToken = nil // It may be what failed, and events from the gap went out locally
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(30 * time.Second):
+		}
+	}
+}
+
+type changeEvent struct {
+	OperationType string `bson:"operationType"`
+	NS            struct {
+		Coll string `bson:"coll"`
+	} `bson:"ns"`
+	FullDocument             *types.CouponEntry `bson:"fullDocument"`
+	FullDocumentBeforeChange *types.CouponEntry `bson:"fullDocumentBeforeChange"`
+	UpdateDescription        struct {
+		UpdatedFields bson.M `bson:"updatedFields"`
+	} `bson:"updateDescription"`
+}
+
+func (f *CouponFeed) stream(ctx context.Context, resumeToken *bson.Raw) error {
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.M{
+		"operationType": bson.M{"$in": bson.A{"insert", "update", "replace", "delete"}},
+	}}}}
+	opts := options.ChangeStream().
+		SetFullDocument(options.UpdateLookup).
+		SetFullDocumentBeforeChange(options.WhenAvailable)
+	if *resumeToken != nil {
+		opts.SetResumeAfter(*resumeToken)
+	}
+	cs, err := f.db.Watch(ctx, pipeline, opts)
+	if err != nil {
+		return err
+	}
+	defer cs.Close(context.Background())
+
+	// Deleted coupons only carry their code with pre-images, MongoDB 6.0 and up
+	database.EnablePreImages(ctx, f.db)
+	f.streaming.Store(true)
+	log.Info().Msg("Watching coupon changes")
+
+	for cs.Next(ctx) {
+		*resumeToken = cs.ResumeToken()
+		var change changeEvent
+		if err := cs.Decode(&change); err != nil {
+			log.Warn().Err(err).Msg("Failed to decode coupon change")
+			continue
+		}
+		if event, ok := toCouponEvent(change); ok {
+			f.publish(event)
+		}
+	}
+	return cs.Err()
+}
+
+// Pending coupons aren't public, so changes to them aren't either
+func toCouponEvent(change changeEvent) (types.CouponEvent, bool) {
+	event := types.CouponEvent{Site: change.NS.Coll}
+	switch change.OperationType {
+	case "insert", "update", "replace":
+		entry := change.FullDocument
+		if entry == nil {
+			return event, false
+		}
+		// A live coupon can be held back, e.g. a variant whose details differ in a merge
+		if entry.Status == types.CouponPending {
+			before := change.FullDocumentBeforeChange
+			if before == nil || before.Status == types.CouponPending {
+				return event, false
+			}
+			event.Type, event.Coupon, event.Score = types.EventPruned, entry.Coupon, entry.Score
+			return event, true
+		}
+		_, statusChanged := change.UpdateDescription.UpdatedFields["status"]
+		_, scoreChanged := change.UpdateDescription.UpdatedFields["score"]
+		switch {
+		case change.OperationType == "insert" || statusChanged:
+			event.Type, event.Entry = types.EventAdded, entry
+		case scoreChanged || change.OperationType == "replace":
+			event.Type = types.EventRescored
+		default:
+			return event, false
+		}
+		event.Coupon, event.Score = entry.Coupon, entry.Score
+	case "delete":
+		entry := change.FullDocumentBeforeChange
+		if entry == nil || entry.Status == types.CouponPending {
+			return event, false
+		}
+		event.Type, event.Coupon, event.Score = deletedEventType(*entry), entry.Coupon, entry.Score
+	default:
+		return event, false
+	}
+	return event, true
+}
+
+// deletedEventType tells an expired coupon from a pruned one
+func deletedEventType(entry types.CouponEntry) string {
+	if !entry.ExpiresAt.IsZero() && entry.ExpiresAt.Before(time.Now()) {
+		return types.EventExpired
+	}
+	return types.EventPruned
+}
@@ -0,0 +1,85 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/MisterNorwood/SugarCube-Server/pkg/types"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestToCouponEvent(t *testing.T) {
+	live := &types.CouponEntry{Coupon: "SAVE10", Score: 2, Status: types.CouponLive}
+	legacy := &types.CouponEntry{Coupon: "OLD5", Score: 1}
+	pending := &types.CouponEntry{Coupon: "NEW20", Status: types.CouponPending}
+	expired := &types.CouponEntry{Coupon: "GONE", Score: 3, ExpiresAt: time.Now().Add(-time.Hour)}
+	negative := &types.CouponEntry{Coupon: "BAD", Score: -1, ExpiresAt: time.Now().Add(time.Hour)}
+
+	change := func(op string, after, before *types.CouponEntry, updated ...string) changeEvent {
+		event := changeEvent{OperationType: op, FullDocument: after, FullDocumentBeforeChange: before}
+		event.NS.Coll = "example.com"
+		event.UpdateDescription.UpdatedFields = bson.M{}
+		for _, field := range updated {
+			event.UpdateDescription.UpdatedFields[field] = nil
+		}
+		return event
+	}
+	tests := []struct {
+		name   string
+		change changeEvent
+		ok     bool
+		typ    string
+		coupon string
+		entry  bool
+	}{
+		{"insert", change("insert", live, nil), true, types.EventAdded, "SAVE10", true},
+		{"insert without status", change("insert", legacy, nil), true, types.EventAdded, "OLD5", true},
+		{"insert pending", change("insert", pending, nil), false, "", "", false},
+		{"promoted", change("update", live, nil, "status"), true, types.EventAdded, "SAVE10", true},
+		{"rescored", change("update", live, nil, "score", "reports_applied"), true, types.EventRescored, "SAVE10", false},
+		{"rescored pending", change("update", pending, nil, "score"), false, "", "", false},
+		{"held back", change("replace", pending, live), true, types.EventPruned, "NEW20", false},
+		{"other field", change("update", live, nil, "code_key"), false, "", "", false},
+		{"replaced", change("replace", live, nil), true, types.EventRescored, "SAVE10", false},
+		{"update of a deleted coupon", change("update", nil, nil, "score"), false, "", "", false},
+		{"pruned", change("delete", nil, negative), true, types.EventPruned, "BAD", false},
+		{"deleted after expiry", change("delete", nil, expired), true, types.EventExpired, "GONE", false},
+		{"deleted pending", change("delete", nil, pending), false, "", "", false},
+		{"deleted without pre-image", change("delete", nil, nil), false, "", "", false},
+		{"dropped", change("drop", nil, nil), false, "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, ok := toCouponEvent(tt.change)
+			if ok != tt.ok {
+				t.Fatalf("ok is %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if event.Type != tt.typ || event.Coupon != tt.coupon || event.Site != "example.com" {
+				t.Fatalf("got %s %s on %s, want %s %s", event.Type, event.Coupon, event.Site, tt.typ, tt.coupon)
+			}
+			if (event.Entry != nil) != tt.entry {
+				t.Fatalf("entry set is %v, want %v", event.Entry != nil, tt.entry)
+			}
+		})
+	}
+}
+
+func TestDeletedEventType(t *testing.T) {
+	tests := []struct {
+		name      string
+		expiresAt time.Time
+		want      string
+	}{
+		{"no expiry", time.Time{}, types.EventPruned},
+		{"expires later", time.Now().Add(time.Hour), types.EventPruned},
+		{"expired", time.Now().Add(-time.Second), types.EventExpired},
+	}
+	for _, tt := range tests {
+		if got := deletedEventType(types.CouponEntry{ExpiresAt: tt.expiresAt}); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -4,34 +4,68 @@ import (
 	"context"
 	"time"
 
-	"github.com/go-co-op/gocron"
+	"github.com/MisterNorwood/SugarCube-Server/pkg/types"
 	"github.com/rs/zerolog/log"
 	"go.mongodb.org/mongo-driver/v2/bson"
 	"go.mongodb.org/mongo-driver/v2/mongo"
 )
 
-func CleanupNegativeCoupons(db *mongo.Database) error {
-	ctx := context.Background()
-
+// CleanupCoupons removes coupons with a negative score, publishing a pruned event for each
+// live one. Expired coupons are kept, live ones whose expires_at passed since expiredSince
+// get an expired event. It returns when it looked, the next run's expiredSince.
+func CleanupCoupons(ctx context.Context, db *mongo.Database, feed *CouponFeed, cache *SiteCache, expiredSince time.Time) (time.Time, error) {
+	now := time.Now().UTC()
 	collections, err := db.ListCollectionNames(ctx, bson.D{})
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to list collections")
-		return err
+		return expiredSince, err
 	}
 
+	filter := bson.M{"score": bson.M{"$lt": 0}}
 	for _, colName := range collections {
 		col := db.Collection(colName)
+		announceExpired(ctx, col, feed, expiredSince, now)
+
+		cur, err := col.Find(ctx, filter)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("collection", colName).
+				Msg("Failed to find coupons to remove")
+			continue
+		}
+		var removed []types.CouponEntry
+		if err := cur.All(ctx, &removed); err != nil {
+			log.Error().
+				Err(err).
+				Str("collection", colName).
+				Msg("Failed to read coupons to remove")
+			continue
+		}
+		if len(removed) == 0 {
+			continue
+		}
 
-		filter := bson.M{"score": bson.M{"$lt": 0}}
-		result, err := col.DeleteMany(ctx, filter)
+		codes := make([]string, 0, len(removed))
+		for _, entry := range removed {
+			codes = append(codes, entry.Coupon)
+		}
+		// Re-checks the filter, a vote may have lifted a score since the Find
+		result, err := col.DeleteMany(ctx, bson.M{"$and": bson.A{filter, bson.M{"coupon": bson.M{"$in": codes}}}})
 		if err != nil {
 			log.Error().
 				Err(err).
 				Str("collection", colName).
-				Msg("Failed to delete negative-score coupons")
+				Msg("Failed to delete coupons")
 			continue
 		}
 
+		cache.Invalidate(colName)
+		for _, entry := range removed {
+			if entry.Status != types.CouponPending {
+				feed.PublishLocal(types.CouponEvent{Type: deletedEventType(entry), Site: colName, Coupon: entry.Coupon, Score: entry.Score})
+			}
+		}
 		if result.DeletedCount > 0 {
 			log.Info().
 				Int64("deleted", result.DeletedCount).
@@ -40,19 +74,47 @@ func CleanupNegativeCoupons(db *mongo.Database) error {
 		}
 	}
 
-	return nil
+	return now, nil
+}
+
+// announceExpired publishes an expired event for the live coupons whose expires_at is in [since, now).
+// No write stands behind it, so it goes to this instance's subscribers even with a change stream.
+func announceExpired(ctx context.Context, col *mongo.Collection, feed *CouponFeed, since, now time.Time) {
+	cur, err := col.Find(ctx, bson.M{
+		"expires_at": bson.M{"$gte": since, "$lt": now},
+		"status":     bson.M{"$ne": types.CouponPending},
+	})
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("collection", col.Name()).
+			Msg("Failed to find expired coupons")
+		return
+	}
+	var expired []types.CouponEntry
+	if err := cur.All(ctx, &expired); err != nil {
+		log.Error().
+			Err(err).
+			Str("collection", col.Name()).
+			Msg("Failed to read expired coupons")
+		return
+	}
+	for _, entry := range expired {
+		feed.Announce(types.CouponEvent{Type: types.EventExpired, Site: col.Name(), Coupon: entry.Coupon, Score: entry.Score})
+	}
 }
 
-func StartNegativeScorePruner(db *mongo.Database) {
-	s := gocron.NewScheduler(time.UTC)
-	s.Every(6).Hours().Do(func() {
+func NewCouponPruner(db *mongo.Database, feed *CouponFeed, cache *SiteCache, interval time.Duration) *PeriodicJob {
+	// Coupons that expired before the server started aren't news to anyone
+	expiredSince := time.Now().UTC()
+	return NewPeriodicJob("coupon-pruner", interval, func(ctx context.Context) {
 		log.Info().Msg("Starting scheduled cleanup of negative-score coupons")
 
-		if err := CleanupNegativeCoupons(db); err != nil {
+		var err error
+		if expiredSince, err = CleanupCoupons(ctx, db, feed, cache, expiredSince); err != nil {
 			log.Error().Err(err).Msg("Cleanup job failed")
 		} else {
 			log.Info().Msg("Cleanup job completed successfully")
 		}
 	})
-	s.StartAsync()
 }
@@ -0,0 +1,173 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+var (
+	ErrInstallUnknown = errors.New("unknown install")
+	ErrInstallRevoked = errors.New("install revoked")
+	// Returned by Register once an IP used up its registrations for the hour
+	ErrRegistrationLimit = errors.New("registration limit reached")
+)
+
+// Prefix of every install token, bumped if the format ever changes
+const installTokenVersion = "sc1"
+
+// InstallService owns the installs collection. Every extension install registers once
+// and gets a token signed with the server secret; the signature proves the token is ours
+// without a lookup, the collection is only needed to check for revocation.
+type InstallService struct {
+	db      *mongo.Database
+	secrets atomic.Pointer[[][]byte]
+	// Used while no secret is configured, tokens then stop working on restart
+	ephemeral []byte
+	perIP     atomic.Uint64
+}
+
+type Install struct {
+	ID           string    `bson:"_id"`
+	CreatedAt    time.Time `bson:"created_at"`
+	IP           string    `bson:"ip"`
+	UserAgent    string    `bson:"user_agent"`
+	RevokedAt    time.Time `bson:"revoked_at,omitempty"`
+	RevokeReason string    `bson:"revoke_reason,omitempty"`
+}
+
+func NewInstallService(db *mongo.Database, secrets []string) *InstallService {
+	s := &InstallService{db: db, ephemeral: make([]byte, 32)}
+	_, _ = rand.Read(s.ephemeral)
+	s.SetSecrets(secrets)
+	return s
+}
+
+func (s *InstallService) collection() *mongo.Collection {
+	return s.db.Collection("installs")
+}
+
+// SetSecrets replaces the signing secrets. The first one signs new tokens,
+// the others still verify, so a secret can be rotated without logging every install out.
+func (s *InstallService) SetSecrets(secrets []string) {
+	keys := make([][]byte, 0, len(secrets))
+	for _, secret := range secrets {
+		keys = append(keys, []byte(secret))
+	}
+	if len(keys) == 0 {
+		keys = append(keys, s.ephemeral)
+	}
+	s.secrets.Store(&keys)
+}
+
+// SetRegistrationLimit caps the installs one IP registers per hour, 0 is unlimited
+func (s *InstallService) SetRegistrationLimit(perIP uint64) {
+	s.perIP.Store(perIP)
+}
+
+func (s *InstallService) EnsureIndexes(ctx context.Context) error {
+	_, err := s.collection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "ip", Value: 1}, {Key: "created_at", Value: 1}},
+	})
+	return err
+}
+
+// Register records a new install and returns its ID and token.
+// It returns ErrRegistrationLimit if the IP registered too many installs in the last hour.
+func (s *InstallService) Register(ctx context.Context, ip, userAgent string) (string, string, error) {
+	if limit := s.perIP.Load(); limit > 0 {
+		recent, err := s.collection().CountDocuments(ctx,
+			bson.M{"ip": ip, "created_at": bson.M{"$gte": time.Now().UTC().Add(-time.Hour)}},
+			options.Count().SetLimit(int64(limit)),
+		)
+		if err != nil {
+			return "", "", err
+		}
+		if uint64(recent) >= limit {
+			return "", "", ErrRegistrationLimit
+		}
+	}
+	install := Install{
+		ID:        uuid.NewString(),
+		CreatedAt: time.Now().UTC(),
+		IP:        ip,
+		UserAgent: userAgent,
+	}
+	if _, err := s.collection().InsertOne(ctx, install); err != nil {
+		return "", "", err
+	}
+	return install.ID, s.sign(install.ID), nil
+}
+
+func (s *InstallService) sign(id string) string {
+	payload := installTokenVersion + "." + id
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac((*s.secrets.Load())[0], payload))
+}
+
+// Verify checks the token's signature and returns the install ID it was issued to.
+// It doesn't check for revocation, see Check.
+func (s *InstallService) Verify(token string) (string, bool) {
+	version, rest, _ := strings.Cut(token, ".")
+	id, signature, ok := strings.Cut(rest, ".")
+	if !ok || version != installTokenVersion {
+		return "", false
+	}
+	if _, err := uuid.Parse(id); err != nil {
+		return "", false
+	}
+	presented, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return "", false
+	}
+	for _, secret := range *s.secrets.Load() {
+		if hmac.Equal(presented, mac(secret, installTokenVersion+"."+id)) {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// Check returns ErrInstallRevoked or ErrInstallUnknown if the install may no longer write
+func (s *InstallService) Check(ctx context.Context, id string) error {
+	var install Install
+	err := s.collection().FindOne(ctx, bson.M{"_id": id}).Decode(&install)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrInstallUnknown
+	}
+	if err != nil {
+		return err
+	}
+	if !install.RevokedAt.IsZero() {
+		return ErrInstallRevoked
+	}
+	return nil
+}
+
+// Revoke blocks an install for good and reports whether it exists
+func (s *InstallService) Revoke(ctx context.Context, id, reason string) (bool, error) {
+	result, err := s.collection().UpdateOne(ctx,
+		bson.M{"_id": id},
+		bson.M{"$set": bson.M{"revoked_at": time.Now().UTC(), "revoke_reason": reason}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount > 0, nil
+}
+
+func mac(secret []byte, payload string) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
@@ -0,0 +1,134 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-co-op/gocron"
+	"github.com/rs/zerolog/log"
+)
+
+// PeriodicJob runs a task on a fixed interval that can be changed while running.
+// Each job owns its scheduler so it can be stopped or rescheduled on its own.
+// The task's context is cancelled when Shutdown runs out of time.
+type PeriodicJob struct {
+	Name string
+
+	mu        sync.Mutex
+	interval  time.Duration
+	task      func(ctx context.Context)
+	scheduler *gocron.Scheduler
+	closed    bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewPeriodicJob(name string, interval time.Duration, task func(ctx context.Context)) *PeriodicJob {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &PeriodicJob{
+		Name:     name,
+		interval: interval,
+		task:     task,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Start schedules the job, running it once right away. A job that was shut down stays down.
+func (j *PeriodicJob) Start() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.closed {
+		return
+	}
+	j.start(true)
+}
+
+// Stop unschedules the job and waits for a running task to finish
+func (j *PeriodicJob) Stop() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.stop()
+}
+
+// Shutdown stops the job for good and waits for a running task to finish.
+// If ctx is done first the task's context is cancelled, so it doesn't keep writing to a closing database.
+func (j *PeriodicJob) Shutdown(ctx context.Context) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.closed = true
+	if j.scheduler == nil {
+		j.cancel()
+		return nil
+	}
+
+	scheduler := j.scheduler
+	j.scheduler = nil
+	done := make(chan struct{})
+	go func() {
+		scheduler.Stop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		j.cancel()
+		return nil
+	case <-ctx.Done():
+		j.cancel()
+		log.Warn().Str("job", j.Name).Msg("Job still running at shutdown deadline, cancelled it")
+		return ctx.Err()
+	}
+}
+
+func (j *PeriodicJob) Running() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.scheduler != nil
+}
+
+func (j *PeriodicJob) Interval() time.Duration {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.interval
+}
+
+// SetInterval reschedules a running job. The next run happens one new interval from now.
+func (j *PeriodicJob) SetInterval(interval time.Duration) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if interval == j.interval {
+		return
+	}
+	j.interval = interval
+	if j.scheduler != nil {
+		j.stop()
+		j.start(false)
+		log.Info().Str("job", j.Name).Dur("interval", interval).Msg("Rescheduled job")
+	}
+}
+
+func (j *PeriodicJob) start(immediately bool) {
+	if j.scheduler != nil {
+		return
+	}
+	s := gocron.NewScheduler(time.UTC)
+	s.SingletonModeAll() // a slow run shouldn't overlap the next one
+	s.Every(j.interval)
+	if !immediately {
+		s.WaitForSchedule()
+	}
+	s.Do(func() { j.task(j.ctx) })
+	s.StartAsync()
+	j.scheduler = s
+}
+
+func (j *PeriodicJob) stop() {
+	if j.scheduler == nil {
+		return
+	}
+	j.scheduler.Stop()
+	j.scheduler = nil
+}
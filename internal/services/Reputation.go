@@ -0,0 +1,290 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/MisterNorwood/SugarCube-Server/internal/database"
+	"github.com/MisterNorwood/SugarCube-Server/internal/utils"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// A coupon's score has to be at least this far from 0 before votes on it count as agreeing or not
+const consensusScore = 1.0
+
+const (
+	// How long a read remembers whether an install is trusted
+	trustMemoTTL = 30 * time.Second
+	// Expired entries are swept once the memo holds this many installs
+	trustMemoSize = 10000
+)
+
+// ReputationService owns the reputation collection. Every client, an install or
+// an IP for clients without a token, gets credit when its votes agree with the
+// consensus and when coupons it submitted work, and loses it otherwise.
+type ReputationService struct {
+	db  *mongo.Database
+	cfg atomic.Pointer[utils.ReputationConfig]
+
+	memoMu sync.Mutex
+	memo   map[string]trustMemo
+
+	// Set once a client is trusted on its own, which ends the bootstrap. Until then
+	// bootstrapUntil is how long the last look for one counts.
+	bootstrapped   atomic.Bool
+	bootstrapMu    sync.Mutex
+	bootstrapUntil time.Time
+}
+
+type trustMemo struct {
+	trusted bool
+	until   time.Time
+}
+
+// Reputation counters of one client
+type ClientReputation struct {
+	Key               string    `bson:"_id"`
+	VotesAgreed       int64     `bson:"votes_agreed"`
+	VotesDisagreed    int64     `bson:"votes_disagreed"`
+	SubmissionsWorked int64     `bson:"submissions_worked"`
+	SubmissionsFailed int64     `bson:"submissions_failed"`
+	UpdatedAt         time.Time `bson:"updated_at"`
+}
+
+// Score is between 0 and 1. Clients without history start at 0.5 and
+// every outcome moves them less the more history they have.
+func (r ClientReputation) Score() float64 {
+	good := float64(r.VotesAgreed + r.SubmissionsWorked)
+	bad := float64(r.VotesDisagreed + r.SubmissionsFailed)
+	return (good + 1) / (good + bad + 2)
+}
+
+// Outcomes counts the votes and submissions the score is based on
+func (r ClientReputation) Outcomes() int64 {
+	return r.VotesAgreed + r.VotesDisagreed + r.SubmissionsWorked + r.SubmissionsFailed
+}
+
+// Weight is how much one vote of the client moves a coupon's score, between 0 and 2
+func (r ClientReputation) Weight() float64 {
+	return 2 * r.Score()
+}
+
+// TrustedUnder reports whether the client is trusted. A few lucky votes give a high score,
+// so it takes cfg.MinOutcomes of history as well.
+func (r ClientReputation) TrustedUnder(cfg utils.ReputationConfig) bool {
+	return r.Outcomes() >= int64(cfg.MinOutcomes) && r.Score() >= cfg.TrustedAbove
+}
+
+func NewReputationService(db *mongo.Database, cfg utils.ReputationConfig) *ReputationService {
+	r := &ReputationService{db: db, memo: map[string]trustMemo{}}
+	r.SetConfig(cfg)
+	return r
+}
+
+func (r *ReputationService) SetConfig(cfg utils.ReputationConfig) {
+	r.cfg.Store(&cfg)
+	r.memoMu.Lock()
+	clear(r.memo)
+	r.memoMu.Unlock()
+	// The clients trusted under the old thresholds may not be under the new ones
+	r.bootstrapped.Store(false)
+	r.bootstrapMu.Lock()
+	r.bootstrapUntil = time.Time{}
+	r.bootstrapMu.Unlock()
+}
+
+func (r *ReputationService) collection() *mongo.Collection {
+	return r.db.Collection("reputation")
+}
+
+// ClientKey is the reputation key of a client, its install if it has one
+func ClientKey(installID, ip string) string {
+	if installID != "" {
+		return "install:" + installID
+	}
+	return "ip:" + ip
+}
+
+func (r *ReputationService) Get(ctx context.Context, key string) (ClientReputation, error) {
+	reputation := ClientReputation{Key: key}
+	err := r.collection().FindOne(ctx, bson.M{"_id": key}).Decode(&reputation)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		err = nil
+	}
+	return reputation, err
+}
+
+// Weight is the client's vote weight, 1 for a new client. Lookup errors count as a new client.
+func (r *ReputationService) Weight(ctx context.Context, key string) float64 {
+	if !r.cfg.Load().Enabled {
+		return 1
+	}
+	reputation, err := r.Get(ctx, key)
+	if err != nil {
+		log.Warn().Ctx(ctx).Err(err).Msg("Failed to look up reputation, using the default weight")
+	}
+	return reputation.Weight()
+}
+
+// Trusted reports whether the client's submissions go live right away
+// and whether it gets to see pending coupons
+func (r *ReputationService) Trusted(ctx context.Context, key string) bool {
+	cfg := r.cfg.Load()
+	if !cfg.Enabled || r.Bootstrapping(ctx) {
+		return true
+	}
+	reputation, err := r.Get(ctx, key)
+	if err != nil {
+		log.Warn().Ctx(ctx).Err(err).Msg("Failed to look up reputation, treating the client as untrusted")
+		return false
+	}
+	return reputation.TrustedUnder(*cfg)
+}
+
+// TrustedReader is Trusted for coupon reads, which happen on every page load. Only installs
+// see pending coupons, and their trust is remembered for a short while instead of looked up each time.
+func (r *ReputationService) TrustedReader(ctx context.Context, installID string) bool {
+	if !r.cfg.Load().Enabled {
+		return true
+	}
+	if installID == "" {
+		return false
+	}
+	now := time.Now()
+	r.memoMu.Lock()
+	memo, ok := r.memo[installID]
+	r.memoMu.Unlock()
+	if ok && now.Before(memo.until) {
+		return memo.trusted
+	}
+
+	trusted := r.Trusted(ctx, ClientKey(installID, ""))
+	r.memoMu.Lock()
+	if len(r.memo) >= trustMemoSize {
+		for id, memo := range r.memo {
+			if now.After(memo.until) {
+				delete(r.memo, id)
+			}
+		}
+		if len(r.memo) >= trustMemoSize {
+			clear(r.memo)
+		}
+	}
+	r.memo[installID] = trustMemo{trusted: trusted, until: now.Add(trustMemoTTL)}
+	r.memoMu.Unlock()
+	return trusted
+}
+
+// Bootstrapping reports whether every client is trusted because none is on its own yet.
+// Only votes on live coupons earn reputation, and only trusted clients submit live ones,
+// so a new deployment would never trust anybody otherwise. Lookup errors end it for the
+// moment, like they make a client untrusted.
+func (r *ReputationService) Bootstrapping(ctx context.Context) bool {
+	cfg := r.cfg.Load()
+	if !cfg.Bootstrap || r.bootstrapped.Load() {
+		return false
+	}
+	now := time.Now()
+	r.bootstrapMu.Lock()
+	defer r.bootstrapMu.Unlock()
+	if now.Before(r.bootstrapUntil) {
+		return true
+	}
+
+	err := r.collection().FindOne(ctx, trustedFilter(*cfg)).Err()
+	switch {
+	case err == nil:
+		r.bootstrapped.Store(true)
+		log.Info().Ctx(ctx).Msg("A client is trusted, reputation bootstrap is over")
+		return false
+	case errors.Is(err, mongo.ErrNoDocuments):
+		r.bootstrapUntil = now.Add(trustMemoTTL)
+		return true
+	}
+	log.Warn().Ctx(ctx).Err(err).Msg("Failed to look for trusted clients, treating the bootstrap as over")
+	return false
+}
+
+// trustedFilter matches the clients TrustedUnder trusts
+func trustedFilter(cfg utils.ReputationConfig) bson.M {
+	counter := func(field string) bson.M { return bson.M{"$ifNull": bson.A{"$" + field, 0}} }
+	good := bson.M{"$add": bson.A{counter("votes_agreed"), counter("submissions_worked")}}
+	bad := bson.M{"$add": bson.A{counter("votes_disagreed"), counter("submissions_failed")}}
+	return bson.M{"$expr": bson.M{"$and": bson.A{
+		bson.M{"$gte": bson.A{bson.M{"$add": bson.A{good, bad}}, int64(cfg.MinOutcomes)}},
+		// Score() >= TrustedAbove without dividing
+		bson.M{"$gte": bson.A{
+			bson.M{"$add": bson.A{good, 1}},
+			bson.M{"$multiply": bson.A{cfg.TrustedAbove, bson.M{"$add": bson.A{good, bad, 2}}}},
+		}},
+	}}}
+}
+
+func (r *ReputationService) PromoteScore() float64 {
+	return r.cfg.Load().PromoteScore
+}
+
+// RecordVotes credits the voter for votes that agreed with the score the coupon had
+// before and the submitters for votes on their coupons
+func (r *ReputationService) RecordVotes(ctx context.Context, voter string, votes []database.VoteResult) {
+	if !r.cfg.Load().Enabled {
+		return
+	}
+	var agreed, disagreed int64
+	submitters := map[string]*ClientReputation{}
+	for _, vote := range votes {
+		if math.Abs(vote.ScoreBefore) >= consensusScore {
+			if (vote.ScoreBefore > 0) == vote.Worked {
+				agreed++
+			} else {
+				disagreed++
+			}
+		}
+		if vote.SubmittedBy == "" {
+			continue
+		}
+		submitter := submitters[vote.SubmittedBy]
+		if submitter == nil {
+			submitter = &ClientReputation{}
+			submitters[vote.SubmittedBy] = submitter
+		}
+		if vote.Worked {
+			submitter.SubmissionsWorked++
+		} else {
+			submitter.SubmissionsFailed++
+		}
+	}
+
+	if agreed+disagreed > 0 {
+		r.add(ctx, voter, bson.M{"votes_agreed": agreed, "votes_disagreed": disagreed})
+	}
+	for key, submitter := range submitters {
+		r.add(ctx, key, bson.M{"submissions_worked": submitter.SubmissionsWorked, "submissions_failed": submitter.SubmissionsFailed})
+	}
+}
+
+// add adds to the client's counters. The first client trusted on its own ends the bootstrap
+// here right away, other instances notice on their next look.
+func (r *ReputationService) add(ctx context.Context, key string, counters bson.M) {
+	var updated ClientReputation
+	err := r.collection().FindOneAndUpdate(ctx,
+		bson.M{"_id": key},
+		bson.M{"$inc": counters, "$set": bson.M{"updated_at": time.Now().UTC()}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&updated)
+	if err != nil {
+		log.Warn().Ctx(ctx).Err(err).Msg("Failed to update reputation")
+		return
+	}
+	if !r.bootstrapped.Load() && updated.TrustedUnder(*r.cfg.Load()) {
+		r.bootstrapped.Store(true)
+		log.Info().Ctx(ctx).Msg("A client is trusted, reputation bootstrap is over")
+	}
+}
@@ -0,0 +1,86 @@
+package services
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/MisterNorwood/SugarCube-Server/internal/utils"
+)
+
+func TestReputationThresholds(t *testing.T) {
+	cfg := utils.DefaultConfig().Reputation
+	tests := []struct {
+		name       string
+		reputation ClientReputation
+		score      float64
+		weight     float64
+		trusted    bool
+	}{
+		{"new client", ClientReputation{}, 0.5, 1, false},
+		{"one agreeing vote", ClientReputation{VotesAgreed: 1}, 2.0 / 3, 4.0 / 3, false},
+		{"lucky streak below minimum", ClientReputation{VotesAgreed: 9}, 10.0 / 11, 20.0 / 11, false},
+		{"at minimum below threshold", ClientReputation{VotesAgreed: 4, VotesDisagreed: 4, SubmissionsWorked: 1, SubmissionsFailed: 1}, 0.5, 1, false},
+		{"at minimum above threshold", ClientReputation{VotesAgreed: 7, SubmissionsWorked: 1, VotesDisagreed: 2}, 0.75, 1.5, true},
+		{"exactly at threshold", ClientReputation{VotesAgreed: 8, VotesDisagreed: 5}, 0.6, 1.2, true},
+		{"just below threshold", ClientReputation{VotesAgreed: 7, VotesDisagreed: 5}, 8.0 / 14, 16.0 / 14, false},
+		{"mostly wrong", ClientReputation{VotesDisagreed: 20}, 1.0 / 22, 2.0 / 22, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.reputation.Score(); math.Abs(got-tt.score) > 1e-9 {
+				t.Errorf("score %v, want %v", got, tt.score)
+			}
+			if got := tt.reputation.Weight(); math.Abs(got-tt.weight) > 1e-9 {
+				t.Errorf("weight %v, want %v", got, tt.weight)
+			}
+			if got := tt.reputation.TrustedUnder(cfg); got != tt.trusted {
+				t.Errorf("trusted %v, want %v", got, tt.trusted)
+			}
+		})
+	}
+}
+
+func TestReputationMinOutcomes(t *testing.T) {
+	reputation := ClientReputation{VotesAgreed: 3}
+	for _, tt := range []struct {
+		min     uint64
+		trusted bool
+	}{{0, true}, {3, true}, {4, false}} {
+		cfg := utils.ReputationConfig{Enabled: true, TrustedAbove: 0.6, MinOutcomes: tt.min}
+		if got := reputation.TrustedUnder(cfg); got != tt.trusted {
+			t.Errorf("min_outcomes %d: trusted %v, want %v", tt.min, got, tt.trusted)
+		}
+	}
+}
+
+func TestReputationDisabled(t *testing.T) {
+	r := NewReputationService(nil, utils.ReputationConfig{})
+	ctx := context.Background()
+	if !r.Trusted(ctx, "ip:192.0.2.1") || !r.TrustedReader(ctx, "") {
+		t.Fatal("everyone is trusted with reputation off")
+	}
+	if w := r.Weight(ctx, "ip:192.0.2.1"); w != 1 {
+		t.Fatalf("weight %v with reputation off, want 1", w)
+	}
+}
+
+func TestReputationBootstrapEnds(t *testing.T) {
+	cfg := utils.DefaultConfig().Reputation
+	ctx := context.Background()
+	r := NewReputationService(nil, cfg)
+	// Without a database this only gets past the lookup once the bootstrap is over
+	r.bootstrapped.Store(true)
+	if r.Bootstrapping(ctx) {
+		t.Fatal("still bootstrapping after a client was trusted")
+	}
+
+	cfg.Bootstrap = false
+	r.SetConfig(cfg)
+	if r.bootstrapped.Load() {
+		t.Fatal("a reload kept the bootstrap over, the thresholds may have changed")
+	}
+	if r.Bootstrapping(ctx) {
+		t.Fatal("bootstrapping with bootstrap off")
+	}
+}
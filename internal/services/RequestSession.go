@@ -2,23 +2,53 @@ package services
 
 import (
 	"container/heap"
+	"context"
 	"errors"
 	"net"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/MisterNorwood/SugarCube-Server/internal/database"
-	"github.com/go-co-op/gocron"
+	"github.com/MisterNorwood/SugarCube-Server/internal/utils"
+	"github.com/MisterNorwood/SugarCube-Server/pkg/types"
 	"github.com/google/uuid"
 )
 
+var (
+	ErrSessionNotFound = errors.New("session not found")
+	ErrSessionExpired  = errors.New("session expired")
+	ErrSessionsFull    = errors.New("session limit reached")
+	ErrSessionQuota    = errors.New("too many open sessions for this client")
+)
+
 type UserSession struct {
 	RequestUUID     uuid.UUID
 	UserIP          net.IP
 	ExpiryTimestamp time.Time
-	index           int
+	// What the session may report on, the callback is rejected for anything else
+	Site    string
+	Coupons map[string]struct{}
+	Region  string // Scored per region too when set
+	index   int    // Position in the heap, -1 once it's out
+}
+
+// Covers reports whether a callback for these results on site belongs to the session
+func (s *UserSession) Covers(site string, results map[string]bool) bool {
+	if site != s.Site {
+		return false
+	}
+	for code := range results {
+		if _, ok := s.Coupons[code]; !ok {
+			return false
+		}
+	}
+	return true
 }
 
+// SessionHeap orders sessions by expiry so the pruner only looks at expired ones.
+// Every session in the map is in the heap and the other way round.
 type SessionHeap []*UserSession
 
 func (h SessionHeap) Len() int           { return len(h) }
@@ -47,86 +77,246 @@ func (h *SessionHeap) Pop() any {
 
 type SessionManager struct {
 	sessions sync.Map
-	heap     *SessionHeap
-	heapMu   sync.Mutex
+	cfg      atomic.Pointer[utils.SessionConfig]
+	pruner   *PeriodicJob
+
+	// Guards the heap and the per-IP lists, the map is only written with it held
+	mu    sync.Mutex
+	heap  *SessionHeap
+	perIP map[string][]*UserSession // Open sessions of each IP, oldest first
+
+	created, consumed, expired, evicted, rejectedFull, rejectedQuota atomic.Uint64
 }
 
-func NewSessionManager() *SessionManager {
+func NewSessionManager(cfg utils.SessionConfig) *SessionManager {
 	h := &SessionHeap{}
 	heap.Init(h)
-	return &SessionManager{
+	sm := &SessionManager{
 		sessions: sync.Map{},
 		heap:     h,
+		perIP:    map[string][]*UserSession{},
+	}
+	sm.SetConfig(cfg)
+	return sm
+}
+
+// SetConfig changes the lifetime of sessions created from now on and the limits
+func (sm *SessionManager) SetConfig(cfg utils.SessionConfig) {
+	sm.cfg.Store(&cfg)
+}
+
+// TTL is the lifetime of new sessions on site
+func (sm *SessionManager) TTL(site string) time.Duration {
+	cfg := sm.cfg.Load()
+	if ttl, ok := cfg.SiteTTL[site]; ok {
+		return ttl
 	}
+	return cfg.TTL
 }
 
-func (sm *SessionManager) CreateSession(ip net.IP) uuid.UUID {
-	id := uuid.New()
-	expiry := time.Now().Add(5 * time.Minute)
+// CreateSession opens a session for testing coupons on site. It fails with ErrSessionQuota
+// when the client holds too many, and with ErrSessionsFull when the manager does and
+// the eviction policy is to reject.
+func (sm *SessionManager) CreateSession(ip net.IP, site, region string, coupons []string) (*UserSession, error) {
+	return sm.create(ip, site, region, coupons, false)
+}
 
+// create is CreateSession, with evictOwn a client at its quota loses its oldest session instead
+func (sm *SessionManager) create(ip net.IP, site, region string, coupons []string, evictOwn bool) (*UserSession, error) {
+	cfg := sm.cfg.Load()
+	codes := make(map[string]struct{}, len(coupons))
+	for _, code := range coupons {
+		codes[code] = struct{}{}
+	}
 	session := &UserSession{
-		RequestUUID:     id,
+		RequestUUID:     uuid.New(),
 		UserIP:          ip,
-		ExpiryTimestamp: expiry,
+		ExpiryTimestamp: time.Now().Add(sm.TTL(site)),
+		Site:            site,
+		Coupons:         codes,
+		Region:          region,
 	}
+	client := ip.String()
 
-	sm.sessions.Store(id, session)
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if cfg.MaxPerIP > 0 && uint64(len(sm.perIP[client])) >= cfg.MaxPerIP {
+		if !evictOwn {
+			sm.rejectedQuota.Add(1)
+			return nil, ErrSessionQuota
+		}
+		// The quota may have been lowered by a reload, so more than one can be over it
+		for uint64(len(sm.perIP[client])) >= cfg.MaxPerIP {
+			sm.remove(sm.perIP[client][0])
+			sm.evicted.Add(1)
+		}
+	}
+	if cfg.MaxSessions > 0 && uint64(sm.heap.Len()) >= cfg.MaxSessions {
+		if cfg.Eviction == utils.EvictReject || !sm.evictOne() {
+			sm.rejectedFull.Add(1)
+			return nil, ErrSessionsFull
+		}
+	}
 
-	sm.heapMu.Lock()
+	sm.sessions.Store(session.RequestUUID, session)
 	heap.Push(sm.heap, session)
-	sm.heapMu.Unlock()
+	sm.perIP[client] = append(sm.perIP[client], session)
+	sm.created.Add(1)
+	return session, nil
+}
 
-	return id
+// evictOne drops the session closest to expiring, sm.mu must be held
+func (sm *SessionManager) evictOne() bool {
+	if sm.heap.Len() == 0 {
+		return false
+	}
+	sm.remove((*sm.heap)[0])
+	sm.evicted.Add(1)
+	return true
 }
 
-func (sm *SessionManager) ValidateSession(id uuid.UUID) (bool, error) {
+// forget removes the session with the ID if it's open, sm.mu must be held
+func (sm *SessionManager) forget(id uuid.UUID) bool {
+	val, ok := sm.sessions.Load(id)
+	if ok {
+		sm.remove(val.(*UserSession))
+	}
+	return ok
+}
+
+// remove takes a session out of the map, the heap and the counts, sm.mu must be held
+func (sm *SessionManager) remove(session *UserSession) {
+	sm.sessions.Delete(session.RequestUUID)
+	heap.Remove(sm.heap, session.index)
+	client := session.UserIP.String()
+	open := slices.DeleteFunc(sm.perIP[client], func(s *UserSession) bool { return s == session })
+	if len(open) == 0 {
+		delete(sm.perIP, client)
+	} else {
+		sm.perIP[client] = open
+	}
+}
+
+// ValidateSession returns the session if it exists and hasn't expired
+func (sm *SessionManager) ValidateSession(id uuid.UUID) (*UserSession, error) {
 	val, ok := sm.sessions.Load(id)
 	if !ok {
-		return false, errors.New("session not found")
+		return nil, ErrSessionNotFound
 	}
 
 	session := val.(*UserSession)
 	if time.Now().After(session.ExpiryTimestamp) {
-		sm.RemoveSession(id)
-		return false, errors.New("session expired")
+		sm.mu.Lock()
+		if sm.forget(id) {
+			sm.expired.Add(1)
+		}
+		sm.mu.Unlock()
+		return nil, ErrSessionExpired
 	}
 
-	return true, nil
+	return session, nil
+}
+
+// Consume ends the session and returns it, once. Of concurrent callbacks with the same
+// session ID only one gets it, the others get ErrSessionNotFound.
+func (sm *SessionManager) Consume(id uuid.UUID) (*UserSession, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	val, ok := sm.sessions.Load(id)
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	session := val.(*UserSession)
+	sm.remove(session)
+	if time.Now().After(session.ExpiryTimestamp) {
+		sm.expired.Add(1)
+		return nil, ErrSessionExpired
+	}
+	sm.consumed.Add(1)
+	return session, nil
 }
 
+// RemoveSession ends a session once its callback came in
 func (sm *SessionManager) RemoveSession(id uuid.UUID) {
-	sm.sessions.Delete(id)
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if sm.forget(id) {
+		sm.consumed.Add(1)
+	}
 }
 
-func (sm *SessionManager) StartPruner() {
-	scheduler := gocron.NewScheduler(time.UTC)
-	scheduler.Every(3).Seconds().Do(func() {
-		now := time.Now()
+// Stats is a snapshot of the session counts, the totals are since startup
+func (sm *SessionManager) Stats() types.SessionStats {
+	cfg := sm.cfg.Load()
+	sm.mu.Lock()
+	active, clients := sm.heap.Len(), len(sm.perIP)
+	sm.mu.Unlock()
+	return types.SessionStats{
+		Active:        active,
+		Clients:       clients,
+		MaxSessions:   cfg.MaxSessions,
+		MaxPerIP:      cfg.MaxPerIP,
+		Created:       sm.created.Load(),
+		Consumed:      sm.consumed.Load(),
+		Expired:       sm.expired.Load(),
+		Evicted:       sm.evicted.Load(),
+		RejectedFull:  sm.rejectedFull.Load(),
+		RejectedQuota: sm.rejectedQuota.Load(),
+	}
+}
 
-		for {
-			sm.heapMu.Lock()
-			if sm.heap.Len() == 0 || (*sm.heap)[0].ExpiryTimestamp.After(now) {
-				sm.heapMu.Unlock()
-				break
-			}
+func (sm *SessionManager) StartPruner(interval time.Duration) {
+	sm.pruner = NewPeriodicJob("session-pruner", interval, sm.pruneExpired)
+	sm.pruner.Start()
+}
+
+// Shutdown stops the pruner, sessions are in memory so there is nothing to flush
+func (sm *SessionManager) Shutdown(ctx context.Context) error {
+	if sm.pruner == nil {
+		return nil
+	}
+	return sm.pruner.Shutdown(ctx)
+}
+
+func (sm *SessionManager) SetPruneInterval(interval time.Duration) {
+	if sm.pruner != nil {
+		sm.pruner.SetInterval(interval)
+	}
+}
 
-			expired := heap.Pop(sm.heap).(*UserSession)
-			sm.heapMu.Unlock()
+func (sm *SessionManager) pruneExpired(context.Context) {
+	now := time.Now()
 
-			sm.sessions.Delete(expired.RequestUUID)
+	for {
+		sm.mu.Lock()
+		if sm.heap.Len() == 0 || (*sm.heap)[0].ExpiryTimestamp.After(now) {
+			sm.mu.Unlock()
+			break
 		}
-	})
-	scheduler.StartAsync()
+
+		sm.remove((*sm.heap)[0])
+		sm.expired.Add(1)
+		sm.mu.Unlock()
+	}
 }
 
-func (sm *SessionManager) CreateResponseGetSite(ip net.IP, site database.Site) SiteGetRequestResponse {
+// CreateResponseGetSite is the v1 coupon list, which opens a session for every coupon on it.
+// Every read opens one, so a shared IP at its quota loses its oldest session rather than
+// getting no list.
+func (sm *SessionManager) CreateResponseGetSite(ip net.IP, site database.Site, region string) (SiteGetRequestResponse, error) {
+	coupons := make([]string, 0, len(site.CouponEntries))
+	for _, entry := range site.CouponEntries {
+		coupons = append(coupons, entry.Coupon)
+	}
+	session, err := sm.create(ip, site.Name, region, coupons, true)
+	if err != nil {
+		return SiteGetRequestResponse{}, err
+	}
 	return SiteGetRequestResponse{
-		RequestUUID:   sm.CreateSession(ip),
+		RequestUUID:   session.RequestUUID,
 		RequestedSite: site,
-	}
+	}, nil
 }
 
-type SiteGetRequestResponse struct {
-	RequestUUID   uuid.UUID     `json:"RequestID"`
-	RequestedSite database.Site `json:"Site"`
-}
+// Shared with pkg/client
+type SiteGetRequestResponse = types.SiteGetRequestResponse
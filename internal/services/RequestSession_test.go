@@ -0,0 +1,284 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MisterNorwood/SugarCube-Server/internal/database"
+	"github.com/MisterNorwood/SugarCube-Server/internal/utils"
+	"github.com/google/uuid"
+)
+
+// checkSessions verifies the heap, the map and the counts describe the same sessions
+func checkSessions(t *testing.T, sm *SessionManager) {
+	t.Helper()
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	perIP := map[string]int{}
+	for i, session := range *sm.heap {
+		if session.index != i {
+			t.Fatalf("session at %d has index %d", i, session.index)
+		}
+		if parent := (i - 1) / 2; i > 0 && session.ExpiryTimestamp.Before((*sm.heap)[parent].ExpiryTimestamp) {
+			t.Fatalf("session at %d expires before its parent at %d", i, parent)
+		}
+		if val, ok := sm.sessions.Load(session.RequestUUID); !ok || val.(*UserSession) != session {
+			t.Fatalf("session at %d is missing from the map", i)
+		}
+		perIP[session.UserIP.String()]++
+	}
+
+	mapped := 0
+	sm.sessions.Range(func(_, val any) bool {
+		if val.(*UserSession).index < 0 {
+			t.Errorf("session %s is in the map but not the heap", val.(*UserSession).RequestUUID)
+		}
+		mapped++
+		return true
+	})
+	if mapped != sm.heap.Len() {
+		t.Fatalf("map holds %d sessions, heap %d", mapped, sm.heap.Len())
+	}
+
+	if len(perIP) != len(sm.perIP) {
+		t.Fatalf("%d IPs hold sessions, perIP counts %d", len(perIP), len(sm.perIP))
+	}
+	for ip, count := range perIP {
+		if len(sm.perIP[ip]) != count {
+			t.Fatalf("perIP[%s] holds %d, %d sessions are open", ip, len(sm.perIP[ip]), count)
+		}
+		for _, session := range sm.perIP[ip] {
+			if session.index < 0 || session.UserIP.String() != ip {
+				t.Fatalf("perIP[%s] holds a closed or foreign session", ip)
+			}
+		}
+	}
+}
+
+func TestSessionManagerConcurrent(t *testing.T) {
+	sm := NewSessionManager(utils.SessionConfig{
+		TTL:         time.Hour,
+		SiteTTL:     map[string]time.Duration{"short.example": time.Millisecond},
+		MaxSessions: 200,
+		Eviction:    utils.EvictOldest,
+		MaxPerIP:    40,
+	})
+	sites := []string{"example.com", "short.example"}
+
+	const workers, rounds = 16, 2000
+	var wg sync.WaitGroup
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var open []uuid.UUID
+			for i := range rounds {
+				ip := net.IPv4(10, 0, byte(w), byte(i%8))
+				session, err := sm.create(ip, sites[i%len(sites)], "", []string{"SAVE10"}, i%4 == 0)
+				switch {
+				case err == nil:
+					open = append(open, session.RequestUUID)
+				case !errors.Is(err, ErrSessionQuota) && !errors.Is(err, ErrSessionsFull):
+					t.Errorf("unexpected error: %v", err)
+					return
+				}
+				if len(open) == 0 {
+					continue
+				}
+				n := rand.IntN(len(open))
+				id := open[n]
+				switch rand.IntN(3) {
+				case 0:
+					_, _ = sm.ValidateSession(id)
+				case 1:
+					sm.RemoveSession(id)
+					open = append(open[:n], open[n+1:]...)
+				}
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	pruned := make(chan struct{})
+	go func() {
+		defer close(pruned)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				sm.pruneExpired(context.Background())
+				_ = sm.Stats()
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(done)
+	<-pruned
+
+	checkSessions(t, sm)
+	stats := sm.Stats()
+	if stats.Active != sm.heap.Len() || stats.Clients != len(sm.perIP) {
+		t.Fatalf("stats report %d sessions from %d IPs, manager holds %d from %d", stats.Active, stats.Clients, sm.heap.Len(), len(sm.perIP))
+	}
+	if closed := stats.Consumed + stats.Expired + stats.Evicted; stats.Created-closed != uint64(stats.Active) {
+		t.Fatalf("created %d, closed %d, but %d are open", stats.Created, closed, stats.Active)
+	}
+	if stats.MaxSessions > 0 && uint64(stats.Active) > stats.MaxSessions {
+		t.Fatalf("%d sessions open, limit is %d", stats.Active, stats.MaxSessions)
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	sm.pruneExpired(context.Background())
+	checkSessions(t, sm)
+}
+
+func benchmarkManager(ttl time.Duration) *SessionManager {
+	return NewSessionManager(utils.SessionConfig{TTL: ttl, Eviction: utils.EvictOldest})
+}
+
+func benchmarkIP(i int) net.IP {
+	return net.IPv4(10, byte(i>>16), byte(i>>8), byte(i))
+}
+
+func BenchmarkCreateSession(b *testing.B) {
+	sm := benchmarkManager(time.Hour)
+	coupons := []string{"SAVE10", "FREESHIP"}
+	i := 0
+	for b.Loop() {
+		if _, err := sm.CreateSession(benchmarkIP(i), "example.com", "", coupons); err != nil {
+			b.Fatal(err)
+		}
+		i++
+	}
+}
+
+// Removes sessions in random order, so most come out of the middle of the heap
+func BenchmarkRemoveSession(b *testing.B) {
+	sm := benchmarkManager(time.Hour)
+	ids := make([]uuid.UUID, b.N)
+	for i := range ids {
+		session, err := sm.CreateSession(benchmarkIP(i), "example.com", "", nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		ids[i] = session.RequestUUID
+	}
+	rand.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+
+	b.ResetTimer()
+	for _, id := range ids {
+		sm.RemoveSession(id)
+	}
+}
+
+func BenchmarkPruneExpired(b *testing.B) {
+	sm := benchmarkManager(-time.Second)
+	for i := range b.N {
+		if _, err := sm.CreateSession(benchmarkIP(i), "example.com", "", nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ResetTimer()
+	sm.pruneExpired(context.Background())
+}
+
+func TestReadSessionsEvictOwnOldest(t *testing.T) {
+	sm := NewSessionManager(utils.SessionConfig{TTL: time.Hour, Eviction: utils.EvictOldest, MaxPerIP: 2})
+	shared, other := net.IPv4(100, 64, 0, 1), net.IPv4(100, 64, 0, 2)
+	site := database.Site{Name: "example.com", CouponEntries: []database.CouponEntry{{Coupon: "SAVE10"}}}
+
+	neighbour, err := sm.CreateSession(other, "example.com", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reads []uuid.UUID
+	for range 5 {
+		response, err := sm.CreateResponseGetSite(shared, site, "")
+		if err != nil {
+			t.Fatalf("v1 read at the quota failed: %v", err)
+		}
+		reads = append(reads, response.RequestUUID)
+	}
+	checkSessions(t, sm)
+
+	for i, id := range reads {
+		_, err := sm.ValidateSession(id)
+		if open := i >= len(reads)-2; open != (err == nil) {
+			t.Fatalf("read %d open is %v, want %v", i, err == nil, open)
+		}
+	}
+	if _, err := sm.ValidateSession(neighbour.RequestUUID); err != nil {
+		t.Fatalf("another IP's session was evicted: %v", err)
+	}
+	if _, err := sm.CreateSession(shared, "example.com", "", nil); !errors.Is(err, ErrSessionQuota) {
+		t.Fatalf("POST /api/session at the quota got %v, want ErrSessionQuota", err)
+	}
+	if stats := sm.Stats(); stats.Evicted != 3 || stats.RejectedQuota != 1 {
+		t.Fatalf("evicted %d and rejected %d, want 3 and 1", stats.Evicted, stats.RejectedQuota)
+	}
+}
+
+func TestConsumeConcurrentReplay(t *testing.T) {
+	sm := NewSessionManager(utils.SessionConfig{TTL: time.Hour, Eviction: utils.EvictOldest})
+	session, err := sm.CreateSession(net.IPv4(192, 0, 2, 1), "example.com", "", []string{"SAVE10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const replays = 64
+	var wg sync.WaitGroup
+	var won atomic.Int32
+	start := make(chan struct{})
+	for range replays {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			got, err := sm.Consume(session.RequestUUID)
+			switch {
+			case err == nil && got == session:
+				won.Add(1)
+			case !errors.Is(err, ErrSessionNotFound):
+				t.Errorf("replay got %v", err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if won.Load() != 1 {
+		t.Fatalf("%d callbacks consumed the session, want 1", won.Load())
+	}
+	checkSessions(t, sm)
+	if stats := sm.Stats(); stats.Consumed != 1 || stats.Active != 0 {
+		t.Fatalf("consumed %d with %d open, want 1 and 0", stats.Consumed, stats.Active)
+	}
+}
+
+func TestConsumeExpired(t *testing.T) {
+	sm := NewSessionManager(utils.SessionConfig{TTL: -time.Second, Eviction: utils.EvictOldest})
+	session, err := sm.CreateSession(net.IPv4(192, 0, 2, 1), "example.com", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sm.Consume(session.RequestUUID); !errors.Is(err, ErrSessionExpired) {
+		t.Fatalf("got %v, want ErrSessionExpired", err)
+	}
+	if _, err := sm.Consume(session.RequestUUID); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("second try got %v, want ErrSessionNotFound", err)
+	}
+	checkSessions(t, sm)
+	if stats := sm.Stats(); stats.Expired != 1 || stats.Consumed != 0 {
+		t.Fatalf("expired %d and consumed %d, want 1 and 0", stats.Expired, stats.Consumed)
+	}
+}
@@ -0,0 +1,119 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/MisterNorwood/SugarCube-Server/internal/utils"
+	"github.com/MisterNorwood/SugarCube-Server/pkg/types"
+)
+
+// SiteCache keeps the coupon lists GET /api/coupons serves, per site and with or without
+// pending coupons. Writes through this instance invalidate their site right away, writes
+// through other instances when the coupon feed sees them or when the entry expires.
+type SiteCache struct {
+	cfg atomic.Pointer[utils.CacheConfig]
+
+	mu      sync.Mutex
+	entries map[siteCacheKey]*CachedSite
+	// Bumped by Invalidate, a list loaded while its site changed isn't stored
+	versions map[string]uint64
+}
+
+type siteCacheKey struct {
+	site           string
+	includePending bool
+}
+
+type CachedSite struct {
+	Site types.Site
+	// Version of the list, a hash of its content, so every instance serving the same list agrees on it
+	ETag    string
+	expires time.Time
+}
+
+func NewSiteCache(cfg utils.CacheConfig) *SiteCache {
+	sc := &SiteCache{entries: map[siteCacheKey]*CachedSite{}, versions: map[string]uint64{}}
+	sc.SetConfig(cfg)
+	return sc
+}
+
+// MaxAge is how long clients and shared caches may reuse a coupon list
+func (sc *SiteCache) MaxAge() time.Duration {
+	return sc.cfg.Load().MaxAge
+}
+
+func (sc *SiteCache) SetConfig(cfg utils.CacheConfig) {
+	sc.cfg.Store(&cfg)
+	if cfg.TTL == 0 {
+		sc.mu.Lock()
+		clear(sc.entries)
+		sc.mu.Unlock()
+	}
+}
+
+// Get returns the cached list or loads it. Load errors aren't cached.
+func (sc *SiteCache) Get(ctx context.Context, site string, includePending bool, load func(context.Context) (*types.Site, error)) (*CachedSite, error) {
+	cfg := sc.cfg.Load()
+	key := siteCacheKey{site, includePending}
+	now := time.Now()
+
+	sc.mu.Lock()
+	entry, ok := sc.entries[key]
+	version := sc.versions[site]
+	sc.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry, nil
+	}
+
+	loaded, err := load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(loaded)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	entry = &CachedSite{
+		Site:    *loaded,
+		ETag:    `"` + hex.EncodeToString(sum[:16]) + `"`,
+		expires: now.Add(cfg.TTL),
+	}
+	if cfg.TTL == 0 {
+		return entry, nil
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if uint64(len(sc.entries)) >= cfg.MaxSites {
+		sc.evictExpired(now)
+	}
+	if sc.versions[site] == version && uint64(len(sc.entries)) < cfg.MaxSites {
+		sc.entries[key] = entry
+	}
+	return entry, nil
+}
+
+// Invalidate drops the cached lists of a site, call it after every change to its coupons
+func (sc *SiteCache) Invalidate(site string) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	delete(sc.entries, siteCacheKey{site, false})
+	delete(sc.entries, siteCacheKey{site, true})
+	sc.versions[site]++
+}
+
+// evictExpired makes room when the cache is full, sc.mu must be held
+func (sc *SiteCache) evictExpired(now time.Time) {
+	for key, entry := range sc.entries {
+		if !now.Before(entry.expires) {
+			delete(sc.entries, key)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/MisterNorwood/SugarCube-Server/internal/database"
+	"github.com/MisterNorwood/SugarCube-Server/internal/utils"
+	"github.com/MisterNorwood/SugarCube-Server/pkg/types"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+var ErrCaseNotFound = errors.New("quarantine case not found")
+
+// VoteGuard screens callback votes before they touch a score. A client and an IP get one vote
+// per site and coupon per window, so minting sessions or installs doesn't buy more votes. A burst of failure
+// votes on one coupon from few IPs opens a quarantine case; failure votes on that coupon are
+// then held in the case until an admin approves or rejects them.
+type VoteGuard struct {
+	db  *mongo.Database
+	cfg atomic.Pointer[utils.VoteConfig]
+}
+
+type quarantineCase struct {
+	ID          bson.ObjectID `bson:"_id,omitempty"`
+	Site        string        `bson:"site"`
+	Coupon      string        `bson:"coupon"`
+	Status      string        `bson:"status"`
+	Votes       int           `bson:"votes"`
+	IPs         []string      `bson:"ips"`
+	ScoreChange float64       `bson:"score_change"`
+	Held        []HeldVote    `bson:"held,omitempty"` // Cases from before held votes were kept only have ScoreChange
+	CreatedAt   time.Time     `bson:"created_at"`
+	UpdatedAt   time.Time     `bson:"updated_at"`
+}
+
+// HeldVote is a vote held back in a quarantine case, with what ProcessCallback needs to
+// apply it as it would have been
+type HeldVote struct {
+	Voter          string  `bson:"voter"`
+	IP             string  `bson:"ip"`
+	Region         string  `bson:"region,omitempty"`
+	Worked         bool    `bson:"worked"`
+	Weight         float64 `bson:"weight"`
+	IncludePending bool    `bson:"include_pending,omitempty"`
+	// From a v2 callback that sent a report on the code
+	Report *types.CouponReport `bson:"report,omitempty"`
+	At     time.Time           `bson:"at"`
+}
+
+// Vote is the held vote on code as ProcessCallback takes it
+func (v HeldVote) Vote(code string) database.Vote {
+	var reports map[string]types.CouponReport
+	if v.Report != nil {
+		reports = map[string]types.CouponReport{code: *v.Report}
+	}
+	return database.Vote{
+		Results:        map[string]bool{code: v.Worked},
+		Reports:        reports,
+		Region:         v.Region,
+		Weight:         v.Weight,
+		Voter:          v.Voter,
+		IncludePending: v.IncludePending,
+	}
+}
+
+// A case closed by Resolve
+type ResolvedCase struct {
+	Site        string
+	Coupon      string
+	Votes       []HeldVote
+	ScoreChange float64
+}
+
+const (
+	caseOpen     = "open"
+	caseApproved = "approved"
+	caseRejected = "rejected"
+)
+
+func NewVoteGuard(db *mongo.Database, cfg utils.VoteConfig) *VoteGuard {
+	g := &VoteGuard{db: db}
+	g.SetConfig(cfg)
+	return g
+}
+
+func (g *VoteGuard) SetConfig(cfg utils.VoteConfig) {
+	g.cfg.Store(&cfg)
+}
+
+func (g *VoteGuard) votes() *mongo.Collection {
+	return g.db.Collection("votes")
+}
+
+// One document per IP, site and coupon, kept apart from the votes so the burst counts stay per vote
+func (g *VoteGuard) ipVotes() *mongo.Collection {
+	return g.db.Collection("vote_ips")
+}
+
+func (g *VoteGuard) cases() *mongo.Collection {
+	return g.db.Collection("vote_quarantine")
+}
+
+func (g *VoteGuard) EnsureIndexes(ctx context.Context) error {
+	_, err := g.votes().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		{Keys: bson.D{{Key: "site", Value: 1}, {Key: "coupon", Value: 1}, {Key: "voted_at", Value: 1}}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = g.ipVotes().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = g.cases().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "site", Value: 1}, {Key: "coupon", Value: 1}, {Key: "status", Value: 1}},
+	})
+	return err
+}
+
+// Screen splits a callback's results into the votes that count now and the coupons whose
+// failure votes go into quarantine. Duplicate votes are dropped. Lookup errors let the vote
+// through, the reputation weighting still applies to it.
+func (g *VoteGuard) Screen(ctx context.Context, voter, ip, site string, results map[string]bool) (accepted map[string]bool, quarantined []string) {
+	accepted = map[string]bool{}
+	for code, worked := range results {
+		fresh, err := g.record(ctx, voter, ip, site, code, worked)
+		if err != nil {
+			log.Warn().Ctx(ctx).Err(err).Msg("Failed to record vote")
+		} else if !fresh {
+			log.Info().
+				Ctx(ctx).
+				Str("site", utils.RedactSite(site)).
+				Str("coupon", utils.RedactCoupon(code)).
+				Msg("Dropped duplicate vote")
+			continue
+		}
+
+		if !worked && g.suspicious(ctx, site, code) {
+			quarantined = append(quarantined, code)
+			continue
+		}
+		accepted[code] = worked
+	}
+	return accepted, quarantined
+}
+
+// record stores the vote and reports false if the client or its IP already voted on the coupon within the window.
+// There is one document per client, site and coupon, the last counted vote, until it expires,
+// and one per IP, site and coupon claiming the IP's vote.
+func (g *VoteGuard) record(ctx context.Context, voter, ip, site, code string, worked bool) (bool, error) {
+	now := time.Now().UTC()
+	expires := now.Add(g.cfg.Load().DedupWindow)
+	fresh, err := claim(ctx, g.ipVotes(), ip+"|"+site+"|"+code, now, bson.M{"voted_at": now, "expires_at": expires})
+	if !fresh || err != nil {
+		return fresh, err
+	}
+	return claim(ctx, g.votes(), voter+"|"+site+"|"+code, now, bson.M{
+		"voter":      voter,
+		"ip":         ip,
+		"site":       site,
+		"coupon":     code,
+		"worked":     worked,
+		"voted_at":   now,
+		"expires_at": expires,
+	})
+}
+
+// claim upserts the document and reports false if an unexpired one with the ID exists
+func claim(ctx context.Context, coll *mongo.Collection, id string, now time.Time, set bson.M) (bool, error) {
+	// Matches only an expired record, so an unexpired one makes the upsert collide on _id
+	_, err := coll.UpdateOne(ctx,
+		bson.M{"_id": id, "expires_at": bson.M{"$lte": now}},
+		bson.M{"$set": set},
+		options.UpdateOne().SetUpsert(true),
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// suspicious reports whether failure votes on the coupon should be held back: a case is
+// already open, or this vote completes a burst from few IPs and opens one
+func (g *VoteGuard) suspicious(ctx context.Context, site, code string) bool {
+	cfg := g.cfg.Load()
+	err := g.cases().FindOne(ctx, bson.M{"site": site, "coupon": code, "status": caseOpen}).Err()
+	if err == nil {
+		return true
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		log.Warn().Ctx(ctx).Err(err).Msg("Failed to look up quarantine cases")
+		return false
+	}
+
+	filter := bson.M{"site": site, "coupon": code, "worked": false, "voted_at": bson.M{"$gte": time.Now().Add(-cfg.BurstWindow)}}
+	failures, err := g.votes().CountDocuments(ctx, filter)
+	if err != nil || uint64(failures) < cfg.BurstFailures {
+		return false
+	}
+	var ips []string
+	if err := g.votes().Distinct(ctx, "ip", filter).Decode(&ips); err != nil {
+		log.Warn().Ctx(ctx).Err(err).Msg("Failed to count vote sources")
+		return false
+	}
+	if uint64(len(ips)) > cfg.BurstMaxSources {
+		return false
+	}
+
+	log.Warn().
+		Ctx(ctx).
+		Str("site", utils.RedactSite(site)).
+		Str("coupon", utils.RedactCoupon(code)).
+		Int64("failures", failures).
+		Int("sources", len(ips)).
+		Msg("Failure vote burst, quarantining votes on the coupon")
+	return true
+}
+
+// Quarantine holds a vote back in the coupon's open case, opening one if needed
+func (g *VoteGuard) Quarantine(ctx context.Context, site, code string, vote HeldVote) error {
+	now := time.Now().UTC()
+	vote.At = now
+	change := vote.Weight
+	if !vote.Worked {
+		change = -change
+	}
+	_, err := g.cases().UpdateOne(ctx,
+		bson.M{"site": site, "coupon": code, "status": caseOpen},
+		bson.M{
+			"$inc":         bson.M{"votes": 1, "score_change": change},
+			"$addToSet":    bson.M{"ips": vote.IP},
+			"$push":        bson.M{"held": vote},
+			"$set":         bson.M{"updated_at": now},
+			"$setOnInsert": bson.M{"created_at": now},
+		},
+		options.UpdateOne().SetUpsert(true),
+	)
+	return err
+}
+
+// MoveVotes moves the votes and quarantine cases of merged coupons to the coupon they were
+// merged into, so bursts and reviews see them together. Duplicate checks still go by the
+// code that was voted on until those votes expire.
+func (g *VoteGuard) MoveVotes(ctx context.Context, site string, from []string, to string) error {
+	filter := bson.M{"site": site, "coupon": bson.M{"$in": from}}
+	update := bson.M{"$set": bson.M{"coupon": to}}
+	if _, err := g.votes().UpdateMany(ctx, filter, update); err != nil {
+		return err
+	}
+	_, err := g.cases().UpdateMany(ctx, filter, update)
+	return err
+}
+
+// OpenCases lists the cases waiting for review, oldest first
+func (g *VoteGuard) OpenCases(ctx context.Context) ([]types.QuarantineCase, error) {
+	cur, err := g.cases().Find(ctx, bson.M{"status": caseOpen}, options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var cases []quarantineCase
+	if err := cur.All(ctx, &cases); err != nil {
+		return nil, err
+	}
+
+	result := make([]types.QuarantineCase, 0, len(cases))
+	for _, c := range cases {
+		result = append(result, types.QuarantineCase{
+			ID:          c.ID.Hex(),
+			Site:        c.Site,
+			Coupon:      c.Coupon,
+			Votes:       c.Votes,
+			Sources:     len(c.IPs),
+			ScoreChange: c.ScoreChange,
+			CreatedAt:   c.CreatedAt,
+			UpdatedAt:   c.UpdatedAt,
+		})
+	}
+	return result, nil
+}
+
+// Resolve closes an open case and returns it. Approving leaves applying its votes to the
+// caller, rejecting discards them.
+func (g *VoteGuard) Resolve(ctx context.Context, id string, approve bool) (*ResolvedCase, error) {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrCaseNotFound
+	}
+	status := caseRejected
+	if approve {
+		status = caseApproved
+	}
+
+	var resolved quarantineCase
+	err = g.cases().FindOneAndUpdate(ctx,
+		bson.M{"_id": objectID, "status": caseOpen},
+		bson.M{"$set": bson.M{"status": status, "updated_at": time.Now().UTC()}},
+	).Decode(&resolved)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrCaseNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ResolvedCase{Site: resolved.Site, Coupon: resolved.Coupon, Votes: resolved.Held, ScoreChange: resolved.ScoreChange}, nil
+}
@@ -0,0 +1,54 @@
+package telemetry
+
+import (
+	"context"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/v2/event"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type commandKey struct {
+	connectionID string
+	requestID    int64
+}
+
+// NewMongoMonitor returns a command monitor that opens a client span for every
+// Mongo command, parented to whatever span is on the operation's context.
+func NewMongoMonitor() *event.CommandMonitor {
+	var spans sync.Map
+
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, evt *event.CommandStartedEvent) {
+			_, span := Tracer().Start(ctx, evt.CommandName+" "+evt.DatabaseName,
+				trace.WithSpanKind(trace.SpanKindClient),
+				trace.WithAttributes(
+					semconv.DBSystemMongoDB,
+					semconv.DBNamespace(evt.DatabaseName),
+					semconv.DBOperationName(evt.CommandName),
+					attribute.String("db.mongodb.connection_id", evt.ConnectionID),
+				),
+			)
+			if collection, ok := evt.Command.Lookup(evt.CommandName).StringValueOK(); ok {
+				span.SetAttributes(semconv.DBCollectionName(collection))
+			}
+			spans.Store(commandKey{evt.ConnectionID, evt.RequestID}, span)
+		},
+		Succeeded: func(ctx context.Context, evt *event.CommandSucceededEvent) {
+			if s, ok := spans.LoadAndDelete(commandKey{evt.ConnectionID, evt.RequestID}); ok {
+				s.(trace.Span).End()
+			}
+		},
+		Failed: func(ctx context.Context, evt *event.CommandFailedEvent) {
+			if s, ok := spans.LoadAndDelete(commandKey{evt.ConnectionID, evt.RequestID}); ok {
+				span := s.(trace.Span)
+				span.RecordError(evt.Failure)
+				span.SetStatus(codes.Error, evt.Failure.Error())
+				span.End()
+			}
+		},
+	}
+}
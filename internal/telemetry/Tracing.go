@@ -0,0 +1,101 @@
+package telemetry
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strings"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	TracerName     = "github.com/MisterNorwood/SugarCube-Server"
+	ServiceName    = "sugarcube-server"
+	ServiceVersion = "1.0.0"
+
+	// Span attribute keys shared across middleware, handlers and database
+	AttrSite          = "sugarcube.site"
+	AttrCouponCount   = "sugarcube.coupon_count"
+	AttrBanHit        = "sugarcube.ban_hit"
+	AttrSessionIDHash = "sugarcube.session_id_hash"
+	AttrRequestID     = "sugarcube.request_id"
+)
+
+type TracingConfig struct {
+	Endpoint    string  `yaml:"endpoint"`     // OTLP/HTTP collector, e.g. "localhost:4318" or "http://otel:4318"
+	SampleRatio float64 `yaml:"sample_ratio"` // 0..1, applied to root spans only
+	Insecure    bool    `yaml:"insecure"`     // Use plain HTTP when the endpoint has no scheme
+}
+
+// Tracer returns the application tracer from the global provider.
+// When tracing is disabled this is a no-op tracer.
+func Tracer() trace.Tracer {
+	return otel.Tracer(TracerName)
+}
+
+// InitTracer installs the global tracer provider and propagator.
+// An empty endpoint leaves tracing disabled; the returned shutdown func is always safe to call.
+func InitTracer(ctx context.Context, cfg TracingConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	if cfg.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx, exporterOptions(cfg)...)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(ServiceName),
+		semconv.ServiceVersion(ServiceVersion),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+func exporterOptions(cfg TracingConfig) []otlptracehttp.Option {
+	if strings.Contains(cfg.Endpoint, "://") {
+		if u, err := url.Parse(cfg.Endpoint); err == nil && u.Scheme == "http" {
+			return []otlptracehttp.Option{otlptracehttp.WithEndpointURL(cfg.Endpoint), otlptracehttp.WithInsecure()}
+		}
+		return []otlptracehttp.Option{otlptracehttp.WithEndpointURL(cfg.Endpoint)}
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Endpoint)}
+	if cfg.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	return opts
+}
+
+// HashSessionID returns a short, non-reversible identifier for a session UUID
+// so traces can correlate a GET with its callback without exposing the token.
+func HashSessionID(id uuid.UUID) string {
+	sum := sha256.Sum256(id[:])
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,483 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/MisterNorwood/SugarCube-Server/internal/telemetry"
+	"github.com/MisterNorwood/SugarCube-Server/pkg/types"
+	"gopkg.in/yaml.v3"
+)
+
+// Configuration is layered: flags > env > config file > defaults.
+// Every field has a yaml key; the same dotted path is used in validation errors.
+type SessionCtx struct {
+	ConfigFile string `yaml:"-"`
+
+	Debug      bool                    `yaml:"debug"`
+	Server     ServerConfig            `yaml:"server"`
+	DB         DBConfig                `yaml:"db"`
+	Log        LogConfig               `yaml:"log"`
+	Tracing    telemetry.TracingConfig `yaml:"tracing"`
+	Schedulers SchedulerConfig         `yaml:"schedulers"`
+	Sessions   SessionConfig           `yaml:"sessions"`
+	Blocklist  BlocklistConfig         `yaml:"blocklist"`
+	RateLimit  RateLimitConfig         `yaml:"rate_limit"`
+	CORS       CORSConfig              `yaml:"cors"`
+	Admin      AdminConfig             `yaml:"admin"`
+	API        APIConfig               `yaml:"api"`
+	Auth       AuthConfig              `yaml:"auth"`
+	Reputation ReputationConfig        `yaml:"reputation"`
+	Votes      VoteConfig              `yaml:"votes"`
+	Stream     StreamConfig            `yaml:"stream"`
+	Cache      CacheConfig             `yaml:"cache"`
+	GeoIP      GeoIPConfig             `yaml:"geoip"`
+	Coupons    CouponConfig            `yaml:"coupons"`
+}
+
+type ServerConfig struct {
+	Port uint16 `yaml:"port"`
+}
+
+// Either a full connection string in URI, or the structured fields below.
+// Options set here are added to the URI unless it already sets them.
+type DBConfig struct {
+	URI            string      `yaml:"uri"`
+	Host           string      `yaml:"host"` // Comma separated for a replica set seed list
+	Port           uint16      `yaml:"port"`
+	SRV            bool        `yaml:"srv"`
+	User           string      `yaml:"user"`
+	Password       string      `yaml:"password"`
+	PasswordFile   string      `yaml:"password_file"` // Docker or Kubernetes secret, "-" reads stdin
+	AuthSource     string      `yaml:"auth_source"`
+	ReplicaSet     string      `yaml:"replica_set"`
+	ReadPreference string      `yaml:"read_preference"`
+	TLS            DBTLSConfig `yaml:"tls"`
+}
+
+type SchedulerConfig struct {
+	BlocklistInterval    time.Duration `yaml:"blocklist_interval"`
+	CouponPruneInterval  time.Duration `yaml:"coupon_prune_interval"`
+	SessionPruneInterval time.Duration `yaml:"session_prune_interval"`
+}
+
+type SessionConfig struct {
+	TTL         time.Duration            `yaml:"ttl"`          // How long a client has to send the callback for a coupon list
+	SiteTTL     map[string]time.Duration `yaml:"site_ttl"`     // Overrides TTL for sites with slow checkouts
+	MaxSessions uint64                   `yaml:"max_sessions"` // Open sessions across all clients, 0 is unlimited
+	Eviction    string                   `yaml:"eviction"`     // At max_sessions: oldest or reject
+	MaxPerIP    uint64                   `yaml:"max_per_ip"`   // Open sessions per client IP, v1 reads over it close the oldest, 0 is unlimited
+}
+
+// Values of sessions.eviction
+const (
+	EvictOldest = "oldest" // A new session pushes out the one closest to expiring
+	EvictReject = "reject" // New sessions are refused until some expire
+)
+
+type BlocklistConfig struct {
+	Enabled bool     `yaml:"enabled"`
+	Sources []string `yaml:"sources"`
+}
+
+// Per client IP token bucket
+type RateLimitConfig struct {
+	Enabled           bool          `yaml:"enabled"`
+	RequestsPerSecond float64       `yaml:"requests_per_second"`
+	Burst             uint64        `yaml:"burst"`
+	ExpiresIn         time.Duration `yaml:"expires_in"` // Forget idle clients after this long
+}
+
+type CORSConfig struct {
+	AllowOrigins []string `yaml:"allow_origins"`
+	MaxAge       uint64   `yaml:"max_age"` // Seconds browsers may cache a preflight
+}
+
+type AdminConfig struct {
+	APIKeys     []string `yaml:"api_keys"`
+	APIKeysFile string   `yaml:"api_keys_file"` // One key per line or comma separated
+}
+
+// Install tokens, handed out by POST /api/register
+type AuthConfig struct {
+	TokenSecrets        []string `yaml:"token_secrets"`         // First signs new tokens, all verify, so secrets can be rotated
+	TokenSecretsFile    string   `yaml:"token_secrets_file"`    // One secret per line
+	RequireInstallToken bool     `yaml:"require_install_token"` // Off lets builds from before registration keep writing, the default for now
+	RegistrationsPerIP  uint64   `yaml:"registrations_per_ip"`  // New installs per IP per hour, 0 is unlimited
+}
+
+// Reputation weights callback votes and decides whose submissions go live right away.
+// Scores are between 0 and 1, new clients start at 0.5.
+type ReputationConfig struct {
+	Enabled      bool    `yaml:"enabled"`
+	TrustedAbove float64 `yaml:"trusted_above"` // Clients at or above submit live coupons, installs at or above see pending ones
+	MinOutcomes  uint64  `yaml:"min_outcomes"`  // Votes and submissions a client needs on record before it can be trusted
+	PromoteScore float64 `yaml:"promote_score"` // Score a pending coupon needs from trusted votes to go live
+	Bootstrap    bool    `yaml:"bootstrap"`     // Trust every client until one is trusted on its own, or nobody ever would be
+}
+
+// Callback vote screening. A burst is at least BurstFailures failure votes on one coupon
+// within BurstWindow from at most BurstMaxSources IPs.
+type VoteConfig struct {
+	DedupWindow     time.Duration `yaml:"dedup_window"` // One vote per client and per IP, site and coupon within this
+	BurstWindow     time.Duration `yaml:"burst_window"`
+	BurstFailures   uint64        `yaml:"burst_failures"`
+	BurstMaxSources uint64        `yaml:"burst_max_sources"`
+}
+
+// GET /api/coupons/stream
+type StreamConfig struct {
+	MaxSubscribers uint64        `yaml:"max_subscribers"` // Open streams across all sites, more get 503
+	MaxPerIP       uint64        `yaml:"max_per_ip"`      // Open streams of one IP, more get 429, 0 is unlimited
+	Heartbeat      time.Duration `yaml:"heartbeat"`       // Keeps idle connections open through proxies
+}
+
+// Read cache of GET /api/coupons, per instance
+type CacheConfig struct {
+	TTL      time.Duration `yaml:"ttl"`       // 0 disables the cache
+	MaxSites uint64        `yaml:"max_sites"` // Lists beyond this aren't cached until entries expire
+	MaxAge   time.Duration `yaml:"max_age"`   // Cache-Control max-age of v2 coupon lists
+}
+
+// How codes submitted to a site are matched against the ones it has
+type CouponConfig struct {
+	CaseSensitive     bool            `yaml:"case_sensitive"`      // Whether save10 and SAVE10 are different coupons
+	SiteCaseSensitive map[string]bool `yaml:"site_case_sensitive"` // Overrides case_sensitive by site
+}
+
+// CaseSensitiveFor reports whether the site tells codes apart by case
+func (c CouponConfig) CaseSensitiveFor(site string) bool {
+	if caseSensitive, ok := c.SiteCaseSensitive[site]; ok {
+		return caseSensitive
+	}
+	return c.CaseSensitive
+}
+
+// Country lookup for coupon lists requested without a region, read once at startup
+type GeoIPConfig struct {
+	Database string `yaml:"database"` // MaxMind DB file, e.g. GeoLite2-Country.mmdb. Empty disables the lookup
+}
+
+// Deprecation schedule by API version, e.g. api.versions.v1.sunset
+type APIConfig struct {
+	Versions map[string]APIVersionPolicy `yaml:"versions"`
+}
+
+// Announced in response headers only, a version keeps working after its sunset
+type APIVersionPolicy struct {
+	Deprecated time.Time `yaml:"deprecated"` // Sent as the Deprecation header
+	Sunset     time.Time `yaml:"sunset"`     // Sent as the Sunset header
+	Link       string    `yaml:"link"`       // Migration notes, sent as Link rel="deprecation"
+}
+
+func DefaultConfig() SessionCtx {
+	return SessionCtx{
+		Server: ServerConfig{Port: 80},
+		DB: DBConfig{
+			Host: "localhost",
+			Port: 27017,
+		},
+		Log: LogConfig{
+			Level:      "info",
+			Format:     LogFormatJSON,
+			FilePath:   DefaultLogFile,
+			MaxSizeMB:  100,
+			MaxAgeDays: 30,
+			MaxBackups: 10,
+			Compress:   true,
+			Privacy:    PrivacyNone,
+		},
+		Tracing: telemetry.TracingConfig{SampleRatio: 1.0},
+		Schedulers: SchedulerConfig{
+			BlocklistInterval:    12 * time.Hour,
+			CouponPruneInterval:  6 * time.Hour,
+			SessionPruneInterval: 3 * time.Second,
+		},
+		Sessions: SessionConfig{
+			TTL:         5 * time.Minute,
+			MaxSessions: 100000,
+			Eviction:    EvictOldest,
+			MaxPerIP:    20,
+		},
+		Blocklist: BlocklistConfig{
+			Enabled: true,
+			Sources: []string{"https://lists.blocklist.de/lists/all.txt"},
+		},
+		RateLimit: RateLimitConfig{
+			Enabled:           false, // Opt in, deployments from before the limiter had none
+			RequestsPerSecond: 10,
+			Burst:             30,
+			ExpiresIn:         3 * time.Minute,
+		},
+		CORS: CORSConfig{MaxAge: 3600},
+		Auth: AuthConfig{RegistrationsPerIP: 20},
+		Reputation: ReputationConfig{
+			Enabled:      true,
+			TrustedAbove: 0.6,
+			MinOutcomes:  10,
+			Bootstrap:    true,
+			PromoteScore: 3,
+		},
+		Votes: VoteConfig{
+			DedupWindow:     24 * time.Hour,
+			BurstWindow:     10 * time.Minute,
+			BurstFailures:   5,
+			BurstMaxSources: 2,
+		},
+		Stream: StreamConfig{
+			MaxSubscribers: 1000,
+			MaxPerIP:       10,
+			Heartbeat:      30 * time.Second,
+		},
+		Cache: CacheConfig{
+			TTL:      30 * time.Second,
+			MaxSites: 10000,
+			MaxAge:   time.Minute,
+		},
+	}
+}
+
+// LoadConfigFile overlays a YAML (or JSON) file onto cfg. Unknown keys are an error
+// so typos don't silently fall back to defaults.
+func LoadConfigFile(path string, cfg *SessionCtx) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml", ".json":
+	default:
+		return fmt.Errorf("%s: unsupported config format %q, use .yaml, .yml or .json", path, ext)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// Points at the offending key using its yaml path, e.g. "server.port"
+type ConfigError struct {
+	Key string
+	Msg string
+}
+
+func (e *ConfigError) Error() string {
+	return e.Key + ": " + e.Msg
+}
+
+// Validate checks the merged configuration and reports every invalid key at once
+func (s *SessionCtx) Validate() error {
+	var errs []error
+	fail := func(key, format string, args ...any) {
+		errs = append(errs, &ConfigError{Key: key, Msg: fmt.Sprintf(format, args...)})
+	}
+	// Whether a low port can be bound depends on capabilities and sysctls, Listen reports it
+	if s.Server.Port == 0 {
+		fail("server.port", "must be a number between 1 and 65535")
+	}
+	s.DB.validate(fail)
+
+	if _, ok := ParsePrivacyMode(string(s.Log.Privacy)); !ok {
+		fail("log.privacy", "must be none, hash or redact")
+	}
+	if s.Log.Format != LogFormatJSON && s.Log.Format != LogFormatConsole {
+		fail("log.format", "must be %s or %s", LogFormatJSON, LogFormatConsole)
+	}
+	if _, err := parseLogLevel(s.Log.Level); err != nil {
+		fail("log.level", "must be one of trace, debug, info, warn, error, fatal")
+	}
+
+	if s.Tracing.SampleRatio < 0 || s.Tracing.SampleRatio > 1 {
+		fail("tracing.sample_ratio", "must be between 0.0 and 1.0")
+	}
+
+	if s.Schedulers.BlocklistInterval < time.Minute {
+		fail("schedulers.blocklist_interval", "must be at least 1m")
+	}
+	if s.Schedulers.CouponPruneInterval < time.Minute {
+		fail("schedulers.coupon_prune_interval", "must be at least 1m")
+	}
+	if s.Schedulers.SessionPruneInterval < time.Second {
+		fail("schedulers.session_prune_interval", "must be at least 1s")
+	}
+
+	if s.Sessions.TTL < 10*time.Second {
+		fail("sessions.ttl", "must be at least 10s")
+	}
+	for site, ttl := range s.Sessions.SiteTTL {
+		if ttl < 10*time.Second {
+			fail("sessions.site_ttl."+site, "must be at least 10s")
+		}
+	}
+	if s.Sessions.Eviction != EvictOldest && s.Sessions.Eviction != EvictReject {
+		fail("sessions.eviction", "must be %s or %s", EvictOldest, EvictReject)
+	}
+
+	for i, source := range s.Blocklist.Sources {
+		if u, err := url.Parse(source); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			fail(fmt.Sprintf("blocklist.sources[%d]", i), "must be an http(s) URL")
+		}
+	}
+
+	if s.RateLimit.Enabled {
+		if s.RateLimit.RequestsPerSecond <= 0 {
+			fail("rate_limit.requests_per_second", "must be greater than 0")
+		}
+		if s.RateLimit.Burst == 0 {
+			fail("rate_limit.burst", "must be at least 1")
+		}
+	}
+
+	for i, origin := range s.CORS.AllowOrigins {
+		if origin == "*" {
+			continue
+		}
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" {
+			fail(fmt.Sprintf("cors.allow_origins[%d]", i), "must be \"*\" or an origin like https://example.com")
+		}
+	}
+
+	for i, key := range s.Admin.APIKeys {
+		if len(key) < 16 {
+			fail(fmt.Sprintf("admin.api_keys[%d]", i), "must be at least 16 characters")
+		}
+	}
+
+	for i, secret := range s.Auth.TokenSecrets {
+		if len(secret) < 32 {
+			fail(fmt.Sprintf("auth.token_secrets[%d]", i), "must be at least 32 characters")
+		}
+	}
+
+	if s.Reputation.TrustedAbove < 0 || s.Reputation.TrustedAbove > 1 {
+		fail("reputation.trusted_above", "must be between 0.0 and 1.0")
+	}
+	if s.Reputation.PromoteScore <= 0 {
+		fail("reputation.promote_score", "must be greater than 0")
+	}
+
+	if s.Votes.DedupWindow < time.Minute {
+		fail("votes.dedup_window", "must be at least 1m")
+	}
+	if s.Votes.BurstWindow < time.Minute {
+		fail("votes.burst_window", "must be at least 1m")
+	}
+	if s.Votes.BurstFailures < 2 {
+		fail("votes.burst_failures", "must be at least 2")
+	}
+	if s.Votes.BurstMaxSources == 0 {
+		fail("votes.burst_max_sources", "must be at least 1")
+	}
+
+	if s.Stream.Heartbeat < time.Second {
+		fail("stream.heartbeat", "must be at least 1s")
+	}
+
+	if s.Cache.TTL < 0 {
+		fail("cache.ttl", "must not be negative")
+	}
+	if s.Cache.MaxAge < 0 {
+		fail("cache.max_age", "must not be negative")
+	}
+	if s.Cache.TTL > 0 && s.Cache.MaxSites == 0 {
+		fail("cache.max_sites", "must be at least 1 while the cache is enabled")
+	}
+
+	for version, policy := range s.API.Versions {
+		key := "api.versions." + version
+		if !slices.Contains(types.APIVersions, version) {
+			fail(key, "unknown API version, must be one of %s", strings.Join(types.APIVersions, ", "))
+		}
+		if policy.Deprecated.IsZero() {
+			fail(key+".deprecated", "must be set for a deprecated version")
+		}
+		if !policy.Sunset.IsZero() && policy.Sunset.Before(policy.Deprecated) {
+			fail(key+".sunset", "must not be before deprecated")
+		}
+		if policy.Link != "" {
+			if u, err := url.Parse(policy.Link); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				fail(key+".link", "must be an http(s) URL")
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Keys whose values are never printed, in diffs or anywhere else
+var secretConfigKeys = []string{"db.uri", "db.password", "admin.api_keys", "auth.token_secrets"}
+
+type ConfigChange struct {
+	Key string
+	Old string
+	New string
+}
+
+// DiffConfig lists every key whose value differs between old and new, by yaml path.
+// Secret values are masked.
+func DiffConfig(old, new SessionCtx) []ConfigChange {
+	oldFlat, newFlat := flattenConfig(old), flattenConfig(new)
+
+	var changes []ConfigChange
+	for key, newValue := range newFlat {
+		if oldValue := oldFlat[key]; oldValue != newValue {
+			changes = append(changes, ConfigChange{Key: key, Old: oldValue, New: newValue})
+		}
+	}
+	for key, oldValue := range oldFlat {
+		if _, ok := newFlat[key]; !ok {
+			changes = append(changes, ConfigChange{Key: key, Old: oldValue})
+		}
+	}
+	slices.SortFunc(changes, func(a, b ConfigChange) int { return strings.Compare(a.Key, b.Key) })
+
+	for i := range changes {
+		if slices.Contains(secretConfigKeys, changes[i].Key) {
+			changes[i].Old, changes[i].New = maskSecret(changes[i].Old), maskSecret(changes[i].New)
+		}
+	}
+	return changes
+}
+
+func flattenConfig(cfg SessionCtx) map[string]string {
+	var tree map[string]any
+	data, _ := yaml.Marshal(cfg)
+	_ = yaml.Unmarshal(data, &tree)
+
+	flat := map[string]string{}
+	var walk func(prefix string, node any)
+	walk = func(prefix string, node any) {
+		if m, ok := node.(map[string]any); ok {
+			for k, v := range m {
+				key := k
+				if prefix != "" {
+					key = prefix + "." + k
+				}
+				walk(key, v)
+			}
+			return
+		}
+		flat[prefix] = fmt.Sprint(node)
+	}
+	walk("", tree)
+	return flat
+}
+
+func maskSecret(value string) string {
+	if value == "" || value == "[]" {
+		return value
+	}
+	return "[hidden]"
+}
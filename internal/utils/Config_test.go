@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDiffConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(cfg *SessionCtx)
+		want   []ConfigChange
+	}{
+		{"unchanged", func(*SessionCtx) {}, nil},
+		{"nested key", func(cfg *SessionCtx) { cfg.Log.Level = "debug" }, []ConfigChange{
+			{Key: "log.level", Old: "info", New: "debug"},
+		}},
+		{"sorted by key", func(cfg *SessionCtx) {
+			cfg.Sessions.MaxPerIP = 5
+			cfg.Cache.TTL = time.Minute
+		}, []ConfigChange{
+			{Key: "cache.ttl", Old: "30s", New: "1m0s"},
+			{Key: "sessions.max_per_ip", Old: "20", New: "5"},
+		}},
+		{"secret masked", func(cfg *SessionCtx) { cfg.DB.Password = "hunter2" }, []ConfigChange{
+			{Key: "db.password", Old: "", New: "[hidden]"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old, next := DefaultConfig(), DefaultConfig()
+			tt.change(&next)
+			got := DiffConfig(old, next)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("change %d is %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
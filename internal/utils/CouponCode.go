@@ -0,0 +1,24 @@
+package utils
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// CouponKey is the form variants of a code share: compatibility characters folded (NFKC),
+// whitespace removed and, unless the shop tells cases apart, upper case.
+// "SAVE10", "save10" and " SAVE 10 " all give SAVE10.
+func CouponKey(code string, caseSensitive bool) string {
+	key := strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, norm.NFKC.String(code))
+	if !caseSensitive {
+		key = strings.ToUpper(key)
+	}
+	return key
+}
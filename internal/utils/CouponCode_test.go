@@ -0,0 +1,27 @@
+package utils
+
+import "testing"
+
+func TestCouponKey(t *testing.T) {
+	tests := []struct {
+		code          string
+		caseSensitive bool
+		want          string
+	}{
+		{"SAVE10", false, "SAVE10"},
+		{"save10", false, "SAVE10"},
+		{" SAVE 10 ", false, "SAVE10"},
+		{"save\t10\n", false, "SAVE10"},
+		{"save10", true, "save10"},
+		{" Save 10", true, "Save10"},
+		{"ＳＡＶＥ１０", false, "SAVE10"},  // Fullwidth
+		{"SAVE 10", false, "SAVE10"}, // No-break space
+		{"ﬁve", false, "FIVE"},       // Ligature
+		{"", false, ""},
+	}
+	for _, tt := range tests {
+		if got := CouponKey(tt.code, tt.caseSensitive); got != tt.want {
+			t.Errorf("CouponKey(%q, %v) = %q, want %q", tt.code, tt.caseSensitive, got, tt.want)
+		}
+	}
+}
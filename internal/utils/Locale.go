@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"strings"
+
+	"golang.org/x/text/language"
+)
+
+// NormalizeRegion returns an ISO 3166-1 alpha-2 country code in upper case
+func NormalizeRegion(region string) (string, bool) {
+	region = strings.ToUpper(strings.TrimSpace(region))
+	if len(region) != 2 || !isLetters(region) {
+		return "", false
+	}
+	parsed, err := language.ParseRegion(region)
+	if err != nil || !parsed.IsCountry() {
+		return "", false
+	}
+	return parsed.Canonicalize().String(), true // UK is GB
+}
+
+// NormalizeCurrency returns an ISO 4217 currency code in upper case
+func NormalizeCurrency(currency string) (string, bool) {
+	currency = strings.ToUpper(strings.TrimSpace(currency))
+	if len(currency) != 3 || !isLetters(currency) {
+		return "", false
+	}
+	return currency, true
+}
+
+// NormalizeLocale returns the canonical form of a BCP 47 tag, e.g. de-AT
+func NormalizeLocale(locale string) (string, bool) {
+	tag, err := language.Parse(strings.TrimSpace(locale))
+	if err != nil {
+		return "", false
+	}
+	return tag.String(), true
+}
+
+// RegionFromAcceptLanguage returns the region of the most preferred language that names one,
+// de-AT gives AT. A bare language doesn't count, de is spoken in more than one country.
+func RegionFromAcceptLanguage(header string) (string, bool) {
+	tags, _, err := language.ParseAcceptLanguage(header)
+	if err != nil {
+		return "", false
+	}
+	for _, tag := range tags {
+		if region, confidence := tag.Region(); confidence == language.Exact && region.IsCountry() {
+			return region.String(), true
+		}
+	}
+	return "", false
+}
+
+func isLetters(s string) bool {
+	for _, r := range s {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
@@ -2,34 +2,113 @@ package utils
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
-	"time"
+	"strings"
 
+	"github.com/MisterNorwood/SugarCube-Server/internal/telemetry"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
-func InitLogger() {
-	logDir := "/var/log/sugarcube-backend"
+const (
+	LogFormatJSON    = "json"
+	LogFormatConsole = "console"
 
-	if err := os.MkdirAll(logDir, 0755); err != nil {
-		fmt.Printf("Failed to create log directory: %v\n", err)
-		os.Exit(1)
-	}
+	DefaultLogFile = "/var/log/sugarcube-backend/sugarcube-backend.log"
+)
 
-	timestamp := time.Now().Format("20060102-150405")
-	filePath := filepath.Join(logDir, fmt.Sprintf("sugarcube-backend-%s.log", timestamp))
+type LogConfig struct {
+	Level      string      `yaml:"level"`
+	Format     string      `yaml:"format"` // Format of stdout output, the log file is always JSON
+	StdoutOnly bool        `yaml:"stdout_only"`
+	FilePath   string      `yaml:"file"`
+	MaxSizeMB  uint64      `yaml:"max_size_mb"`  // Rotate once the file reaches this size
+	MaxAgeDays uint64      `yaml:"max_age_days"` // Delete rotated files older than this, 0 keeps them forever
+	MaxBackups uint64      `yaml:"max_backups"`  // Number of rotated files to keep, 0 keeps all
+	Compress   bool        `yaml:"compress"`     // Gzip rotated files
+	Privacy    PrivacyMode `yaml:"privacy"`      // How sites and coupon codes appear in logs
+}
 
-	logFile, err := os.OpenFile(filePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+// Kept so the file can be closed on shutdown
+var logFile io.Closer
+
+func InitLogger(cfg LogConfig) error {
+	level, err := parseLogLevel(cfg.Level)
 	if err != nil {
-		fmt.Printf("Failed to open log file: %v\n", err)
-		os.Exit(1)
+		return err
+	}
+	zerolog.SetGlobalLevel(level)
+	SetLogPrivacy(cfg.Privacy)
+
+	var stdout io.Writer
+	switch cfg.Format {
+	case LogFormatJSON:
+		stdout = os.Stdout
+	case LogFormatConsole:
+		stdout = zerolog.ConsoleWriter{Out: os.Stdout}
+	default:
+		return fmt.Errorf("invalid log format %q: must be %s or %s", cfg.Format, LogFormatJSON, LogFormatConsole)
+	}
+
+	writers := []io.Writer{stdout}
+	var fileErr error
+	if !cfg.StdoutOnly && cfg.FilePath != "" {
+		// A missing or read-only log directory shouldn't stop the server, stdout still works
+		if fileErr = checkLogFile(cfg.FilePath); fileErr == nil {
+			rotator := &lumberjack.Logger{
+				Filename:   cfg.FilePath,
+				MaxSize:    int(cfg.MaxSizeMB),
+				MaxAge:     int(cfg.MaxAgeDays),
+				MaxBackups: int(cfg.MaxBackups),
+				Compress:   cfg.Compress,
+			}
+			writers = append(writers, rotator)
+			logFile = rotator
+		}
 	}
 
-	log.Logger = zerolog.New(logFile).With().Timestamp().Logger()
+	log.Logger = zerolog.New(SecretRedactor(zerolog.MultiLevelWriter(writers...))).
+		With().Timestamp().Logger().
+		Hook(telemetry.TraceHook{}).
+		Hook(RequestHook{})
 
-	log.Logger = log.Output(zerolog.MultiLevelWriter(os.Stdout, logFile))
+	if fileErr != nil {
+		log.Warn().Err(fileErr).Str("path", cfg.FilePath).Msg("Cannot open log file, logging to stdout only")
+	}
+	log.Info().
+		Str("log_level", level.String()).
+		Str("format", cfg.Format).
+		Bool("file", logFile != nil).
+		Msg("Logger initialized successfully.")
+	return nil
+}
 
-	log.Info().Msg("Logger initialized successfully.")
+func parseLogLevel(s string) (zerolog.Level, error) {
+	level, err := zerolog.ParseLevel(strings.ToLower(s))
+	if err != nil || level == zerolog.NoLevel {
+		return zerolog.NoLevel, fmt.Errorf("invalid log level %q", s)
+	}
+	return level, nil
+}
+
+func CloseLogger() error {
+	if logFile == nil {
+		return nil
+	}
+	return logFile.Close()
+}
+
+// lumberjack opens the file lazily, so probe it up front to catch permission problems
+func checkLogFile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
 }
@@ -0,0 +1,190 @@
+package utils
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var readPreferences = []string{"primary", "primaryPreferred", "secondary", "secondaryPreferred", "nearest"}
+
+type DBTLSConfig struct {
+	Enabled     bool   `yaml:"enabled"`
+	CAFile      string `yaml:"ca_file"`       // PEM bundle used to verify the server
+	CertKeyFile string `yaml:"cert_key_file"` // PEM with client certificate and key, for x509 auth or mutual TLS
+	Insecure    bool   `yaml:"insecure"`      // Skip certificate and hostname checks, testing only
+}
+
+// MongoURI returns the connection string for the configured database.
+// A full URI in db.uri is used as the base; structured options are added on top
+// unless the URI already sets them. Credentials are always URL-escaped.
+func (s SessionCtx) MongoURI() (string, error) {
+	u, err := s.mongoURL()
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+// RedactedMongoURI is MongoURI with the password masked, for logs and PrintEnv
+func (s SessionCtx) RedactedMongoURI() string {
+	u, err := s.mongoURL()
+	if err != nil {
+		return "[invalid]"
+	}
+	if _, hasPassword := u.User.Password(); hasPassword {
+		u.User = url.UserPassword(u.User.Username(), "[hidden]")
+	}
+	// Redacted() would escape the brackets, build it by hand instead
+	return strings.Replace(u.String(), url.QueryEscape("[hidden]"), "[hidden]", 1)
+}
+
+func (s SessionCtx) mongoURL() (*url.URL, error) {
+	db := s.DB
+	var u *url.URL
+
+	if db.URI != "" {
+		parsed, err := url.Parse(db.URI)
+		if err != nil {
+			return nil, &ConfigError{Key: "db.uri", Msg: "is not a valid connection string"}
+		}
+		if parsed.Scheme != "mongodb" && parsed.Scheme != "mongodb+srv" {
+			return nil, &ConfigError{Key: "db.uri", Msg: "must start with mongodb:// or mongodb+srv://"}
+		}
+		u = parsed
+	} else {
+		u = &url.URL{Scheme: "mongodb", Host: joinHosts(db.Host, db.Port), Path: "/"}
+		if db.SRV {
+			// SRV records carry the ports, and there can only be one host
+			u.Scheme = "mongodb+srv"
+			u.Host = db.Host
+		}
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+
+	// Explicit credentials win over the ones in the URI, a password alone goes with the URI's user
+	user := db.User
+	if user == "" && u.User != nil {
+		user = u.User.Username()
+	}
+	switch {
+	case db.Password != "" && user == "":
+		return nil, &ConfigError{Key: "db.password", Msg: "needs a user, set db.user or put one in db.uri"}
+	case db.Password != "":
+		u.User = url.UserPassword(user, db.Password)
+	case db.User != "" && (u.User == nil || u.User.Username() != db.User):
+		u.User = url.User(db.User)
+	}
+
+	query := u.Query()
+	setDefault := func(key, value string) {
+		if value != "" && !query.Has(key) {
+			query.Set(key, value)
+		}
+	}
+	setDefault("authSource", db.AuthSource)
+	setDefault("replicaSet", db.ReplicaSet)
+	setDefault("readPreference", db.ReadPreference)
+	if db.TLS.Enabled {
+		setDefault("tls", "true")
+		setDefault("tlsCAFile", db.TLS.CAFile)
+		setDefault("tlsCertificateKeyFile", db.TLS.CertKeyFile)
+		if db.TLS.Insecure {
+			setDefault("tlsInsecure", "true")
+		}
+	}
+	u.RawQuery = query.Encode()
+
+	return u, nil
+}
+
+// RegisterURISecret registers the password embedded in a connection string for redaction
+func RegisterURISecret(uri string) {
+	if u, err := url.Parse(uri); err == nil && u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			RegisterSecret(password)
+		}
+	}
+}
+
+// Host may be a comma separated seed list; hosts without a port get the default one
+func joinHosts(hosts string, port uint16) string {
+	var seeds []string
+	for _, host := range strings.Split(hosts, ",") {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(int(port)))
+		}
+		seeds = append(seeds, host)
+	}
+	return strings.Join(seeds, ",")
+}
+
+func (db DBConfig) validate(fail func(key, format string, args ...any)) {
+	if db.URI == "" {
+		if db.Host == "" {
+			fail("db.host", "must not be empty")
+		}
+		if db.Port == 0 {
+			fail("db.port", "must be a number between 1 and 65535")
+		}
+		if db.SRV && strings.Contains(db.Host, ",") {
+			fail("db.srv", "mongodb+srv takes a single host name")
+		}
+	}
+	if db.ReadPreference != "" && !slices.Contains(readPreferences, db.ReadPreference) {
+		fail("db.read_preference", "must be one of %s", strings.Join(readPreferences, ", "))
+	}
+	if !db.TLS.Enabled && (db.TLS.CAFile != "" || db.TLS.CertKeyFile != "") {
+		fail("db.tls.enabled", "must be true when TLS files are set")
+	}
+	for key, path := range map[string]string{"db.tls.ca_file": db.TLS.CAFile, "db.tls.cert_key_file": db.TLS.CertKeyFile} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			fail(key, "cannot read %s: %v", path, err)
+		}
+	}
+	if _, err := (SessionCtx{DB: db}).mongoURL(); err != nil {
+		var cfgErr *ConfigError
+		if errors.As(err, &cfgErr) {
+			fail(cfgErr.Key, "%s", cfgErr.Msg)
+		}
+	}
+}
+
+// SplitDBURI routes the --db-uri value: a full connection string goes to db.uri,
+// anything else is treated as a host name like before.
+func SplitDBURI(value string) (uri string, host string) {
+	if strings.Contains(value, "://") {
+		return value, ""
+	}
+	return "", value
+}
+
+func (tls DBTLSConfig) String() string {
+	if !tls.Enabled {
+		return "off"
+	}
+	parts := []string{"on"}
+	if tls.CAFile != "" {
+		parts = append(parts, "ca="+tls.CAFile)
+	}
+	if tls.CertKeyFile != "" {
+		parts = append(parts, "client-cert="+tls.CertKeyFile)
+	}
+	if tls.Insecure {
+		parts = append(parts, "INSECURE")
+	}
+	return strings.Join(parts, " ")
+}
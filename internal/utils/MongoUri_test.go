@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMongoURI(t *testing.T) {
+	tests := []struct {
+		name string
+		db   DBConfig
+		want string
+	}{
+		{"host and port", DBConfig{Host: "localhost", Port: 27017}, "mongodb://localhost:27017/"},
+		{"seed list", DBConfig{Host: "a, b:27018", Port: 27017, ReplicaSet: "rs0"}, "mongodb://a:27017,b:27018/?replicaSet=rs0"},
+		{"escaped credentials", DBConfig{Host: "db", Port: 27017, User: "app@corp", Password: "p@ss:w/rd"}, "mongodb://app%40corp:p%40ss%3Aw%2Frd@db:27017/"},
+		{"srv", DBConfig{Host: "cluster.example.net", Port: 27017, SRV: true, AuthSource: "admin"}, "mongodb+srv://cluster.example.net/?authSource=admin"},
+		{"uri options kept", DBConfig{URI: "mongodb://db/app?authSource=app&w=majority", AuthSource: "admin", ReadPreference: "nearest"}, "mongodb://db/app?authSource=app&readPreference=nearest&w=majority"},
+		{"tls", DBConfig{Host: "db", Port: 27017, TLS: DBTLSConfig{Enabled: true, Insecure: true}}, "mongodb://db:27017/?tls=true&tlsInsecure=true"},
+		{"password with uri user", DBConfig{URI: "mongodb://app@db/", Password: "secret"}, "mongodb://app:secret@db/"},
+		{"user replaces uri credentials", DBConfig{URI: "mongodb://app:old@db/", User: "other"}, "mongodb://other@db/"},
+		{"same user keeps uri password", DBConfig{URI: "mongodb://app:old@db/", User: "app"}, "mongodb://app:old@db/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SessionCtx{DB: tt.db}.MongoURI()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMongoURIErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		db   DBConfig
+		key  string
+	}{
+		{"bad scheme", DBConfig{URI: "http://db/"}, "db.uri"},
+		{"password without user", DBConfig{URI: "mongodb://db/", Password: "secret"}, "db.password"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := SessionCtx{DB: tt.db}.MongoURI()
+			var cfgErr *ConfigError
+			if !errors.As(err, &cfgErr) || cfgErr.Key != tt.key {
+				t.Fatalf("got %v, want an error on %s", err, tt.key)
+			}
+		})
+	}
+}
+
+func TestRedactedMongoURI(t *testing.T) {
+	tests := []struct {
+		name string
+		db   DBConfig
+		want string
+	}{
+		{"password masked", DBConfig{Host: "db", Port: 27017, User: "app", Password: "p@ss"}, "mongodb://app:[hidden]@db:27017/"},
+		{"uri password masked", DBConfig{URI: "mongodb://app:secret@db/?tls=true"}, "mongodb://app:[hidden]@db/?tls=true"},
+		{"no password", DBConfig{URI: "mongodb://app@db/"}, "mongodb://app@db/"},
+		{"invalid", DBConfig{URI: "http://db/"}, "[invalid]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (SessionCtx{DB: tt.db}).RedactedMongoURI(); got != tt.want {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
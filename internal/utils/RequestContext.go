@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"github.com/MisterNorwood/SugarCube-Server/pkg/types"
+	"github.com/rs/zerolog"
+)
+
+const RequestIDHeader = types.RequestIDHeader
+
+// Request-scoped data shared by middleware, handlers and database calls.
+// Decision fields are filled in by the middleware that makes the decision
+// and reported once by the access log.
+type RequestMeta struct {
+	ID                string
+	ClientIP          string
+	UserAgent         string
+	APIVersion        string
+	InstallID         string
+	BanDecision       string
+	RateLimitDecision string
+}
+
+type requestMetaKey struct{}
+
+func WithRequestMeta(ctx context.Context, meta *RequestMeta) context.Context {
+	return context.WithValue(ctx, requestMetaKey{}, meta)
+}
+
+// RequestMetaFrom returns the request metadata stored on ctx, or nil outside a request.
+func RequestMetaFrom(ctx context.Context) *RequestMeta {
+	if ctx == nil {
+		return nil
+	}
+	meta, _ := ctx.Value(requestMetaKey{}).(*RequestMeta)
+	return meta
+}
+
+func RequestIDFrom(ctx context.Context) string {
+	if meta := RequestMetaFrom(ctx); meta != nil {
+		return meta.ID
+	}
+	return ""
+}
+
+// RequestHook tags every log event created with Event.Ctx(ctx) inside a request
+// with the request ID and client IP, so lines can be tied back to one request.
+type RequestHook struct{}
+
+func (RequestHook) Run(e *zerolog.Event, level zerolog.Level, msg string) {
+	meta := RequestMetaFrom(e.GetCtx())
+	if meta == nil {
+		return
+	}
+	e.Str("request_id", meta.ID).Str("client_ip", meta.ClientIP)
+}
+
+type PrivacyMode string
+
+const (
+	PrivacyNone   PrivacyMode = "none"   // log sites and coupon codes as-is
+	PrivacyHash   PrivacyMode = "hash"   // log a short hash, still lets you group lines
+	PrivacyRedact PrivacyMode = "redact" // drop the value entirely
+)
+
+// Query params that carry a site name and get redacted in logged URLs
+var privateQueryParams = []string{"site", "url"}
+
+var logPrivacy atomic.Value // PrivacyMode
+
+func init() {
+	logPrivacy.Store(PrivacyNone)
+}
+
+// SetLogPrivacy changes how sites and coupon codes are logged, safe to call at runtime
+func SetLogPrivacy(mode PrivacyMode) {
+	logPrivacy.Store(mode)
+}
+
+func LogPrivacy() PrivacyMode {
+	return logPrivacy.Load().(PrivacyMode)
+}
+
+func ParsePrivacyMode(s string) (PrivacyMode, bool) {
+	switch mode := PrivacyMode(strings.ToLower(strings.TrimSpace(s))); mode {
+	case PrivacyNone, PrivacyHash, PrivacyRedact:
+		return mode, true
+	}
+	return "", false
+}
+
+func RedactSite(site string) string {
+	return redact(site)
+}
+
+func RedactCoupon(code string) string {
+	return redact(code)
+}
+
+// RedactURL returns the request URI with site-identifying query values redacted
+func RedactURL(u *url.URL) string {
+	if LogPrivacy() == PrivacyNone || u.RawQuery == "" {
+		return u.String()
+	}
+	query := u.Query()
+	for _, param := range privateQueryParams {
+		if values, ok := query[param]; ok {
+			for i := range values {
+				values[i] = redact(values[i])
+			}
+		}
+	}
+	redacted := *u
+	redacted.RawQuery = query.Encode()
+	return redacted.String()
+}
+
+func redact(value string) string {
+	switch LogPrivacy() {
+	case PrivacyHash:
+		sum := sha256.Sum256([]byte(value))
+		return "sha256:" + hex.EncodeToString(sum[:6])
+	case PrivacyRedact:
+		return "[redacted]"
+	default:
+		return value
+	}
+}
@@ -0,0 +1,133 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Path that makes a secret be read from stdin, e.g. --db-password-file -
+const SecretStdin = "-"
+
+// Shorter secrets would mangle unrelated log output when redacted
+const minRedactLength = 4
+
+const redactedSecret = "[hidden]"
+
+var secrets struct {
+	mu       sync.RWMutex
+	values   []string
+	replacer *strings.Replacer
+}
+
+// Stdin can only be read once, but the config is loaded again on reload
+var stdinSecret struct {
+	once  sync.Once
+	owner string
+	value string
+	err   error
+}
+
+// ReadSecretFile reads a secret for key from path, or from stdin when path is "-".
+// A trailing newline is dropped since most editors and `echo` add one.
+// The value is registered for redaction.
+func ReadSecretFile(key, path string) (string, error) {
+	if path == SecretStdin {
+		return readStdinSecret(key)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("%s: reading secret file: %w", key, err)
+	}
+	value := strings.TrimRight(string(data), "\r\n")
+	RegisterSecret(value)
+	return value, nil
+}
+
+func readStdinSecret(key string) (string, error) {
+	stdinSecret.once.Do(func() {
+		stdinSecret.owner = key
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			stdinSecret.err = fmt.Errorf("%s: reading secret from stdin: %w", key, err)
+			return
+		}
+		stdinSecret.value = strings.TrimRight(string(data), "\r\n")
+		RegisterSecret(stdinSecret.value)
+	})
+	if stdinSecret.owner != key {
+		return "", fmt.Errorf("%s: stdin is already used by %s, only one secret can be read from it", key, stdinSecret.owner)
+	}
+	return stdinSecret.value, stdinSecret.err
+}
+
+// SplitSecretList splits a list of secrets given one per line or comma separated
+func SplitSecretList(value string) []string {
+	var list []string
+	for _, item := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '\n' || r == '\r' }) {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// RegisterSecret makes every later log line and PrintEnv output replace the values with "[hidden]".
+// The escaped forms used in URIs and JSON strings are redacted too.
+func RegisterSecret(values ...string) {
+	secrets.mu.Lock()
+	defer secrets.mu.Unlock()
+	for _, value := range values {
+		if len(value) < minRedactLength {
+			continue
+		}
+		escaped := strings.TrimPrefix(url.UserPassword("", value).String(), ":")
+		for _, form := range []string{value, escaped, url.QueryEscape(value), jsonEscape(value)} {
+			if !slices.Contains(secrets.values, form) {
+				secrets.values = append(secrets.values, form)
+			}
+		}
+	}
+	// Longest first so a secret containing another one is replaced whole
+	slices.SortFunc(secrets.values, func(a, b string) int { return len(b) - len(a) })
+	pairs := make([]string, 0, 2*len(secrets.values))
+	for _, value := range secrets.values {
+		pairs = append(pairs, value, redactedSecret)
+	}
+	secrets.replacer = strings.NewReplacer(pairs...)
+}
+
+// RedactSecrets replaces every registered secret in s
+func RedactSecrets(s string) string {
+	secrets.mu.RLock()
+	defer secrets.mu.RUnlock()
+	if secrets.replacer == nil {
+		return s
+	}
+	return secrets.replacer.Replace(s)
+}
+
+// SecretRedactor wraps a log output so registered secrets never reach it
+func SecretRedactor(w io.Writer) io.Writer {
+	return redactingWriter{w: w}
+}
+
+type redactingWriter struct {
+	w io.Writer
+}
+
+// zerolog hands over one complete event per Write, so a secret is never split across calls
+func (r redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, RedactSecrets(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func jsonEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`).Replace(s)
+}
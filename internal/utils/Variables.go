@@ -1,25 +1,72 @@
 package utils
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type CliVar interface {
-	int | uint64 | string | bool
+	int | uint64 | float64 | string | bool | time.Duration | []string
 }
 
 const (
-	EnvDBPort     = "SUGARCUBE_DB_PORT"
-	EnvPort       = "SUGARCUBE_PORT"
-	EnvDBURI      = "SUGARCUBE_DB_URI"
-	EnvDBUser     = "SUGARCUBE_DB_USER"
-	EnvDBPassword = "SUGARCUBE_DB_PASSWORD"
-	EnvDebug      = "SUGARCUBE_DEBUG"
-	UriProtocol   = "mongodb://"
+	EnvDBPort         = "SUGARCUBE_DB_PORT"
+	EnvPort           = "SUGARCUBE_PORT"
+	EnvDBURI          = "SUGARCUBE_DB_URI"
+	EnvDBUser         = "SUGARCUBE_DB_USER"
+	EnvDBPassword     = "SUGARCUBE_DB_PASSWORD"
+	EnvDBPasswordFile = "SUGARCUBE_DB_PASSWORD_FILE"
+	EnvDebug          = "SUGARCUBE_DEBUG"
+	EnvConfigFile     = "SUGARCUBE_CONFIG"
+
+	EnvOtelEndpoint    = "SUGARCUBE_OTEL_ENDPOINT"
+	EnvOtelSampleRatio = "SUGARCUBE_OTEL_SAMPLE_RATIO"
+	EnvOtelInsecure    = "SUGARCUBE_OTEL_INSECURE"
+	EnvLogPrivacy      = "SUGARCUBE_LOG_PRIVACY"
+
+	EnvLogLevel      = "SUGARCUBE_LOG_LEVEL"
+	EnvLogFormat     = "SUGARCUBE_LOG_FORMAT"
+	EnvLogStdoutOnly = "SUGARCUBE_LOG_STDOUT_ONLY"
+	EnvLogFile       = "SUGARCUBE_LOG_FILE"
+	EnvLogMaxSize    = "SUGARCUBE_LOG_MAX_SIZE"
+	EnvLogMaxAge     = "SUGARCUBE_LOG_MAX_AGE"
+	EnvLogMaxBackups = "SUGARCUBE_LOG_MAX_BACKUPS"
+	EnvLogCompress   = "SUGARCUBE_LOG_COMPRESS"
+
+	EnvBlocklistEnabled     = "SUGARCUBE_BLOCKLIST_ENABLED"
+	EnvBlocklistSources     = "SUGARCUBE_BLOCKLIST_SOURCES"
+	EnvRateLimitEnabled     = "SUGARCUBE_RATE_LIMIT_ENABLED"
+	EnvRateLimitRPS         = "SUGARCUBE_RATE_LIMIT_RPS"
+	EnvRateLimitBurst       = "SUGARCUBE_RATE_LIMIT_BURST"
+	EnvCORSOrigins          = "SUGARCUBE_CORS_ORIGINS"
+	EnvAdminKeys            = "SUGARCUBE_ADMIN_KEYS"
+	EnvAdminKeysFile        = "SUGARCUBE_ADMIN_KEYS_FILE"
+	EnvTokenSecrets         = "SUGARCUBE_TOKEN_SECRETS"
+	EnvTokenSecretsFile     = "SUGARCUBE_TOKEN_SECRETS_FILE"
+	EnvRequireInstallToken  = "SUGARCUBE_REQUIRE_INSTALL_TOKEN"
+	EnvRegistrationsPerIP   = "SUGARCUBE_REGISTRATIONS_PER_IP"
+	EnvReputationEnabled    = "SUGARCUBE_REPUTATION_ENABLED"
+	EnvBlocklistInterval    = "SUGARCUBE_BLOCKLIST_INTERVAL"
+	EnvCouponPruneInterval  = "SUGARCUBE_COUPON_PRUNE_INTERVAL"
+	EnvSessionPruneInterval = "SUGARCUBE_SESSION_PRUNE_INTERVAL"
+	EnvSessionTTL           = "SUGARCUBE_SESSION_TTL"
+	EnvMaxSessions          = "SUGARCUBE_MAX_SESSIONS"
+	EnvSessionsPerIP        = "SUGARCUBE_SESSIONS_PER_IP"
+	EnvGeoIPDatabase        = "SUGARCUBE_GEOIP_DATABASE"
+	EnvCouponsCaseSensitive = "SUGARCUBE_COUPONS_CASE_SENSITIVE"
+
+	EnvDBSRV            = "SUGARCUBE_DB_SRV"
+	EnvDBAuthSource     = "SUGARCUBE_DB_AUTH_SOURCE"
+	EnvDBReplicaSet     = "SUGARCUBE_DB_REPLICA_SET"
+	EnvDBReadPreference = "SUGARCUBE_DB_READ_PREFERENCE"
+	EnvDBTLS            = "SUGARCUBE_DB_TLS"
+	EnvDBTLSCAFile      = "SUGARCUBE_DB_TLS_CA_FILE"
+	EnvDBTLSCertKeyFile = "SUGARCUBE_DB_TLS_CERT_KEY_FILE"
+	EnvDBTLSInsecure    = "SUGARCUBE_DB_TLS_INSECURE"
 
 	//Cool colors
 	ColorReset  = "\033[0m"
@@ -30,26 +77,19 @@ const (
 	ColorBold   = "\033[1m"
 )
 
-type SessionCtx struct {
-	DbPort     uint16
-	ServerPort uint16
-	DbUri      string
-	DbUser     string
-	DbPassword string
-	Debug      bool
-}
-
 // Used to decide what to use as variables.
-func CheckForEnv[T CliVar](envVar string, cliVar T) (T, error) {
+// Returns the env var parsed as T if it is set, otherwise the current value.
+// Flags are applied on top of this by the caller, so the final order is flags > env > file > defaults.
+func CheckForEnv[T CliVar](envVar string, current T) (T, error) {
 	envVarResult := os.Getenv(envVar)
-	if envVarResult == "" { // Env vars will take priority
-		return cliVar, nil
+	if envVarResult == "" {
+		return current, nil
 	}
 
 	var result T
 	var err error
 
-	switch any(cliVar).(type) {
+	switch any(current).(type) {
 	case int:
 		var intVal int
 		intVal, err = strconv.Atoi(envVarResult)
@@ -58,65 +98,140 @@ func CheckForEnv[T CliVar](envVar string, cliVar T) (T, error) {
 		var uint64Val uint64
 		uint64Val, err = strconv.ParseUint(envVarResult, 10, 64)
 		result = any(uint64Val).(T)
+	case float64:
+		var floatVal float64
+		floatVal, err = strconv.ParseFloat(envVarResult, 64)
+		result = any(floatVal).(T)
 	case bool:
 		var boolVal bool
 		boolVal, err = strconv.ParseBool(envVarResult) //Parses 90% of possible bool naming schemas
 		result = any(boolVal).(T)
 	case string:
 		result = any(envVarResult).(T)
+	case time.Duration:
+		var durVal time.Duration
+		durVal, err = time.ParseDuration(envVarResult)
+		result = any(durVal).(T)
+	case []string:
+		var list []string
+		for _, item := range strings.Split(envVarResult, ",") { // Comma separated
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		result = any(list).(T)
 	default:
 		err = errors.New("unsupported type")
 	}
-	return result, err
+	if err != nil {
+		return current, fmt.Errorf("%s: %w", envVar, err)
+	}
+	return result, nil
 
 }
 func (s *SessionCtx) IsEmpty() bool {
 	if s == nil {
 		return true
 	}
-	return s.DbPort == 0 && s.ServerPort == 0 && s.DbUri == ""
+	return s.DB.Port == 0 && s.Server.Port == 0 && s.DB.Host == ""
 
 }
 
+// PrintEnv goes through the same redaction as the logs, so a secret can't leak even if a field shows it
 func (s SessionCtx) PrintEnv() {
-	fmt.Println(ColorCyan + "########################################" + ColorReset)
-	fmt.Println(ColorCyan + "#       " + ColorBold + "SugarCube Configuration" + ColorReset + ColorCyan + "      #" + ColorReset)
-	fmt.Println(ColorCyan + "########################################" + ColorReset)
+	out := SecretRedactor(os.Stdout)
+	fmt.Fprintln(out, ColorCyan+"########################################"+ColorReset)
+	fmt.Fprintln(out, ColorCyan+"#       "+ColorBold+"SugarCube Configuration"+ColorReset+ColorCyan+"      #"+ColorReset)
+	fmt.Fprintln(out, ColorCyan+"########################################"+ColorReset)
 
-	fmt.Printf(ColorGreen+"  %-18s:"+ColorReset+" %d\n", "Database Port", s.DbPort)
-	fmt.Printf(ColorGreen+"  %-18s:"+ColorReset+" %d\n", "Server Port", s.ServerPort)
-	fmt.Printf(ColorGreen+"  %-18s:"+ColorReset+" %s\n", "Database URI", s.DbUri)
+	if s.ConfigFile != "" {
+		fmt.Fprintf(out, ColorGreen+"  %-18s:"+ColorReset+" %s\n", "Config File", s.ConfigFile)
+	} else {
+		fmt.Fprintf(out, ColorYellow+"  %-18s:"+ColorReset+" %s\n", "Config File", "[not set]")
+	}
+
+	fmt.Fprintf(out, ColorGreen+"  %-18s:"+ColorReset+" %d\n", "Database Port", s.DB.Port)
+	fmt.Fprintf(out, ColorGreen+"  %-18s:"+ColorReset+" %d\n", "Server Port", s.Server.Port)
+	fmt.Fprintf(out, ColorGreen+"  %-18s:"+ColorReset+" %s\n", "Database URI", s.RedactedMongoURI())
+	fmt.Fprintf(out, ColorGreen+"  %-18s:"+ColorReset+" %s\n", "Database TLS", s.DB.TLS)
 
-	if s.DbUser != "" {
-		fmt.Printf(ColorGreen+"  %-18s:"+ColorReset+" %s\n", "Database User", s.DbUser)
+	if s.DB.User != "" {
+		fmt.Fprintf(out, ColorGreen+"  %-18s:"+ColorReset+" %s\n", "Database User", s.DB.User)
 	} else {
-		fmt.Printf(ColorYellow+"  %-18s:"+ColorReset+" %s\n", "Database User", "[not set]")
+		fmt.Fprintf(out, ColorYellow+"  %-18s:"+ColorReset+" %s\n", "Database User", "[not set]")
 	}
 
-	if s.DbPassword != "" {
-		fmt.Printf(ColorRed+"  %-18s:"+ColorReset+" %s\n", "Database Password", "[hidden]") // Hide for security
+	if s.DB.PasswordFile != "" {
+		fmt.Fprintf(out, ColorRed+"  %-18s:"+ColorReset+" %s (from %s)\n", "Database Password", "[hidden]", s.DB.PasswordFile)
+	} else if s.DB.Password != "" {
+		fmt.Fprintf(out, ColorRed+"  %-18s:"+ColorReset+" %s\n", "Database Password", "[hidden]") // Hide for security
 	} else {
-		fmt.Printf(ColorYellow+"  %-18s:"+ColorReset+" %s\n", "Database Password", "[not set]")
+		fmt.Fprintf(out, ColorYellow+"  %-18s:"+ColorReset+" %s\n", "Database Password", "[not set]")
 	}
 
-	fmt.Printf(ColorGreen+"  %-18s:"+ColorReset+" %t\n", "Debug Mode", s.Debug)
-	fmt.Println(ColorCyan + "########################################" + ColorReset)
-}
+	fmt.Fprintf(out, ColorGreen+"  %-18s:"+ColorReset+" %t\n", "Debug Mode", s.Debug)
+	fmt.Fprintf(out, ColorGreen+"  %-18s:"+ColorReset+" %s\n", "Log Privacy", s.Log.Privacy)
+	fmt.Fprintf(out, ColorGreen+"  %-18s:"+ColorReset+" %s (%s)\n", "Log Level", s.Log.Level, s.Log.Format)
+	if s.Log.StdoutOnly || s.Log.FilePath == "" {
+		fmt.Fprintf(out, ColorYellow+"  %-18s:"+ColorReset+" %s\n", "Log File", "[stdout only]")
+	} else {
+		fmt.Fprintf(out, ColorGreen+"  %-18s:"+ColorReset+" %s\n", "Log File", s.Log.FilePath)
+	}
 
-func (s SessionCtx) GetFullUri() string {
-	var buffer bytes.Buffer
-	buffer.WriteString(UriProtocol)
-	if s.DbUser != "" {
-		buffer.WriteString(s.DbUser)
-		buffer.WriteString(":")
+	if s.Tracing.Endpoint != "" {
+		fmt.Fprintf(out, ColorGreen+"  %-18s:"+ColorReset+" %s\n", "OTLP Endpoint", s.Tracing.Endpoint)
+		fmt.Fprintf(out, ColorGreen+"  %-18s:"+ColorReset+" %.2f\n", "Trace Sampling", s.Tracing.SampleRatio)
+	} else {
+		fmt.Fprintf(out, ColorYellow+"  %-18s:"+ColorReset+" %s\n", "Tracing", "[disabled]")
 	}
-	if s.DbPassword != "" {
-		buffer.WriteString(s.DbPassword)
-		buffer.WriteString("@")
+
+	fmt.Fprintf(out, ColorGreen+"  %-18s:"+ColorReset+" %s TTL, max %s, %s per IP\n", "Sessions", s.Sessions.TTL, limitString(s.Sessions.MaxSessions), limitString(s.Sessions.MaxPerIP))
+
+	if s.RateLimit.Enabled {
+		fmt.Fprintf(out, ColorGreen+"  %-18s:"+ColorReset+" %.1f/s, burst %d\n", "Rate Limit", s.RateLimit.RequestsPerSecond, s.RateLimit.Burst)
+	} else {
+		fmt.Fprintf(out, ColorYellow+"  %-18s:"+ColorReset+" %s\n", "Rate Limit", "[disabled]")
 	}
-	buffer.WriteString(s.DbUri)
-	buffer.WriteString(":")
-	buffer.WriteString(strconv.Itoa(int(s.DbPort)))
+	if len(s.CORS.AllowOrigins) > 0 {
+		fmt.Fprintf(out, ColorGreen+"  %-18s:"+ColorReset+" %s\n", "CORS Origins", strings.Join(s.CORS.AllowOrigins, ", "))
+	} else {
+		fmt.Fprintf(out, ColorYellow+"  %-18s:"+ColorReset+" %s\n", "CORS Origins", "[none]")
+	}
+	if s.Blocklist.Enabled {
+		fmt.Fprintf(out, ColorGreen+"  %-18s:"+ColorReset+" %d source(s) every %s\n", "IP Blocklist", len(s.Blocklist.Sources), s.Schedulers.BlocklistInterval)
+	} else {
+		fmt.Fprintf(out, ColorYellow+"  %-18s:"+ColorReset+" %s\n", "IP Blocklist", "[disabled]")
+	}
+	if len(s.Admin.APIKeys) > 0 {
+		fmt.Fprintf(out, ColorRed+"  %-18s:"+ColorReset+" %d [hidden]\n", "Admin API Keys", len(s.Admin.APIKeys))
+	} else {
+		fmt.Fprintf(out, ColorYellow+"  %-18s:"+ColorReset+" %s\n", "Admin API Keys", "[admin API disabled]")
+	}
+	fmt.Fprintf(out, ColorGreen+"  %-18s:"+ColorReset+" case sensitive: %t, %d site override(s)\n", "Coupon Codes", s.Coupons.CaseSensitive, len(s.Coupons.SiteCaseSensitive))
+	if s.GeoIP.Database != "" {
+		fmt.Fprintf(out, ColorGreen+"  %-18s:"+ColorReset+" %s\n", "GeoIP Database", s.GeoIP.Database)
+	} else {
+		fmt.Fprintf(out, ColorYellow+"  %-18s:"+ColorReset+" %s\n", "GeoIP Database", "[disabled, regions from the request only]")
+	}
+	if s.Reputation.Enabled {
+		fmt.Fprintf(out, ColorGreen+"  %-18s:"+ColorReset+" trusted from %.2f after %d outcomes, promote at %.1f, bootstrap: %t\n", "Reputation", s.Reputation.TrustedAbove, s.Reputation.MinOutcomes, s.Reputation.PromoteScore, s.Reputation.Bootstrap)
+	} else {
+		fmt.Fprintf(out, ColorYellow+"  %-18s:"+ColorReset+" %s\n", "Reputation", "[disabled, every vote counts the same]")
+	}
+	fmt.Fprintf(out, ColorGreen+"  %-18s:"+ColorReset+" 1 per %s, burst %d from <= %d IPs in %s\n", "Vote Screening",
+		s.Votes.DedupWindow, s.Votes.BurstFailures, s.Votes.BurstMaxSources, s.Votes.BurstWindow)
+	if len(s.Auth.TokenSecrets) > 0 {
+		fmt.Fprintf(out, ColorRed+"  %-18s:"+ColorReset+" %d [hidden], required: %t\n", "Token Secrets", len(s.Auth.TokenSecrets), s.Auth.RequireInstallToken)
+	} else {
+		fmt.Fprintf(out, ColorYellow+"  %-18s:"+ColorReset+" %s\n", "Token Secrets", "[random, tokens reset on restart]")
+	}
+	fmt.Fprintf(out, ColorGreen+"  %-18s:"+ColorReset+" %s per IP per hour\n", "Registrations", limitString(s.Auth.RegistrationsPerIP))
+	fmt.Fprintln(out, ColorCyan+"########################################"+ColorReset)
+}
 
-	return buffer.String()
+func limitString(limit uint64) string {
+	if limit == 0 {
+		return "unlimited"
+	}
+	return strconv.FormatUint(limit, 10)
 }
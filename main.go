@@ -2,144 +2,113 @@ package main
 
 import (
 	"context"
-	"net/http"
+	"fmt"
 	"os"
 	"os/signal"
-	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/MisterNorwood/SugarCube-Server/cmd"
-	"github.com/MisterNorwood/SugarCube-Server/internal/api"
-	apiHandler "github.com/MisterNorwood/SugarCube-Server/internal/api"
-	"github.com/MisterNorwood/SugarCube-Server/internal/middleware"
-	"github.com/MisterNorwood/SugarCube-Server/internal/services"
 	"github.com/MisterNorwood/SugarCube-Server/internal/utils"
-	"github.com/labstack/echo/v4"
+	"github.com/MisterNorwood/SugarCube-Server/pkg/server"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-	"go.mongodb.org/mongo-driver/v2/mongo"
-	"go.mongodb.org/mongo-driver/v2/mongo/options"
 )
 
-var (
-	SessionCtx         *utils.SessionCtx
-	DBClient           *mongo.Client
-	WebServer          *echo.Echo
-	ProgramContext     *context.Context
-	UserSessionManager *services.SessionManager
+const (
+	// How long startup may take, mostly waiting for the database
+	startTimeout = 10 * time.Second
+	// How long shutdown may take before remaining components are abandoned
+	shutdownTimeout = 10 * time.Second
 )
 
 func main() {
+	config := cmd.Execute()
+	if config.IsEmpty() {
+		os.Exit(0)
+	}
+
 	// initialize logger
-	utils.InitLogger()
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	if err := utils.InitLogger(config.Log); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	config.PrintEnv()
 
-	session := cmd.Execute()
-	if session.IsEmpty() {
-		os.Exit(0)
+	log.Info().Str("version", "1.0.0").Str("hostname", getHostname()).Msg("Initializing application...")
+	app, err := server.New(*config)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to initialize application")
+		utils.CloseLogger()
+		os.Exit(1)
 	}
-	SessionCtx = session
-	SessionCtx.PrintEnv()
 
 	go func() {
-		err := Init(SessionCtx)
-		if err != nil {
-			os.Exit(1)
+		ctx, cancel := context.WithTimeout(context.Background(), startTimeout)
+		defer cancel()
+		if err := app.Start(ctx); err != nil {
+			app.Lifecycle.Fail(err)
 		}
 	}()
 
+	// os.Kill can't be caught, SIGTERM is what Docker, Kubernetes and systemd send
 	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, os.Interrupt, os.Kill)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+
+	exitCode := 0
+	for waiting := true; waiting; {
+		select {
+		case <-reload:
+			reloadConfig(app)
+		case sig := <-quit:
+			log.Warn().Str("signal", sig.String()).Msg("Shutting down server...")
+			waiting = false
+		case err := <-app.Failed():
+			log.Error().Err(err).Msg("Shutting down after a fatal error...")
+			exitCode = 1
+			waiting = false
+		}
+	}
 
-	<-quit
-	log.Warn().Msg("Shutting down server...")
+	// A second signal skips the graceful part
+	go func() {
+		<-quit
+		log.Warn().Msg("Received second signal, exiting immediately")
+		os.Exit(1)
+	}()
 
-	// Shutdown logic
-	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
 	defer cancel()
-
-	// Gracefully shutdown Echo server
-	if WebServer != nil {
-		if err := WebServer.Shutdown(shutdownCtx); err != nil {
-			log.Error().Err(err).Msg("Error shutting down Echo server")
-		} else {
-			log.Info().Msg("Echo server shut down gracefully")
-		}
+	if err := app.Stop(shutdownCtx); err != nil {
+		exitCode = 1
 	}
-
-	// Gracefully disconnect from MongoDB
-	if DBClient != nil {
-		if err := DBClient.Disconnect(shutdownCtx); err != nil {
-			log.Error().Err(err).Msg("Error closing MongoDB connection")
-		} else {
-			log.Info().Msg("MongoDB connection closed gracefully")
-		}
+	if exitCode == 0 {
+		log.Warn().Msg("Application exited cleanly")
+	} else {
+		log.Warn().Msg("Application exited with errors")
 	}
-
-	log.Warn().Msg("Application exited cleanly")
+	utils.CloseLogger()
+	os.Exit(exitCode)
 }
 
-func Init(UserSession *utils.SessionCtx) error {
-	// Context
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	ProgramContext = &ctx
-
-	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
-
-	log.Info().Str("version", "1.0.0").Str("hostname", getHostname()).Msg("Initializing application...")
+// reloadConfig re-reads the config file and environment on SIGHUP
+func reloadConfig(app *server.App) {
+	log.Info().Msg("Received SIGHUP, reloading configuration...")
 
-	// MongoDB Setup
-	client, err := mongo.Connect(options.Client().ApplyURI(SessionCtx.GetFullUri()))
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to create MongoDB client")
-		return err
+	next, err := cmd.Load(os.Args)
+	if err == nil && next.IsEmpty() {
+		err = fmt.Errorf("configuration is empty")
 	}
-	DBClient = client
-	middleware.DBMiddlewareClient = DBClient
-	api.ApiClient = DBClient.Database("sugarcube")
-
-	log.Info().Str("uri", SessionCtx.GetFullUri()).Msg("Attempting to ping database...")
-
-	err = DBClient.Ping(ctx, nil)
-	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to Ping the database")
-		return err
+	if err == nil {
+		err = app.Reload(*next)
 	}
-	log.Info().Msg("Successfully connected to MongoDB server")
-
-	services.InitBanLists(DBClient.Database("sugarcube_admin"), *ProgramContext)
-
-	UserSessionManager = services.NewSessionManager()
-	UserSessionManager.StartPruner()
-	apiHandler.SessionManager = UserSessionManager
-	services.StartNegativeScorePruner(DBClient.Database(("sugarcube")))
-
-	// Echo Server Setup
-	e := echo.New()
-	e.HideBanner = true
-	e.HidePort = true
-
-	// Middleware
-	e.Use(middleware.GlobalHeaderMiddleware)
-	e.Use(middleware.ZeroLogMiddleware)
-	e.Use(middleware.CheckIPBanList)
-	if !UserSession.Debug {
-		e.Use(middleware.CheckUserAgent)
+	if err != nil {
+		log.Error().Err(err).Msg("Rejected configuration reload, keeping the running configuration")
 	}
-
-	// Routes
-	setupRoutes(e)
-
-	port := strconv.FormatUint(uint64(SessionCtx.ServerPort), 10)
-	go func() {
-		log.Info().Str("port", port).Msg("Starting Echo web server")
-		if err := e.Start(":" + port); err != nil && err != http.ErrServerClosed {
-			log.Fatal().Err(err).Msg("Failed to start Echo server")
-		}
-	}()
-
-	WebServer = e
-	return nil
 }
 
 func getHostname() string {
@@ -149,12 +118,3 @@ func getHostname() string {
 	}
 	return hostname
 }
-
-func setupRoutes(e *echo.Echo) {
-	api := e.Group("/api")
-
-	api.GET("/coupons", apiHandler.GetCouponsForPage)
-	api.POST("/coupons", apiHandler.AddCouponToSite)
-	api.POST("/site", apiHandler.RequestAddSite)
-	api.POST("/callback", apiHandler.RecieveCallBack)
-}
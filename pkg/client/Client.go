@@ -0,0 +1,378 @@
+// Package client is a Go client for the SugarCube API. It sets the API version
+// header, retries requests that are safe to retry and turns error responses into *APIError.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/MisterNorwood/SugarCube-Server/pkg/types"
+)
+
+// The client speaks one API version, the server keeps older ones for old extension builds
+const (
+	apiVersion = types.APIVersionV2
+	apiPrefix  = "/api/" + apiVersion
+)
+
+type Client struct {
+	baseURL    *url.URL
+	httpClient *http.Client
+	adminKey   string
+	userAgent  string
+	region     string
+	// Set by WithInstallToken or Register
+	installToken atomic.Pointer[string]
+
+	maxRetries int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+type Option func(*Client)
+
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithAdminKey sets the key sent to the /api/admin endpoints
+func WithAdminKey(key string) Option {
+	return func(c *Client) { c.adminKey = key }
+}
+
+// WithInstallToken sets the token from an earlier Register, required for writes and callbacks
+func WithInstallToken(token string) Option {
+	return func(c *Client) { c.installToken.Store(&token) }
+}
+
+// WithRegion sets the country coupon lists and sessions are for, e.g. "DE".
+// Without it the server goes by the client's IP or Accept-Language.
+func WithRegion(region string) Option {
+	return func(c *Client) { c.region = region }
+}
+
+func WithUserAgent(ua string) Option {
+	return func(c *Client) { c.userAgent = ua }
+}
+
+// WithRetries sets how often a failed request is retried, 0 disables retries.
+// The wait doubles from minBackoff up to maxBackoff, a Retry-After header takes precedence.
+func WithRetries(max int, minBackoff, maxBackoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = max
+		c.minBackoff = minBackoff
+		c.maxBackoff = maxBackoff
+	}
+}
+
+// New creates a client for the server at baseURL, e.g. "https://sugarcube.example.com"
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(strings.TrimRight(baseURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("client: invalid base URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("client: base URL must be http or https, got %q", baseURL)
+	}
+	c := &Client{
+		baseURL:    u,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		userAgent:  "sugarcube-go-client",
+		maxRetries: 3,
+		minBackoff: 200 * time.Millisecond,
+		maxBackoff: 5 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// Register registers this install and uses the token for the following requests.
+// Store the token and pass it to WithInstallToken next time instead of registering again.
+func (c *Client) Register(ctx context.Context) (*types.RegisterResponse, error) {
+	var resp types.RegisterResponse
+	if err := c.do(ctx, http.MethodPost, apiPrefix+"/register", nil, nil, &resp, false); err != nil {
+		return nil, err
+	}
+	c.installToken.Store(&resp.Token)
+	return &resp, nil
+}
+
+// GetCoupons returns the coupons of a site
+func (c *Client) GetCoupons(ctx context.Context, site string) (*types.CouponsResponse, error) {
+	var resp types.CouponsResponse
+	err := c.do(ctx, http.MethodGet, apiPrefix+"/coupons", c.siteQuery(site), nil, &resp, false)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// FilterCoupons returns the coupons of a site that pass the filter
+func (c *Client) FilterCoupons(ctx context.Context, site string, filter types.CouponFilter) (*types.CouponsResponse, error) {
+	query := c.siteQuery(site)
+	if filter.DiscountType != "" {
+		query.Set("discount_type", filter.DiscountType)
+	}
+	if filter.FreeShipping {
+		query.Set("free_shipping", "true")
+	}
+	if filter.CartTotal > 0 {
+		query.Set("cart_total", strconv.FormatFloat(filter.CartTotal, 'f', -1, 64))
+	}
+	if filter.Category != "" {
+		query.Set("category", filter.Category)
+	}
+	if filter.ExcludeFirstOrder {
+		query.Set("first_order", "false")
+	}
+	if filter.SortByScore {
+		query.Set("sort", "score")
+	}
+	if filter.Currency != "" {
+		query.Set("currency", filter.Currency)
+	}
+	var resp types.CouponsResponse
+	if err := c.do(ctx, http.MethodGet, apiPrefix+"/coupons", query, nil, &resp, false); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// OpenSession opens a session for testing coupons on a site, report the results with SendCallback
+func (c *Client) OpenSession(ctx context.Context, site string, coupons []string) (*types.SessionResponse, error) {
+	var resp types.SessionResponse
+	err := c.do(ctx, http.MethodPost, apiPrefix+"/session", c.siteQuery(site), types.SessionRequest{Coupons: coupons}, &resp, false)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) siteQuery(site string) url.Values {
+	query := url.Values{"site": {site}}
+	if c.region != "" {
+		query.Set("region", c.region)
+	}
+	return query
+}
+
+func (c *Client) AddCoupon(ctx context.Context, site string, coupon types.CouponEntry) error {
+	return c.do(ctx, http.MethodPost, apiPrefix+"/coupons", url.Values{"site": {site}}, coupon, nil, false)
+}
+
+func (c *Client) AddSite(ctx context.Context, site string) error {
+	return c.do(ctx, http.MethodPost, apiPrefix+"/site", url.Values{"url": {site}}, nil, nil, false)
+}
+
+// SendCallback reports which coupons worked, using the SessionID from OpenSession
+func (c *Client) SendCallback(ctx context.Context, callback types.CallbackRequest) error {
+	return c.do(ctx, http.MethodPost, apiPrefix+"/callback", nil, callback, nil, false)
+}
+
+// BanIP adds a manual ban, requires WithAdminKey
+func (c *Client) BanIP(ctx context.Context, ip string, reason string) error {
+	return c.do(ctx, http.MethodPost, "/api/admin/bans", nil, types.BanRequest{IP: ip, Reason: reason}, nil, true)
+}
+
+// UnbanIP removes a ban, requires WithAdminKey. Returns an error matching ErrNotFound if the IP isn't banned.
+func (c *Client) UnbanIP(ctx context.Context, ip string) error {
+	return c.do(ctx, http.MethodDelete, "/api/admin/bans/"+url.PathEscape(ip), nil, nil, nil, true)
+}
+
+// RevokeInstall blocks an install's token, requires WithAdminKey. Returns an error matching ErrNotFound for unknown installs.
+func (c *Client) RevokeInstall(ctx context.Context, installID, reason string) error {
+	var query url.Values
+	if reason != "" {
+		query = url.Values{"reason": {reason}}
+	}
+	return c.do(ctx, http.MethodDelete, "/api/admin/installs/"+url.PathEscape(installID), query, nil, nil, true)
+}
+
+// SessionStats returns the server's session counts and limits, requires WithAdminKey
+func (c *Client) SessionStats(ctx context.Context) (*types.SessionStats, error) {
+	var stats types.SessionStats
+	if err := c.do(ctx, http.MethodGet, "/api/admin/sessions", nil, nil, &stats, true); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// MergeCoupons merges variants of coupon codes on a site, every site if site is empty, requires WithAdminKey
+func (c *Client) MergeCoupons(ctx context.Context, site string) (*types.MergeReport, error) {
+	var query url.Values
+	if site != "" {
+		query = url.Values{"site": {site}}
+	}
+	var report types.MergeReport
+	if err := c.do(ctx, http.MethodPost, "/api/admin/coupons/merge", query, nil, &report, true); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// ListPending returns the pending coupons of a site, every site if site is empty, requires WithAdminKey
+func (c *Client) ListPending(ctx context.Context, site string) ([]types.PendingCoupon, error) {
+	var query url.Values
+	if site != "" {
+		query = url.Values{"site": {site}}
+	}
+	var pending []types.PendingCoupon
+	if err := c.do(ctx, http.MethodGet, "/api/admin/coupons/pending", query, nil, &pending, true); err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
+
+// ResolvePending makes a pending coupon live (approve) or deletes it, requires WithAdminKey.
+// Returns an error matching ErrNotFound if the coupon isn't pending.
+func (c *Client) ResolvePending(ctx context.Context, site, coupon string, approve bool) error {
+	action := "/reject"
+	if approve {
+		action = "/approve"
+	}
+	return c.do(ctx, http.MethodPost, "/api/admin/coupons/pending"+action, url.Values{"site": {site}, "coupon": {coupon}}, nil, nil, true)
+}
+
+// ListQuarantine returns the open quarantine cases, requires WithAdminKey
+func (c *Client) ListQuarantine(ctx context.Context) ([]types.QuarantineCase, error) {
+	var cases []types.QuarantineCase
+	if err := c.do(ctx, http.MethodGet, "/api/admin/quarantine", nil, nil, &cases, true); err != nil {
+		return nil, err
+	}
+	return cases, nil
+}
+
+// ResolveQuarantine applies (approve) or discards the held back votes of a case, requires WithAdminKey
+func (c *Client) ResolveQuarantine(ctx context.Context, caseID string, approve bool) error {
+	action := "/reject"
+	if approve {
+		action = "/approve"
+	}
+	return c.do(ctx, http.MethodPost, "/api/admin/quarantine/"+url.PathEscape(caseID)+action, nil, nil, nil, true)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, out any, admin bool) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return fmt.Errorf("client: encoding request: %w", err)
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(ctx, method, path, query, payload, admin)
+		if err == nil && resp.StatusCode < 300 {
+			defer resp.Body.Close()
+			if out == nil {
+				return nil
+			}
+			if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+				return fmt.Errorf("client: decoding response: %w", err)
+			}
+			return nil
+		}
+
+		var wait time.Duration
+		if err == nil {
+			err = readAPIError(resp)
+			wait = retryAfter(resp)
+		}
+		if attempt >= c.maxRetries || !retryable(method, err) {
+			return err
+		}
+		if wait == 0 {
+			wait = c.backoff(attempt)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (c *Client) send(ctx context.Context, method, path string, query url.Values, payload []byte, admin bool) (*http.Response, error) {
+	u := *c.baseURL
+	u.Path += path
+	u.RawQuery = query.Encode()
+
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("client: building request: %w", err)
+	}
+	req.Header.Set(types.APIVersionHeader, apiVersion)
+	req.Header.Set("User-Agent", c.userAgent)
+	req.Header.Set("Accept", "application/json")
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if admin && c.adminKey != "" {
+		req.Header.Set(types.AdminKeyHeader, c.adminKey)
+	}
+	if token := c.installToken.Load(); !admin && token != nil {
+		req.Header.Set(types.InstallTokenHeader, *token)
+	}
+	return c.httpClient.Do(req)
+}
+
+// Requests that may have reached a handler are only retried when repeating them is harmless
+func retryable(method string, err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	idempotent := method == http.MethodGet || method == http.MethodDelete
+
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		// Transport error, we can't tell whether the server got the request
+		return idempotent
+	}
+	switch apiErr.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return idempotent
+	}
+	return false
+}
+
+func (c *Client) backoff(attempt int) time.Duration {
+	wait := c.minBackoff << attempt
+	if wait <= 0 || wait > c.maxBackoff {
+		wait = c.maxBackoff
+	}
+	// Full jitter keeps many clients from retrying in lockstep
+	return time.Duration(rand.Int64N(int64(wait)) + 1)
+}
+
+func retryAfter(resp *http.Response) time.Duration {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(time.Until(at), 0)
+	}
+	return 0
+}
@@ -0,0 +1,234 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MisterNorwood/SugarCube-Server/pkg/types"
+)
+
+// testServer answers every request with handler and counts the requests
+func testServer(t *testing.T, handler func(w http.ResponseWriter, r *http.Request, n int32)) (*Client, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler(w, r, requests.Add(1))
+	}))
+	t.Cleanup(server.Close)
+	c, err := New(server.URL, WithRetries(3, time.Millisecond, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, &requests
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(types.ErrorResponse{Error: message, Code: code, RequestID: "req-1"})
+}
+
+func TestRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		status   int
+		requests int32
+	}{
+		{"get on 503", http.MethodGet, http.StatusServiceUnavailable, 4},
+		{"get on 502", http.MethodGet, http.StatusBadGateway, 4},
+		{"get on 500", http.MethodGet, http.StatusInternalServerError, 1},
+		{"get on 404", http.MethodGet, http.StatusNotFound, 1},
+		{"post on 503", http.MethodPost, http.StatusServiceUnavailable, 4},
+		{"post on 429", http.MethodPost, http.StatusTooManyRequests, 4},
+		{"post on 500", http.MethodPost, http.StatusInternalServerError, 1},
+		{"post on 502", http.MethodPost, http.StatusBadGateway, 1},
+		{"post on 504", http.MethodPost, http.StatusGatewayTimeout, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, requests := testServer(t, func(w http.ResponseWriter, r *http.Request, _ int32) {
+				if r.Method != tt.method {
+					t.Errorf("got a %s", r.Method)
+				}
+				writeError(w, tt.status, codeForStatus(tt.status), http.StatusText(tt.status))
+			})
+
+			var err error
+			if tt.method == http.MethodGet {
+				_, err = c.GetCoupons(context.Background(), "example.com")
+			} else {
+				err = c.AddSite(context.Background(), "example.com")
+			}
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) || apiErr.StatusCode != tt.status {
+				t.Fatalf("got %v, want a %d APIError", err, tt.status)
+			}
+			if got := requests.Load(); got != tt.requests {
+				t.Fatalf("sent %d requests, want %d", got, tt.requests)
+			}
+		})
+	}
+}
+
+func TestRetrySucceeds(t *testing.T) {
+	c, requests := testServer(t, func(w http.ResponseWriter, r *http.Request, n int32) {
+		if n < 3 {
+			writeError(w, http.StatusServiceUnavailable, types.CodeUnavailable, "try again")
+			return
+		}
+		_ = json.NewEncoder(w).Encode(types.CouponsResponse{Site: types.Site{Name: "example.com"}})
+	})
+	resp, err := c.GetCoupons(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Site.Name != "example.com" || requests.Load() != 3 {
+		t.Fatalf("got %+v after %d requests", resp, requests.Load())
+	}
+}
+
+func TestRetryAfterHonored(t *testing.T) {
+	c, requests := testServer(t, func(w http.ResponseWriter, r *http.Request, n int32) {
+		if n == 1 {
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusTooManyRequests, types.CodeRateLimited, "slow down")
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	start := time.Now()
+	if err := c.AddSite(context.Background(), "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited < time.Second {
+		t.Fatalf("retried after %v, Retry-After asked for 1s", waited)
+	}
+	if requests.Load() != 2 {
+		t.Fatalf("sent %d requests, want 2", requests.Load())
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		value    string
+		min, max time.Duration
+	}{
+		{"", 0, 0},
+		{"5", 5 * time.Second, 5 * time.Second},
+		{"0", 0, 0},
+		{"-3", 0, 0},
+		{"soon", 0, 0},
+		{time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), 58 * time.Second, time.Minute},
+		{time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), 0, 0},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{Header: http.Header{}}
+		if tt.value != "" {
+			resp.Header.Set("Retry-After", tt.value)
+		}
+		if got := retryAfter(resp); got < tt.min || got > tt.max {
+			t.Errorf("retryAfter(%q) = %v, want %v to %v", tt.value, got, tt.min, tt.max)
+		}
+	}
+}
+
+func TestCancelStopsRetries(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, requests := testServer(t, func(w http.ResponseWriter, r *http.Request, _ int32) {
+		// Cancelled while the client waits out Retry-After
+		w.Header().Set("Retry-After", "60")
+		writeError(w, http.StatusServiceUnavailable, types.CodeUnavailable, "try again")
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			cancel()
+		}()
+	})
+
+	start := time.Now()
+	_, err := c.GetCoupons(ctx, "example.com")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	if time.Since(start) > 10*time.Second || requests.Load() != 1 {
+		t.Fatalf("sent %d requests in %v", requests.Load(), time.Since(start))
+	}
+}
+
+func TestErrorMatching(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		code   string
+		want   error
+	}{
+		{"session not found", http.StatusForbidden, types.CodeForbidden, ErrForbidden},
+		{"invalid coupon", http.StatusBadRequest, types.CodeInvalid, ErrBadRequest},
+		{"bad request", http.StatusBadRequest, types.CodeBadRequest, ErrBadRequest},
+		{"unknown site", http.StatusNotFound, types.CodeNotFound, ErrNotFound},
+		{"site exists", http.StatusConflict, types.CodeConflict, ErrConflict},
+		{"no token", http.StatusUnauthorized, types.CodeUnauthorized, ErrUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := testServer(t, func(w http.ResponseWriter, r *http.Request, _ int32) {
+				writeError(w, tt.status, tt.code, tt.name)
+			})
+			err := c.SendCallback(context.Background(), types.CallbackRequest{Site: "example.com"})
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("%v doesn't match %v", err, tt.want)
+			}
+			if errors.Is(err, ErrUnavailable) {
+				t.Fatalf("%v matches ErrUnavailable", err)
+			}
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) || apiErr.Message != tt.name || apiErr.RequestID != "req-1" {
+				t.Fatalf("got %+v", apiErr)
+			}
+		})
+	}
+}
+
+func TestErrorFromProxy(t *testing.T) {
+	c, _ := testServer(t, func(w http.ResponseWriter, r *http.Request, _ int32) {
+		w.Header().Set(types.RequestIDHeader, "req-2")
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte("<html>not here</html>"))
+	})
+	err := c.AddSite(context.Background(), "example.com")
+	var apiErr *APIError
+	if !errors.Is(err, ErrNotFound) || !errors.As(err, &apiErr) || apiErr.RequestID != "req-2" {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	c, _ := testServer(t, func(w http.ResponseWriter, r *http.Request, _ int32) {
+		if got := r.Header.Get(types.APIVersionHeader); got != types.APIVersionV2 {
+			t.Errorf("version header %q", got)
+		}
+		admin := r.URL.Path == "/api/admin/sessions"
+		if got := r.Header.Get(types.AdminKeyHeader); (got == "key") != admin {
+			t.Errorf("%s got admin key %q", r.URL.Path, got)
+		}
+		if got := r.Header.Get(types.InstallTokenHeader); (got == "token") == admin {
+			t.Errorf("%s got install token %q", r.URL.Path, got)
+		}
+		_, _ = w.Write([]byte("{}"))
+	})
+	WithAdminKey("key")(c)
+	WithInstallToken("token")(c)
+	if _, err := c.SessionStats(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetCoupons(context.Background(), "example.com"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,105 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/MisterNorwood/SugarCube-Server/pkg/types"
+)
+
+// Match an *APIError with errors.Is by its code
+var (
+	ErrBadRequest   = errors.New("bad request")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+	ErrNotFound     = errors.New("not found")
+	ErrConflict     = errors.New("conflict")
+	ErrRateLimited  = errors.New("rate limited")
+	ErrUnavailable  = errors.New("service unavailable")
+)
+
+// APIError is an error response from the server
+type APIError struct {
+	StatusCode int
+	Code       string // types.Code* value
+	Message    string
+	RequestID  string // Quote this when reporting a problem, it's in the server logs
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("sugarcube: %d %s: %s", e.StatusCode, e.Code, e.Message)
+	if e.RequestID != "" {
+		msg += " (request " + e.RequestID + ")"
+	}
+	return msg
+}
+
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrBadRequest:
+		return e.Code == types.CodeBadRequest || e.Code == types.CodeInvalid
+	case ErrUnauthorized:
+		return e.Code == types.CodeUnauthorized
+	case ErrForbidden:
+		return e.Code == types.CodeForbidden
+	case ErrNotFound:
+		return e.Code == types.CodeNotFound
+	case ErrConflict:
+		return e.Code == types.CodeConflict
+	case ErrRateLimited:
+		return e.Code == types.CodeRateLimited
+	case ErrUnavailable:
+		return e.Code == types.CodeUnavailable
+	}
+	return false
+}
+
+// readAPIError consumes the body of a failed response
+func readAPIError(resp *http.Response) error {
+	defer resp.Body.Close()
+	apiErr := &APIError{
+		StatusCode: resp.StatusCode,
+		RequestID:  resp.Header.Get(types.RequestIDHeader),
+	}
+
+	var body types.ErrorResponse
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err := json.Unmarshal(data, &body); err == nil && body.Code != "" {
+		apiErr.Code, apiErr.Message = body.Code, body.Error
+		if body.RequestID != "" {
+			apiErr.RequestID = body.RequestID
+		}
+		return apiErr
+	}
+
+	// Not one of ours, e.g. a proxy error page
+	apiErr.Code = codeForStatus(resp.StatusCode)
+	apiErr.Message = http.StatusText(resp.StatusCode)
+	return apiErr
+}
+
+func codeForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return types.CodeBadRequest
+	case http.StatusUnauthorized:
+		return types.CodeUnauthorized
+	case http.StatusForbidden:
+		return types.CodeForbidden
+	case http.StatusNotFound:
+		return types.CodeNotFound
+	case http.StatusConflict:
+		return types.CodeConflict
+	case http.StatusTooManyRequests:
+		return types.CodeRateLimited
+	case http.StatusServiceUnavailable:
+		return types.CodeUnavailable
+	}
+	if status >= http.StatusInternalServerError {
+		return types.CodeInternal
+	}
+	return types.CodeError
+}
@@ -0,0 +1,300 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/MisterNorwood/SugarCube-Server/internal/api"
+	"github.com/MisterNorwood/SugarCube-Server/internal/database"
+	"github.com/MisterNorwood/SugarCube-Server/internal/geoip"
+	"github.com/MisterNorwood/SugarCube-Server/internal/lifecycle"
+	"github.com/MisterNorwood/SugarCube-Server/internal/middleware"
+	"github.com/MisterNorwood/SugarCube-Server/internal/openapi"
+	"github.com/MisterNorwood/SugarCube-Server/internal/services"
+	"github.com/MisterNorwood/SugarCube-Server/internal/telemetry"
+	"github.com/MisterNorwood/SugarCube-Server/internal/utils"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	CouponDatabase = "sugarcube"
+	AdminDatabase  = "sugarcube_admin"
+)
+
+// Config is the full server configuration, see configs/sugarcube.example.yaml
+type Config = utils.SessionCtx
+
+func DefaultConfig() Config {
+	return utils.DefaultConfig()
+}
+
+// App is one SugarCube server: its database client, background jobs and HTTP server.
+// Nothing is kept in package state, so several Apps can run in one process.
+type App struct {
+	Echo       *echo.Echo
+	DB         *mongo.Client
+	Lifecycle  *lifecycle.Manager
+	Sessions   *services.SessionManager
+	Installs   *services.InstallService
+	Reputation *services.ReputationService
+	Votes      *services.VoteGuard
+	Feed       *services.CouponFeed
+	Cache      *services.SiteCache
+	Bans       *services.BanService
+	Handler    *api.Handler
+	Spec       *openapi.Spec
+
+	log      zerolog.Logger
+	listener net.Listener
+
+	mu  sync.Mutex
+	cfg Config
+
+	blocklist    *services.BlocklistUpdater
+	couponPruner *services.PeriodicJob
+	rateLimiter  *middleware.RateLimiter
+	cors         *middleware.CORS
+	versions     *middleware.APIVersions
+	installAuth  *middleware.InstallAuth
+	adminAuth    *middleware.AdminAuth
+}
+
+type Option func(*App)
+
+// WithMongoClient uses an existing client instead of connecting with the db settings.
+// The App still disconnects it on Stop.
+func WithMongoClient(client *mongo.Client) Option {
+	return func(a *App) { a.DB = client }
+}
+
+// WithListener serves HTTP on l instead of listening on server.port, e.g. a random port in tests
+func WithListener(l net.Listener) Option {
+	return func(a *App) { a.listener = l }
+}
+
+// WithLogger sets the logger for the App's own lifecycle and reload messages
+func WithLogger(logger zerolog.Logger) Option {
+	return func(a *App) { a.log = logger }
+}
+
+// New wires an App from cfg. Nothing runs until Start.
+func New(cfg Config, opts ...Option) (*App, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	a := &App{
+		cfg:       cfg,
+		log:       log.Logger,
+		Lifecycle: lifecycle.New(),
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+
+	// Before connecting, so a bad file doesn't leave a client behind
+	var geoIP *geoip.Reader
+	if cfg.GeoIP.Database != "" {
+		reader, err := geoip.Open(cfg.GeoIP.Database)
+		if err != nil {
+			return nil, err
+		}
+		geoIP = reader
+	}
+
+	if a.DB == nil {
+		uri, err := cfg.MongoURI()
+		if err != nil {
+			return nil, err
+		}
+		// Connect doesn't do any I/O, the first ping happens in Start
+		client, err := mongo.Connect(options.Client().
+			ApplyURI(uri).
+			SetMonitor(telemetry.NewMongoMonitor()))
+		if err != nil {
+			return nil, err
+		}
+		a.DB = client
+	}
+	coupons := a.DB.Database(CouponDatabase)
+	a.Bans = services.NewBanService(a.DB.Database(AdminDatabase))
+	a.Sessions = services.NewSessionManager(cfg.Sessions)
+	a.Installs = services.NewInstallService(a.DB.Database(AdminDatabase), cfg.Auth.TokenSecrets)
+	a.Installs.SetRegistrationLimit(cfg.Auth.RegistrationsPerIP)
+	if len(cfg.Auth.TokenSecrets) == 0 {
+		a.log.Warn().Msg("No install token secret configured, using a random one. Installs have to register again after a restart")
+	}
+	if !cfg.Auth.RequireInstallToken {
+		a.log.Warn().Msg("Install tokens aren't required on writes and callbacks. Set auth.require_install_token once old extension builds are gone, it becomes the default in the next release")
+	}
+	a.Reputation = services.NewReputationService(a.DB.Database(AdminDatabase), cfg.Reputation)
+	a.Votes = services.NewVoteGuard(a.DB.Database(AdminDatabase), cfg.Votes)
+	a.Feed = services.NewCouponFeed(coupons, cfg.Stream.MaxSubscribers)
+	a.Feed.SetMaxPerIP(cfg.Stream.MaxPerIP)
+	a.Cache = services.NewSiteCache(cfg.Cache)
+	// Catches changes made through other instances once the change stream runs
+	a.Feed.OnChange(a.Cache.Invalidate)
+	a.Handler = api.NewHandler(coupons, a.Sessions, a.Bans, a.Installs, a.Reputation, a.Votes, a.Feed, a.Cache, geoIP)
+	a.Handler.SetStreamHeartbeat(cfg.Stream.Heartbeat)
+	a.Handler.SetCouponConfig(cfg.Coupons)
+	a.blocklist = services.NewBlocklistUpdater(a.Bans, cfg.Schedulers.BlocklistInterval, cfg.Blocklist.Sources)
+	a.couponPruner = services.NewCouponPruner(coupons, a.Feed, a.Cache, cfg.Schedulers.CouponPruneInterval)
+
+	a.setupEcho()
+	a.registerComponents()
+	return a, nil
+}
+
+// Config returns a copy of the running configuration
+func (a *App) Config() Config {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.cfg
+}
+
+// Start connects to the database, starts the background jobs and then serves HTTP
+func (a *App) Start(ctx context.Context) error {
+	return a.Lifecycle.Start(ctx)
+}
+
+// Stop shuts everything down in reverse order, see lifecycle.Manager
+func (a *App) Stop(ctx context.Context) error {
+	return a.Lifecycle.Stop(ctx)
+}
+
+// Failed delivers a fatal error from a running component, e.g. the HTTP server dying
+func (a *App) Failed() <-chan error {
+	return a.Lifecycle.Failed()
+}
+
+func (a *App) setupEcho() {
+	e := echo.New()
+	e.HideBanner = true
+	e.HidePort = true
+	e.HTTPErrorHandler = api.HTTPErrorHandler
+
+	// Middleware
+	a.cors = middleware.NewCORS(a.cfg.CORS)
+	a.Handler.AllowOrigin = a.cors.Allowed
+	a.installAuth = middleware.NewInstallAuth(a.Installs, a.cfg.Auth.RequireInstallToken)
+	a.rateLimiter = middleware.NewRateLimiter(a.cfg.RateLimit, a.installAuth.ClientKey)
+	e.Use(middleware.GlobalHeaderMiddleware)
+	e.Use(middleware.RequestIDMiddleware)
+	e.Use(middleware.TracingMiddleware)
+	e.Use(middleware.ZeroLogMiddleware)
+	e.Use(a.cors.Middleware)
+	e.Use(middleware.NewIPBanCheck(a.Bans).Middleware)
+	e.Use(a.rateLimiter.Middleware)
+
+	a.Echo = e
+	a.setupRoutes()
+}
+
+// Registration order is start order; shutdown runs in reverse
+func (a *App) registerComponents() {
+	var tracerShutdown func(context.Context) error
+	// First to start so spans from the rest of shutdown are still flushed
+	a.Lifecycle.Register("tracing", lifecycle.Hooks{
+		OnStart: func(ctx context.Context) error {
+			shutdown, err := telemetry.InitTracer(ctx, a.Config().Tracing)
+			tracerShutdown = shutdown
+			return err
+		},
+		OnStop: func(ctx context.Context) error {
+			if tracerShutdown == nil {
+				return nil
+			}
+			return tracerShutdown(ctx)
+		},
+	})
+
+	a.Lifecycle.Register("mongodb", lifecycle.Hooks{
+		OnStart: func(ctx context.Context) error {
+			a.log.Info().Str("uri", a.Config().RedactedMongoURI()).Msg("Attempting to ping database...")
+			if err := a.DB.Ping(ctx, nil); err != nil {
+				a.log.Error().Err(err).Msg("Failed to Ping the database")
+				return err
+			}
+			a.log.Info().Msg("Successfully connected to MongoDB server")
+			if err := a.Bans.EnsureIndexes(ctx); err != nil {
+				a.log.Warn().Err(err).Msg("Failed to create ban list index")
+			}
+			if err := a.Votes.EnsureIndexes(ctx); err != nil {
+				a.log.Warn().Err(err).Msg("Failed to create vote indexes")
+			}
+			if err := a.Installs.EnsureIndexes(ctx); err != nil {
+				a.log.Warn().Err(err).Msg("Failed to create install indexes")
+			}
+			if err := database.EnsureCouponIndexes(ctx, a.DB.Database(CouponDatabase)); err != nil {
+				a.log.Warn().Err(err).Msg("Failed to create coupon indexes")
+			}
+			return nil
+		},
+		OnStop: a.DB.Disconnect,
+	})
+
+	a.Lifecycle.Register("session-pruner", lifecycle.Hooks{
+		OnStart: func(context.Context) error {
+			a.Sessions.StartPruner(a.Config().Schedulers.SessionPruneInterval)
+			return nil
+		},
+		OnStop: a.Sessions.Shutdown,
+	})
+
+	a.Lifecycle.Register("coupon-pruner", lifecycle.Hooks{
+		OnStart: func(context.Context) error {
+			a.couponPruner.Start()
+			return nil
+		},
+		OnStop: a.couponPruner.Shutdown,
+	})
+
+	a.Lifecycle.Register("blocklist-updater", lifecycle.Hooks{
+		OnStart: func(context.Context) error {
+			// Can also be toggled later by Reload
+			if a.Config().Blocklist.Enabled {
+				a.blocklist.Start()
+			}
+			return nil
+		},
+		OnStop: a.blocklist.Shutdown,
+	})
+
+	// Last to start and first to stop, apart from the coupon feed: Shutdown stops accepting connections and waits for in-flight requests
+	a.Lifecycle.Register("http-server", lifecycle.Hooks{
+		OnStart: func(context.Context) error {
+			if a.listener == nil {
+				// Listen here so a taken port fails startup instead of a background goroutine
+				listener, err := net.Listen("tcp", ":"+strconv.FormatUint(uint64(a.Config().Server.Port), 10))
+				if err != nil {
+					return err
+				}
+				a.listener = listener
+			}
+			a.Echo.Listener = a.listener
+			address := a.listener.Addr().String()
+			go func() {
+				a.log.Info().Str("address", address).Msg("Starting Echo web server")
+				if err := a.Echo.Start(address); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					a.log.Error().Err(err).Msg("Echo server stopped unexpectedly")
+					a.Lifecycle.Fail(err)
+				}
+			}()
+			return nil
+		},
+		OnStop: a.Echo.Shutdown,
+	})
+
+	// Stops before the HTTP server, closing the feed ends open streams so Shutdown doesn't wait on them
+	a.Lifecycle.Register("coupon-feed", lifecycle.Hooks{
+		OnStart: a.Feed.Start,
+		OnStop:  a.Feed.Stop,
+	})
+}
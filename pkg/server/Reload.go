@@ -0,0 +1,121 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/MisterNorwood/SugarCube-Server/internal/utils"
+	"github.com/rs/zerolog"
+)
+
+// Config keys (yaml paths or prefixes) that can change without a restart
+var reloadableKeys = []string{
+	"log.level",
+	"log.privacy",
+	"rate_limit.",
+	"blocklist.",
+	"schedulers.",
+	"sessions.",
+	"cors.allow_origins",
+	"admin.api_keys",
+	"admin.api_keys_file",
+	"api.",
+	"auth.",
+	"reputation.",
+	"votes.",
+	"stream.",
+	"cache.",
+}
+
+// Reload applies the settings from next that are safe to change live and logs every change.
+// Restart-only settings keep their running values. An invalid config is rejected as a whole.
+func (a *App) Reload(next Config) error {
+	if err := next.Validate(); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	changes := utils.DiffConfig(a.cfg, next)
+	if len(changes) == 0 {
+		a.log.Info().Msg("Configuration unchanged")
+		return nil
+	}
+
+	// Start from the running config so restart-only settings keep their current values
+	applied := a.cfg
+	for _, change := range changes {
+		event := a.log.Info()
+		if !isReloadable(change.Key) {
+			event = a.log.Warn().Bool("requires_restart", true)
+		}
+		event.
+			Str("key", change.Key).
+			Str("old", change.Old).
+			Str("new", change.New).
+			Msg("Configuration changed")
+	}
+
+	applied.Log.Level = next.Log.Level
+	applied.Log.Privacy = next.Log.Privacy
+	applied.RateLimit = next.RateLimit
+	applied.Blocklist = next.Blocklist
+	applied.Schedulers = next.Schedulers
+	applied.Sessions = next.Sessions
+	applied.CORS.AllowOrigins = next.CORS.AllowOrigins
+	applied.Admin = next.Admin
+	applied.API = next.API
+	applied.Auth = next.Auth
+	applied.Reputation = next.Reputation
+	applied.Votes = next.Votes
+	applied.Stream = next.Stream
+	applied.Cache = next.Cache
+
+	a.applyConfig(&applied)
+	a.cfg = applied
+	a.log.Info().Int("changes", len(changes)).Msg("Configuration reloaded")
+	return nil
+}
+
+func (a *App) applyConfig(cfg *Config) {
+	if level, err := zerolog.ParseLevel(cfg.Log.Level); err == nil {
+		zerolog.SetGlobalLevel(level)
+	}
+	utils.SetLogPrivacy(cfg.Log.Privacy)
+
+	a.rateLimiter.Update(cfg.RateLimit)
+	a.cors.Update(cfg.CORS)
+	a.versions.Update(cfg.API)
+	a.Installs.SetSecrets(cfg.Auth.TokenSecrets)
+	a.installAuth.SetRequired(cfg.Auth.RequireInstallToken)
+	a.Installs.SetRegistrationLimit(cfg.Auth.RegistrationsPerIP)
+	a.Reputation.SetConfig(cfg.Reputation)
+	a.Votes.SetConfig(cfg.Votes)
+	a.Feed.SetMaxSubscribers(cfg.Stream.MaxSubscribers)
+	a.Feed.SetMaxPerIP(cfg.Stream.MaxPerIP)
+	a.Handler.SetStreamHeartbeat(cfg.Stream.Heartbeat)
+	a.Cache.SetConfig(cfg.Cache)
+	a.Handler.SetCouponConfig(cfg.Coupons)
+	a.adminAuth.SetKeys(cfg.Admin.APIKeys)
+
+	a.Sessions.SetConfig(cfg.Sessions)
+	a.Sessions.SetPruneInterval(cfg.Schedulers.SessionPruneInterval)
+	a.couponPruner.SetInterval(cfg.Schedulers.CouponPruneInterval)
+
+	a.blocklist.SetSources(cfg.Blocklist.Sources)
+	a.blocklist.SetInterval(cfg.Schedulers.BlocklistInterval)
+	if cfg.Blocklist.Enabled && !a.blocklist.Running() {
+		a.blocklist.Start()
+	} else if !cfg.Blocklist.Enabled && a.blocklist.Running() {
+		a.blocklist.Stop()
+	}
+}
+
+func isReloadable(key string) bool {
+	for _, prefix := range reloadableKeys {
+		if key == prefix || (strings.HasSuffix(prefix, ".") && strings.HasPrefix(key, prefix)) {
+			return true
+		}
+	}
+	return false
+}
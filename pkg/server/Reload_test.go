@@ -0,0 +1,34 @@
+package server
+
+import "testing"
+
+func TestIsReloadable(t *testing.T) {
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"log.level", true},
+		{"log.privacy", true},
+		{"log.format", false},
+		{"log.file_path", false},
+		{"sessions.max_per_ip", true},
+		{"rate_limit.burst", true},
+		{"cors.allow_origins", true},
+		{"cors.max_age", false},
+		{"admin.api_keys", true},
+		{"admin.api_keys_extra", false},
+		{"server.port", false},
+		{"db.uri", false},
+		{"cache.ttl", true},
+		// Stored code keys were made under the running rule
+		{"coupons.case_sensitive", false},
+		{"coupons.site_case_sensitive", false},
+		{"sessions", false},
+		{"sessionsx.ttl", false},
+	}
+	for _, tt := range tests {
+		if got := isReloadable(tt.key); got != tt.want {
+			t.Errorf("isReloadable(%q) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/MisterNorwood/SugarCube-Server/internal/middleware"
+	"github.com/MisterNorwood/SugarCube-Server/internal/openapi"
+	"github.com/MisterNorwood/SugarCube-Server/pkg/types"
+	"github.com/labstack/echo/v4"
+)
+
+// Every route is added through a routeGroup so it is documented and validated;
+// checkRoutesDocumented catches any that aren't.
+type routeGroup struct {
+	group  *echo.Group
+	prefix string
+	spec   *openapi.Spec
+}
+
+func (g routeGroup) add(method, path string, handler echo.HandlerFunc, op openapi.Operation) {
+	validate := g.spec.Add(method, g.prefix+path, op)
+	g.group.Add(method, path, handler, validate)
+}
+
+// One implementation of an endpoint per API version, versions left out don't have it
+type versioned map[string]endpoint
+
+type endpoint struct {
+	handler echo.HandlerFunc
+	op      openapi.Operation
+}
+
+// allVersions is for endpoints whose bodies are the same in every version
+func allVersions(handler echo.HandlerFunc, op openapi.Operation) versioned {
+	impls := versioned{}
+	for _, version := range types.APIVersions {
+		impls[version] = endpoint{handler, op}
+	}
+	return impls
+}
+
+func withBody(op openapi.Operation, body any) openapi.Operation {
+	op.Body = body
+	return op
+}
+
+func withResponse(op openapi.Operation, response any) openapi.Operation {
+	op.Response = response
+	return op
+}
+
+type apiRoutes struct {
+	legacy   *echo.Group
+	versions map[string]*echo.Group
+	spec     *openapi.Spec
+	install  echo.MiddlewareFunc // Added to operations marked Install
+}
+
+// add mounts each implementation at /api/<version><path>, and all of them behind
+// /api<path>, which dispatches on the negotiated version.
+func (r apiRoutes) add(method, path string, impls versioned) {
+	chains := map[string]echo.HandlerFunc{}
+	var oldest *endpoint
+	for _, version := range types.APIVersions {
+		impl, ok := impls[version]
+		if !ok {
+			continue
+		}
+		if oldest == nil {
+			oldest = &impl
+		}
+		middlewares := []echo.MiddlewareFunc{r.spec.Add(method, "/api/"+version+path, impl.op)}
+		if impl.op.Install {
+			middlewares = append([]echo.MiddlewareFunc{r.install}, middlewares...)
+		}
+		r.versions[version].Add(method, path, impl.handler, middlewares...)
+		chain := impl.handler
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			chain = middlewares[i](chain)
+		}
+		chains[version] = chain
+	}
+
+	// Documented with the oldest shapes, that's what clients without the header get
+	op := oldest.op
+	op.Description = strings.TrimSpace(op.Description + " Unversioned path, the " + types.APIVersionHeader +
+		" header picks the version and the bodies of /api/<version>" + path + " apply.")
+	r.spec.Add(method, "/api"+path, op)
+	r.legacy.Add(method, path, func(c echo.Context) error {
+		chain, ok := chains[middleware.APIVersionOf(c)]
+		if !ok {
+			return echo.ErrNotFound
+		}
+		return chain(c)
+	})
+}
+
+func (a *App) setupRoutes() {
+	e, h := a.Echo, a.Handler
+	a.Spec = openapi.NewSpec(openapi.Info{
+		Title:       "SugarCube API",
+		Version:     types.LatestAPIVersion,
+		Description: "Coupon lookup and reporting API for the SugarCube browser extension",
+	})
+
+	// Tooling fetches the document without being the extension
+	e.GET("/api/openapi.json", a.Spec.Handler)
+
+	// Admin tooling isn't the extension, so it skips the user agent check
+	a.adminAuth = middleware.NewAdminAuth(a.cfg.Admin.APIKeys)
+	admin := routeGroup{e.Group("/api/admin", a.adminAuth.Middleware), "/api/admin", a.Spec}
+	admin.add(http.MethodPost, "/bans", h.BanIP, openapi.Operation{
+		Summary: "Ban an IP address",
+		Tags:    []string{"admin"},
+		Body:    types.BanRequest{},
+		Status:  http.StatusCreated,
+		Admin:   true,
+	})
+	admin.add(http.MethodDelete, "/bans/:ip", h.UnbanIP, openapi.Operation{
+		Summary: "Remove a ban",
+		Tags:    []string{"admin"},
+		Status:  http.StatusNoContent,
+		Admin:   true,
+	})
+	admin.add(http.MethodGet, "/sessions", h.SessionStats, openapi.Operation{
+		Summary:  "Session counts and limits",
+		Tags:     []string{"admin"},
+		Response: types.SessionStats{},
+		Admin:    true,
+	})
+	admin.add(http.MethodGet, "/quarantine", h.ListQuarantine, openapi.Operation{
+		Summary:     "List open quarantine cases",
+		Description: "Failure votes on a coupon are held back after a burst of them from few IPs, until the case is approved or rejected.",
+		Tags:        []string{"admin"},
+		Response:    []types.QuarantineCase{},
+		Admin:       true,
+	})
+	admin.add(http.MethodPost, "/quarantine/:id/approve", h.ApproveQuarantine, openapi.Operation{
+		Summary: "Apply the held back votes of a case",
+		Tags:    []string{"admin"},
+		Status:  http.StatusNoContent,
+		Admin:   true,
+	})
+	admin.add(http.MethodPost, "/quarantine/:id/reject", h.RejectQuarantine, openapi.Operation{
+		Summary: "Discard the held back votes of a case",
+		Tags:    []string{"admin"},
+		Status:  http.StatusNoContent,
+		Admin:   true,
+	})
+	admin.add(http.MethodPost, "/coupons/merge", h.MergeCoupons, openapi.Operation{
+		Summary: "Merge variants of coupon codes",
+		Description: "Merges coupons whose codes differ only in whitespace, or in case on sites that aren't case sensitive, " +
+			"adding up their scores and reports, and stores the matching key on every coupon. " +
+			"A variant whose other details would change a live coupon stays as a pending coupon until votes promote it into the live one. " +
+			"Run it once after upgrading and after changing the coupons settings. " +
+			"Sites it stops on are listed under failed with what was merged before, running it again handles the rest.",
+		Tags:     []string{"admin"},
+		Query:    []openapi.Param{{Name: "site", Description: "Only this site, every site without it"}},
+		Response: types.MergeReport{},
+		Admin:    true,
+	})
+	admin.add(http.MethodGet, "/coupons/pending", h.ListPending, openapi.Operation{
+		Summary: "List pending coupons",
+		Description: "Submissions from clients that aren't trusted yet, and variants whose details would change a live coupon. " +
+			"They go live once trusted votes bring them to reputation.promote_score, or when approved here.",
+		Tags:     []string{"admin"},
+		Query:    []openapi.Param{{Name: "site", Description: "Only this site, every site without it"}},
+		Response: []types.PendingCoupon{},
+		Admin:    true,
+	})
+	pendingParams := []openapi.Param{
+		{Name: "site", Description: "Site name, e.g. example.com", Required: true},
+		{Name: "coupon", Description: "Code of the pending coupon", Required: true},
+	}
+	admin.add(http.MethodPost, "/coupons/pending/approve", h.ApprovePending, openapi.Operation{
+		Summary:     "Make a pending coupon live",
+		Description: "Whatever its score. A variant is merged into the live coupon it differs from.",
+		Tags:        []string{"admin"},
+		Query:       pendingParams,
+		Status:      http.StatusNoContent,
+		Admin:       true,
+	})
+	admin.add(http.MethodPost, "/coupons/pending/reject", h.RejectPending, openapi.Operation{
+		Summary: "Delete a pending coupon",
+		Tags:    []string{"admin"},
+		Query:   pendingParams,
+		Status:  http.StatusNoContent,
+		Admin:   true,
+	})
+	admin.add(http.MethodDelete, "/installs/:id", h.RevokeInstall, openapi.Operation{
+		Summary:     "Revoke an install token",
+		Description: "The install can no longer write or send callbacks.",
+		Tags:        []string{"admin"},
+		Query:       []openapi.Param{{Name: "reason", Description: "Kept with the install for later reference"}},
+		Status:      http.StatusNoContent,
+		Admin:       true,
+	})
+
+	a.setupAPIRoutes()
+	a.checkRoutesDocumented()
+}
+
+// setupAPIRoutes mounts the extension routes per version under /api/<version> and once
+// more unversioned under /api, where the SC-Api-version header picks the version
+func (a *App) setupAPIRoutes() {
+	e, h := a.Echo, a.Handler
+	a.versions = middleware.NewAPIVersions(a.cfg.API, !a.cfg.Debug)
+	api := apiRoutes{
+		legacy:   e.Group("/api", a.versions.Negotiate),
+		versions: map[string]*echo.Group{},
+		spec:     a.Spec,
+		install:  a.installAuth.Middleware,
+	}
+	for _, version := range types.APIVersions {
+		api.versions[version] = e.Group("/api/"+version, a.versions.Path(version))
+	}
+
+	api.add(http.MethodPost, "/register", allVersions(h.RegisterInstall, openapi.Operation{
+		Summary:     "Register an extension install",
+		Description: "Done once per install, the token is required on writes and callbacks. Limited per IP per hour, see auth.registrations_per_ip.",
+		Tags:        []string{"installs"},
+		Response:    types.RegisterResponse{},
+		Status:      http.StatusCreated,
+	}))
+
+	siteParam := openapi.Param{Name: "site", Description: "Site name, e.g. example.com", Required: true}
+	regionParam := openapi.Param{Name: "region", Description: "ISO 3166-1 alpha-2 country, e.g. DE. Defaults to the client's IP country or Accept-Language region"}
+	filterParams := []openapi.Param{
+		{Name: "discount_type", Description: "percent or fixed"},
+		{Name: "free_shipping", Description: "true keeps coupons with free shipping only"},
+		{Name: "cart_total", Description: "Drops coupons with a higher min_order_value and values percent discounts on this cart"},
+		{Name: "category", Description: "Drops coupons limited to other categories"},
+		{Name: "first_order", Description: "false drops coupons that only work on a first order"},
+		{Name: "currency", Description: "ISO 4217 code, e.g. EUR. Values coupons on the savings reported in it, by default the currency most amounts on the site are in"},
+		{Name: "sort", Description: "value, the default, orders by expected savings: the median reported, else the promised discount, times how often the coupon applied. score orders by score"},
+	}
+	apiVersionParam := openapi.Param{Name: types.APIVersionQuery, Description: "API version for clients that can't send the " + types.APIVersionHeader + " header"}
+	getCoupons := openapi.Operation{
+		Summary: "List the coupons of a site",
+		Description: "Also opens a session, report which coupons worked with its request ID to the callback. " +
+			"Coupons limited to other regions are left out, ones voted down in the region come last.",
+		Tags:  []string{"coupons"},
+		Query: append([]openapi.Param{siteParam, regionParam}, filterParams...),
+	}
+	getCouponsV2 := getCoupons
+	getCouponsV2.Description = "Cacheable, with an ETag for If-None-Match. Open a session with POST /api/v2/session before testing the coupons. " +
+		"Coupons limited to other regions are left out, ones voted down in the region come last."
+	api.add(http.MethodGet, "/coupons", versioned{
+		types.APIVersionV1: {h.GetCouponsForPage, withResponse(getCoupons, types.SiteGetRequestResponse{})},
+		types.APIVersionV2: {h.GetCouponsForPageV2, withResponse(getCouponsV2, types.CouponsResponse{})},
+	})
+	api.add(http.MethodPost, "/coupons", allVersions(h.AddCouponToSite, openapi.Operation{
+		Summary: "Add a coupon to a site",
+		Description: "A variant of a code the site has, differing in whitespace or case, is merged into it. " +
+			"If it would change the details of a live coupon it's pending until votes promote it instead.",
+		Tags:    []string{"coupons"},
+		Query:   []openapi.Param{siteParam},
+		Body:    types.CouponEntry{},
+		Status:  http.StatusCreated,
+		Install: true,
+	}))
+	api.add(http.MethodPost, "/site", allVersions(h.RequestAddSite, openapi.Operation{
+		Summary: "Add a site",
+		Tags:    []string{"sites"},
+		Query:   []openapi.Param{{Name: "url", Description: "Site name, e.g. example.com", Required: true}},
+		Status:  http.StatusCreated,
+		Install: true,
+	}))
+	api.add(http.MethodGet, "/coupons/stream", allVersions(h.StreamCoupons, openapi.Operation{
+		Summary: "Stream coupon changes of a site",
+		Description: "Server-sent events named added, rescored, expired and pruned, each with a CouponEvent as data. " +
+			"A WebSocket upgrade on the same path gets the events as JSON messages instead, " +
+			"from an origin in cors.allow_origins if the request has one. " +
+			"Changes to pending coupons aren't streamed. Open streams are limited per IP.",
+		Tags:     []string{"coupons"},
+		Query:    []openapi.Param{siteParam, apiVersionParam},
+		Response: types.CouponEvent{},
+	}))
+	api.add(http.MethodPost, "/session", allVersions(h.CreateSession, openapi.Operation{
+		Summary: "Open a session for testing coupons",
+		Description: "Open it right before trying the codes, the callback reports on them with the session ID. " +
+			"Its votes also count toward the coupons' scores in the region.",
+		Tags:     []string{"coupons"},
+		Query:    []openapi.Param{siteParam, regionParam},
+		Body:     types.SessionRequest{},
+		Response: types.SessionResponse{},
+		Status:   http.StatusCreated,
+		Install:  true,
+	}))
+	callback := openapi.Operation{
+		Summary:     "Report which coupons worked",
+		Description: "Each session can report once, before it expires.",
+		Tags:        []string{"coupons"},
+		Status:      http.StatusAccepted,
+		Install:     true,
+	}
+	callbackV2 := callback
+	callbackV2.Description = callback.Description + " Reports with the discount and cart total rank the coupons by what they save."
+	api.add(http.MethodPost, "/callback", versioned{
+		types.APIVersionV1: {h.RecieveCallBack, withBody(callback, types.CallbackResponse{})},
+		types.APIVersionV2: {h.RecieveCallBackV2, withBody(callbackV2, types.CallbackRequest{})},
+	})
+}
+
+// Routes added straight on Echo skip validation and are missing from the document
+func (a *App) checkRoutesDocumented() {
+	for _, route := range a.Echo.Routes() {
+		switch route.Method {
+		case http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		default:
+			continue // Echo's internal not-found routes for groups
+		}
+		if route.Path == "/api/openapi.json" || a.Spec.Has(route.Method, route.Path) {
+			continue
+		}
+		a.log.Warn().Str("method", route.Method).Str("path", route.Path).Msg("Route missing from the OpenAPI document")
+	}
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MisterNorwood/SugarCube-Server/internal/api"
+	"github.com/MisterNorwood/SugarCube-Server/internal/middleware"
+	"github.com/MisterNorwood/SugarCube-Server/internal/openapi"
+	"github.com/MisterNorwood/SugarCube-Server/internal/services"
+	"github.com/MisterNorwood/SugarCube-Server/internal/utils"
+	"github.com/MisterNorwood/SugarCube-Server/pkg/types"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+)
+
+// routesApp mounts the extension routes on an App without a database. Reputation is off so
+// reads need no lookup, and the site's list is in the cache already.
+func routesApp(t *testing.T) *App {
+	t.Helper()
+	cfg := DefaultConfig()
+	sessions := services.NewSessionManager(utils.SessionConfig{TTL: time.Hour, Eviction: utils.EvictOldest})
+	installs := services.NewInstallService(nil, []string{"secret"})
+	reputation := services.NewReputationService(nil, utils.ReputationConfig{})
+	cache := services.NewSiteCache(utils.CacheConfig{TTL: time.Hour, MaxAge: time.Minute, MaxSites: 10})
+	_, err := cache.Get(context.Background(), "example.com", true, func(context.Context) (*types.Site, error) {
+		return &types.Site{Name: "example.com", CouponEntries: []types.CouponEntry{{Coupon: "SAVE10", Score: 1}}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	e.HTTPErrorHandler = api.HTTPErrorHandler
+	a := &App{
+		Echo:        e,
+		Handler:     api.NewHandler(nil, sessions, nil, installs, reputation, nil, nil, cache, nil),
+		Spec:        openapi.NewSpec(openapi.Info{Title: "test"}),
+		log:         zerolog.Nop(),
+		cfg:         cfg,
+		installAuth: middleware.NewInstallAuth(installs, false),
+	}
+	a.setupAPIRoutes()
+	return a
+}
+
+func serve(a *App, method, target, version, body string) *httptest.ResponseRecorder {
+	var req *http.Request
+	if body == "" {
+		req = httptest.NewRequest(method, target, nil)
+	} else {
+		req = httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	}
+	if version != "" {
+		req.Header.Set(types.APIVersionHeader, version)
+	}
+	rec := httptest.NewRecorder()
+	a.Echo.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestGetCouponsVersions(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		header string
+		want   string // Version whose body comes back
+	}{
+		{"unversioned v1", "/api/coupons", types.APIVersionV1, types.APIVersionV1},
+		{"unversioned v2", "/api/coupons", types.APIVersionV2, types.APIVersionV2},
+		{"v1 path", "/api/v1/coupons", types.APIVersionV1, types.APIVersionV1},
+		{"v2 path", "/api/v2/coupons", types.APIVersionV2, types.APIVersionV2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(routesApp(t), http.MethodGet, tt.path+"?site=example.com", tt.header, "")
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+			if got := rec.Header().Get(types.ServedVersionHeader); got != tt.want {
+				t.Fatalf("served %q, want %q", got, tt.want)
+			}
+
+			var body map[string]json.RawMessage
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == types.APIVersionV1 {
+				var resp types.SiteGetRequestResponse
+				if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.RequestUUID == uuid.Nil || len(resp.RequestedSite.CouponEntries) != 1 {
+					t.Fatalf("not a v1 body with a session: %s", rec.Body)
+				}
+				if rec.Header().Get("ETag") != "" {
+					t.Fatal("v1 list has an ETag, it opens a session")
+				}
+				return
+			}
+			if _, ok := body["RequestID"]; ok {
+				t.Fatalf("v2 body opened a session: %s", rec.Body)
+			}
+			var resp types.CouponsResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || len(resp.Site.CouponEntries) != 1 {
+				t.Fatalf("not a v2 body: %s", rec.Body)
+			}
+			if rec.Header().Get("ETag") == "" {
+				t.Fatal("v2 list has no ETag")
+			}
+		})
+	}
+}
+
+func TestCallbackVersions(t *testing.T) {
+	id := uuid.NewString()
+	v1 := `{"RequestID":"` + id + `","Site":"example.com","Results":{"SAVE10":true}}`
+	v2 := `{"request_id":"` + id + `","site":"example.com","results":{"SAVE10":true}}`
+	tests := []struct {
+		name    string
+		path    string
+		header  string
+		body    string
+		status  int
+		message string
+	}{
+		// The session is unknown, so a body that reached its handler ends there
+		{"unversioned v1", "/api/callback", types.APIVersionV1, v1, http.StatusForbidden, "Session not found"},
+		{"unversioned v2", "/api/callback", types.APIVersionV2, v2, http.StatusForbidden, "Session not found"},
+		{"v1 path", "/api/v1/callback", types.APIVersionV1, v1, http.StatusForbidden, "Session not found"},
+		{"v2 path", "/api/v2/callback", types.APIVersionV2, v2, http.StatusForbidden, "Session not found"},
+		{"v2 body to v1", "/api/callback", types.APIVersionV1, v2, http.StatusBadRequest, "Invalid request body"},
+		{"v1 body to v2", "/api/callback", types.APIVersionV2, v1, http.StatusBadRequest, "Invalid request body"},
+		{"results not a map", "/api/v2/callback", types.APIVersionV2, `{"request_id":"` + id + `","site":"example.com","results":[true]}`, http.StatusBadRequest, "Invalid request body"},
+		{"not json", "/api/v1/callback", types.APIVersionV1, `{`, http.StatusBadRequest, "Invalid JSON format"},
+		{"header and path disagree", "/api/v1/callback", types.APIVersionV2, v1, http.StatusBadRequest, "path is for v1"},
+		{"unknown version", "/api/callback", "v9", v1, http.StatusForbidden, ""},
+		{"no version", "/api/callback", "", v1, http.StatusForbidden, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(routesApp(t), http.MethodPost, tt.path, tt.header, tt.body)
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			var resp types.ErrorResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || !strings.Contains(resp.Error, tt.message) {
+				t.Fatalf("got %s, want an error with %q", rec.Body, tt.message)
+			}
+		})
+	}
+}
+
+// The spec validator runs on every version of each documented route, before the handler
+func TestRoutesValidated(t *testing.T) {
+	tests := []struct {
+		method  string
+		path    string
+		body    string
+		message string
+	}{
+		{http.MethodGet, "/coupons", "", "Missing site parameter"},
+		{http.MethodGet, "/coupons/stream", "", "Missing site parameter"},
+		{http.MethodPost, "/coupons?site=example.com", `{"coupon":5}`, "Invalid request body"},
+		{http.MethodPost, "/site", "", "Missing url parameter"},
+		{http.MethodPost, "/session?site=example.com", `{"coupons":"SAVE10"}`, "Invalid request body"},
+		{http.MethodPost, "/callback", `{}`, "Invalid request body"},
+	}
+	a := routesApp(t)
+	for _, tt := range tests {
+		for _, version := range types.APIVersions {
+			for _, prefix := range []string{"/api", "/api/" + version} {
+				t.Run(tt.method+" "+prefix+tt.path, func(t *testing.T) {
+					rec := serve(a, tt.method, prefix+tt.path, version, tt.body)
+					var resp types.ErrorResponse
+					if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusBadRequest || !strings.HasPrefix(resp.Error, tt.message) {
+						t.Fatalf("status %d: %s, want a 400 with %q", rec.Code, rec.Body, tt.message)
+					}
+				})
+			}
+		}
+	}
+
+	for _, route := range a.Echo.Routes() {
+		if strings.HasPrefix(route.Path, "/api") && route.Method != echo.RouteNotFound && !a.Spec.Has(route.Method, route.Path) {
+			t.Errorf("%s %s isn't documented, so it isn't validated", route.Method, route.Path)
+		}
+	}
+}
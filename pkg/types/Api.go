@@ -0,0 +1,117 @@
+package types
+
+import "time"
+
+const (
+	// Every /api request from the extension must carry the API version.
+	// On unversioned paths (/api/coupons) it picks the version, on /api/v2/coupons it must match the path.
+	APIVersionHeader = "SC-Api-version"
+	// Stands in for the header where clients can't set one, EventSource and WebSocket
+	APIVersionQuery = "api_version"
+	APIVersionV1    = "v1"
+	APIVersionV2    = "v2"
+	// Version the unversioned paths had before versioning, still what old extension builds send
+	APIVersion       = APIVersionV1
+	LatestAPIVersion = APIVersionV2
+
+	// Response header naming the version that served the request
+	ServedVersionHeader = "X-API-Version"
+
+	AdminKeyHeader  = "X-Admin-Key"
+	RequestIDHeader = "X-Request-ID"
+	// Token from POST /api/register, required on writes and callbacks
+	InstallTokenHeader = "SC-Install-Token"
+)
+
+// Every supported version, oldest first
+var APIVersions = []string{APIVersionV1, APIVersionV2}
+
+// Body of every error response
+type ErrorResponse struct {
+	Error     string `json:"error"`
+	Code      string `json:"code"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// Values of ErrorResponse.Code
+const (
+	CodeBadRequest           = "bad_request"
+	CodeInvalid              = "invalid"
+	CodeUnauthorized         = "unauthorized"
+	CodeForbidden            = "forbidden"
+	CodeNotFound             = "not_found"
+	CodeMethodNotAllowed     = "method_not_allowed"
+	CodeConflict             = "conflict"
+	CodePayloadTooLarge      = "payload_too_large"
+	CodeUnsupportedMediaType = "unsupported_media_type"
+	CodeRateLimited          = "rate_limited"
+	CodeUnavailable          = "unavailable"
+	CodeInternal             = "internal"
+	CodeError                = "error"
+)
+
+// Response of POST /api/register. Keep the token, every install registers once.
+type RegisterResponse struct {
+	InstallID string `json:"install_id"`
+	Token     string `json:"token" doc:"Send it in the SC-Install-Token header"`
+}
+
+// An open quarantine case from GET /api/admin/quarantine: failure votes on a coupon held
+// back after a burst from few sources
+type QuarantineCase struct {
+	ID          string    `json:"id"`
+	Site        string    `json:"site"`
+	Coupon      string    `json:"coupon"`
+	Votes       int       `json:"votes" doc:"Votes held back so far"`
+	Sources     int       `json:"sources" doc:"Distinct IPs the held votes came from"`
+	ScoreChange float64   `json:"score_change" doc:"Applied to the coupon's score if the case is approved"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// A coupon from GET /api/admin/coupons/pending, waiting for votes or an admin to promote it
+type PendingCoupon struct {
+	Site      string      `json:"site"`
+	Coupon    CouponEntry `json:"coupon"`
+	VariantOf string      `json:"variant_of,omitempty" doc:"Live code it's merged into once promoted, for a variant whose details differ"`
+}
+
+// Response of POST /api/admin/coupons/merge
+type MergeReport struct {
+	Merges []CouponMerge  `json:"merges" doc:"Empty if no site had variants of a code"`
+	Failed []MergeFailure `json:"failed,omitempty" doc:"Sites the merge stopped on, the merges listed for them were applied"`
+}
+
+// A site whose merge stopped partway
+type MergeFailure struct {
+	Site  string `json:"site"`
+	Error string `json:"error"`
+}
+
+// Variants of a code merged into the coupon that was kept
+type CouponMerge struct {
+	Site     string   `json:"site"`
+	Coupon   string   `json:"coupon" doc:"The code that was kept"`
+	Variants []string `json:"variants" doc:"The codes merged into it, they no longer exist"`
+	Pending  []string `json:"pending,omitempty" doc:"Codes whose votes were merged into it but whose other details differ. They're pending until votes promote them into the kept code"`
+}
+
+// Response of GET /api/admin/sessions. The totals count since the server started.
+type SessionStats struct {
+	Active        int    `json:"active" doc:"Open sessions"`
+	Clients       int    `json:"clients" doc:"IPs holding open sessions"`
+	MaxSessions   uint64 `json:"max_sessions" doc:"0 is unlimited"`
+	MaxPerIP      uint64 `json:"max_per_ip" doc:"0 is unlimited"`
+	Created       uint64 `json:"created"`
+	Consumed      uint64 `json:"consumed" doc:"Ended by their callback"`
+	Expired       uint64 `json:"expired"`
+	Evicted       uint64 `json:"evicted" doc:"Pushed out to make room for new ones"`
+	RejectedFull  uint64 `json:"rejected_full" doc:"Refused at max_sessions"`
+	RejectedQuota uint64 `json:"rejected_quota" doc:"Refused at max_per_ip"`
+}
+
+// Body of POST /api/admin/bans
+type BanRequest struct {
+	IP     string `json:"ip" openapi:"required" doc:"IPv4 or IPv6 address"`
+	Reason string `json:"reason,omitempty"`
+}
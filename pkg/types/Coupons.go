@@ -0,0 +1,145 @@
+// Package types holds the request and response bodies of the SugarCube API.
+// The server and pkg/client both use them, so they can't drift apart.
+// The doc and openapi field tags feed the document served at /api/openapi.json.
+package types
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type CouponEntry struct {
+	Coupon         string    `bson:"coupon" json:"coupon" openapi:"required" doc:"The coupon code"`                                                             //Actual coupon
+	Score          float64   `bson:"score" json:"score" doc:"Callback votes weighted by the voter's reputation, coupons below 0 are pruned. Set by the server"` //Internal, a score to track how effective the code is
+	ExpiresAt      time.Time `bson:"expires_at" json:"expires_at" doc:"RFC 3339 timestamp"`                                                                     //IMPORTANT: ISO8601-formatted
+	Status         string    `bson:"status,omitempty" json:"status,omitempty" doc:"live or pending, set by the server"`
+	Regions        []string  `bson:"regions,omitempty" json:"regions,omitempty" doc:"ISO 3166-1 alpha-2 countries the coupon works in, none is everywhere"`
+	Currency       string    `bson:"currency,omitempty" json:"currency,omitempty" doc:"ISO 4217 code of the amounts, e.g. EUR"`
+	Locale         string    `bson:"locale,omitempty" json:"locale,omitempty" doc:"BCP 47 tag of the shop the coupon is for, e.g. de-AT"`
+	DiscountType   string    `bson:"discount_type,omitempty" json:"discount_type,omitempty" doc:"percent or fixed"`
+	DiscountAmount float64   `bson:"discount_amount,omitempty" json:"discount_amount,omitempty" doc:"Percent off, or the amount off in currency"`
+	MinOrderValue  float64   `bson:"min_order_value,omitempty" json:"min_order_value,omitempty" doc:"Cart total the coupon needs, in currency"`
+	FreeShipping   bool      `bson:"free_shipping,omitempty" json:"free_shipping,omitempty"`
+	Categories     []string  `bson:"categories,omitempty" json:"categories,omitempty" doc:"Product categories the coupon is limited to, none is the whole shop"`
+	FirstOrderOnly bool      `bson:"first_order_only,omitempty" json:"first_order_only,omitempty" doc:"Only works on a customer's first order"`
+	SourceURL      string    `bson:"source_url,omitempty" json:"source_url,omitempty" doc:"Where the coupon was found"`
+	// What callbacks reported, the list is ranked by it
+	ReportsApplied int64           `bson:"reports_applied,omitempty" json:"reports_applied,omitempty" doc:"Callbacks the coupon applied in. Set by the server"`
+	ReportsFailed  int64           `bson:"reports_failed,omitempty" json:"reports_failed,omitempty" doc:"Callbacks the coupon didn't apply in. Set by the server"`
+	SavingsSamples []SavingsSample `bson:"savings_samples,omitempty" json:"-"` // The latest reported savings
+	MedianSavings  float64         `bson:"-" json:"median_savings,omitempty" doc:"Median discount callbacks reported, in savings_currency. Set by the server"`
+	ExpectedValue  float64         `bson:"-" json:"expected_value,omitempty" doc:"What trying the coupon saves on average, lists are sorted by it. Set by the server"`
+	// Amounts in other currencies aren't comparable, so they're left out of both
+	SavingsCurrency string `bson:"-" json:"savings_currency,omitempty" doc:"Currency of median_savings and expected_value, the currency param or the one most amounts on the site are in. Set by the server"`
+	// Keyed by region, so a coupon that fails in one country doesn't drag down the others
+	RegionScores map[string]float64 `bson:"region_scores,omitempty" json:"region_scores,omitempty" doc:"Score from voters in each region. Set by the server"`
+	CodeKey      string             `bson:"code_key,omitempty" json:"-"`                                                                                             //Shared by variants of the code, see utils.CouponKey
+	VariantOf    string             `bson:"variant_of,omitempty" json:"-"`                                                                                           //Live coupon this pending variant is folded into once promoted
+	SubmittedBy  string             `bson:"submitted_by,omitempty" json:"-"`                                                                                         //Reputation key of the submitter
+	Extra        map[string]any     `bson:",inline" json:"extra,omitempty" doc:"Site specific fields. Nested under extra in JSON but stored inline in the database"` //Random stuff for other sites
+}
+
+// Values of CouponEntry.DiscountType
+const (
+	DiscountPercent = "percent"
+	DiscountFixed   = "fixed"
+)
+
+// One discount a callback reported for a coupon that applied
+type SavingsSample struct {
+	Discount  float64   `bson:"discount"`
+	CartTotal float64   `bson:"cart_total,omitempty"`
+	Currency  string    `bson:"currency,omitempty"`
+	At        time.Time `bson:"at"`
+}
+
+// Query params of GET /api/coupons that narrow the list down, all optional
+type CouponFilter struct {
+	DiscountType      string  // discount_type, percent or fixed
+	FreeShipping      bool    // free_shipping=true keeps coupons with free shipping only
+	CartTotal         float64 // cart_total drops coupons with a higher minimum and values percent coupons
+	Category          string  // category drops coupons limited to other categories
+	ExcludeFirstOrder bool    // first_order=false drops first order coupons
+	SortByScore       bool    // sort=score orders by score instead of expected value
+	Currency          string  // currency ranks on the savings reported in it
+}
+
+// Values of CouponEntry.Status, coupons stored before statuses existed have none and are live
+const (
+	CouponLive    = "live"
+	CouponPending = "pending" // Submitted by a client without enough reputation, only shown to trusted clients until votes promote it
+)
+
+type Site struct {
+	Name          string        `json:"name" doc:"Site name, e.g. example.com"` //URL
+	CouponEntries []CouponEntry `json:"coupon_entries"`
+}
+
+// Response of GET /api/coupons. RequestUUID has to be sent back in the callback.
+// The PascalCase keys are kept for existing extension builds.
+type SiteGetRequestResponse struct {
+	RequestUUID   uuid.UUID `json:"RequestID" doc:"Session ID, send it back as RequestID in the callback"`
+	RequestedSite Site      `json:"Site"`
+}
+
+// Body of POST /api/callback: which coupons worked on the site
+type CallbackResponse struct {
+	RequestID uuid.UUID       `json:"RequestID" openapi:"required" doc:"RequestID from GET /api/coupons"`
+	Site      string          `json:"Site" openapi:"required"`
+	Results   map[string]bool `json:"Results" openapi:"required" doc:"Coupon code to whether it worked"`
+}
+
+// v2 bodies use snake_case keys throughout
+
+// Response of GET /api/v2/coupons. It opens no session, so it can be cached.
+type CouponsResponse struct {
+	Site Site `json:"site"`
+}
+
+// Body of POST /api/session: the coupons the client is about to test
+type SessionRequest struct {
+	Coupons []string `json:"coupons" openapi:"required" doc:"Codes from the site's coupon list"`
+}
+
+// Response of POST /api/session
+type SessionResponse struct {
+	SessionID uuid.UUID `json:"session_id" doc:"Send it back as the request ID in the callback"`
+	Coupons   []string  `json:"coupons" doc:"The requested codes that are on the site, the callback may only report on these"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Region    string    `json:"region,omitempty" doc:"Region the session's votes are scored in"`
+}
+
+// Body of POST /api/v2/callback
+type CallbackRequest struct {
+	RequestID uuid.UUID               `json:"request_id" openapi:"required" doc:"session_id from POST /api/v2/session"`
+	Site      string                  `json:"site" openapi:"required"`
+	Results   map[string]bool         `json:"results,omitempty" doc:"Coupon code to whether it worked. Send reports instead to rank coupons by savings"`
+	Reports   map[string]CouponReport `json:"reports,omitempty" doc:"Coupon code to what happened when the client tried it. A code may be in results or reports, not both"`
+}
+
+// What happened to one coupon in a v2 callback
+type CouponReport struct {
+	Applied   bool    `json:"applied" openapi:"required" doc:"Whether the shop took the coupon"`
+	Discount  float64 `json:"discount,omitempty" doc:"Amount the coupon took off the cart"`
+	CartTotal float64 `json:"cart_total,omitempty" doc:"Cart total before the discount"`
+	Currency  string  `json:"currency,omitempty" doc:"ISO 4217 code of the amounts, e.g. EUR"`
+}
+
+// Values of CouponEvent.Type
+const (
+	EventAdded    = "added"    // New live coupon, or a pending one promoted
+	EventRescored = "rescored" // Score changed by votes
+	EventExpired  = "expired"  // Passed its expires_at
+	EventPruned   = "pruned"   // Removed for a negative score
+)
+
+// Pushed by GET /api/coupons/stream, over SSE as the event's data or as a WebSocket message
+type CouponEvent struct {
+	Type   string       `json:"type" doc:"added, rescored, expired or pruned"`
+	Site   string       `json:"site"`
+	Coupon string       `json:"coupon"`
+	Score  float64      `json:"score"`
+	Entry  *CouponEntry `json:"entry,omitempty" doc:"The whole coupon on added"`
+	At     time.Time    `json:"at"`
+}